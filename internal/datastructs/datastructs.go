@@ -1,110 +1,190 @@
-package datastructs
-
-import "time"
-
-type ControlPanel struct {
-	TypeArchive       int
-	StopService       bool
-	StartRecovery     bool
-	ReloadConfig      bool
-	StartManualBackup bool
-	RestoreToThisDate time.Time
-}
-
-type ArchiveTable struct {
-	ID              int
-	Name            string
-	Entity          string
-	DateColumn      string
-	ConditionFmt    string
-	RmInterval      string
-	RestoreTemplate string
-	DoBackup        bool
-	KeepRestore     int
-}
-
-type ArchivingOptions struct {
-	ID                   int
-	ArchDataAfter        int
-	KeepArchDays         int
-	KeepRestoreData      int
-	Schema               string
-	TblNamePattern       string
-	ArchIntervalName     string
-	Entity               string
-	ConditionFmt         string
-	DateColumn           string
-	TblNameDateFmtSbstr  string
-	TblNameDateFmtToDate string
-	RestoreTemplate      string
-}
-
-type ArchAvailableData struct {
-	ID              int
-	DataID          int
-	ContentRows     int64
-	SchemaName      string
-	TableName       string
-	FileName        string
-	// Comment         string
-	RestoreTemplate string
-	SingleTable     bool
-	ContentDate     time.Time
-	ArchivedAt      time.Time
-	RestoredAt      time.Time
-	DeletedAt       time.Time
-}
-
-type RestoreData struct {
-	ArchAvailableData
-	CurrentTemplate string
-}
-
-type ScheduleConfig struct {
-	DataID            int
-	CheckInterval     string
-	CheckIntervalDays []int
-	WorkStart         time.Time
-}
-
-func DefaultScheduleConfig() []*ScheduleConfig {
-	return []*ScheduleConfig{
-		{
-			DataID:            1,
-			CheckInterval:     "WEEK",
-			CheckIntervalDays: []int{7},
-		},
-		{
-			DataID:            2,
-			CheckInterval:     "WEEK",
-			CheckIntervalDays: []int{7},
-		},
-		{
-			DataID:            3,
-			CheckInterval:     "MONTH",
-			CheckIntervalDays: []int{1},
-		},
-		{
-			DataID:            4,
-			CheckInterval:     "MONTH",
-			CheckIntervalDays: []int{1, 15},
-		},
-		{
-			DataID:            5,
-			CheckInterval:     "WEEK",
-			CheckIntervalDays: []int{7},
-		},
-		{
-			DataID:            6,
-			CheckInterval:     "WEEK",
-			CheckIntervalDays: []int{1, 2, 3, 4, 5, 6, 7},
-		},
-	}
-}
-
-type ArchiveStorage struct {
-	DataID       int
-	Schemaname   string
-	KeepArchDays int
-}
-
+package datastructs
+
+import "time"
+
+type ControlPanel struct {
+	TypeArchive       int
+	StopService       bool
+	StartRecovery     bool
+	ReloadConfig      bool
+	StartManualBackup bool
+	StartKeyRotation  bool
+	StartReconcile    bool
+	ReconcileFix      bool
+	RestoreToThisDate time.Time
+}
+
+type ArchiveTable struct {
+	ID              int
+	Name            string
+	Entity          string
+	DateColumn      string
+	ConditionFmt    string
+	RmInterval      string
+	RestoreTemplate string
+	DoBackup        bool
+	KeepRestore     int
+	// the partitioned table and the bound (FOR VALUES ...) of the partition of the partition entity
+	Parent         string
+	PartitionBound string
+	// "move" moves the expired table of the table entity into the archive schema and tablespace
+	// instead of exporting its rows to the storage, the empty schema or tablespace is not changed
+	Action            string
+	ArchiveSchema     string
+	ArchiveTablespace string
+	// the definition of the table of the table entity captured by the backup, written into the gzip header of the archives
+	TableDDL string
+}
+
+type ArchivingOptions struct {
+	ID                   int
+	ArchDataAfter        int
+	KeepArchDays         int
+	KeepRestoreData      int
+	Schema               string
+	TblNamePattern       string
+	ArchIntervalName     string
+	Entity               string
+	ConditionFmt         string
+	DateColumn           string
+	TblNameDateFmtSbstr  string
+	TblNameDateFmtToDate string
+	RestoreTemplate      string
+}
+
+type ArchAvailableData struct {
+	ID              int
+	DataID          int
+	ContentRows     int64
+	SchemaName      string
+	TableName       string
+	FileName        string
+	Storage         string
+	// Comment         string
+	RestoreTemplate string
+	KeyID           string
+	Checksum        string
+	FileSize        int64
+	SingleTable     bool
+	ContentDate     time.Time
+	ArchivedAt      time.Time
+	RestoredAt      time.Time
+	DeletedAt       time.Time
+	// the partitioned table and the bound of the archived partition, the restore attaches the partition to it
+	Parent         string
+	PartitionBound string
+	// "move" - the table is moved in the database, the file name is the moved table and
+	// the restore moves it back to the schema and the source tablespace
+	Action           string
+	SourceTablespace string
+	// the definition of the archived single table, the restore creates the table by it without the template
+	TableDDL string
+}
+
+// LegalHold blocks deletion of the archives and the source data it covers, the empty fields match any value
+type LegalHold struct {
+	ID              int
+	DataID          int
+	AvailableDataID int
+	SchemaName      string
+	Reason          string
+	DateFrom        time.Time
+	DateTo          time.Time
+}
+
+// StorageDestination is the storage profile from the storage settings of the data type
+type StorageDestination struct {
+	DataID     int
+	Name       string
+	Protocol   string
+	Path       string
+	Host       string
+	Port       string
+	User       string
+	Password   string
+	AuthMethod string
+	PrivateKey string
+	Timeout    int64
+	// the storage period in days overrides keep_arch_days of the data type, 0 means not set
+	StoragePeriod int
+	AutoCleaning  bool
+}
+
+// ArchiveCopy is the copy of the archive in the replica storage, the source is the primary copy of the archive
+type ArchiveCopy struct {
+	AvailableDataID int
+	Attempts        int
+	Storage         string
+	FileName        string
+	Status          string
+	Error           string
+	SourceStorage   string
+	SourceFileName  string
+}
+
+type ReconcileIssue struct {
+	AvailableDataID int
+	Issue           string
+	FileName        string
+	Details         string
+	Fixed           bool
+}
+
+type RestoreData struct {
+	ArchAvailableData
+	CurrentTemplate string
+	DateColumn      string
+}
+
+type ScheduleConfig struct {
+	DataID            int
+	CheckInterval     string
+	CheckIntervalDays []int
+	WorkStart         time.Time
+}
+
+func DefaultScheduleConfig() []*ScheduleConfig {
+	return []*ScheduleConfig{
+		{
+			DataID:            1,
+			CheckInterval:     "WEEK",
+			CheckIntervalDays: []int{7},
+		},
+		{
+			DataID:            2,
+			CheckInterval:     "WEEK",
+			CheckIntervalDays: []int{7},
+		},
+		{
+			DataID:            3,
+			CheckInterval:     "MONTH",
+			CheckIntervalDays: []int{1},
+		},
+		{
+			DataID:            4,
+			CheckInterval:     "MONTH",
+			CheckIntervalDays: []int{1, 15},
+		},
+		{
+			DataID:            5,
+			CheckInterval:     "WEEK",
+			CheckIntervalDays: []int{7},
+		},
+		{
+			DataID:            6,
+			CheckInterval:     "WEEK",
+			CheckIntervalDays: []int{1, 2, 3, 4, 5, 6, 7},
+		},
+	}
+}
+
+type ArchiveStorage struct {
+	DataID       int
+	Schemaname   string
+	DateColumn   string
+	KeepArchDays int
+	KeepMonths   int
+	KeepLast     int
+	KeepYearly   bool
+}
+
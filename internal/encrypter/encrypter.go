@@ -0,0 +1,288 @@
+// Package encrypter provides streaming AES-256-GCM encryption of archive files.
+//
+// An encrypted archive starts with a header that contains the identifier of the key
+// used, so the archive can be decrypted without the catalog. The payload is split into
+// chunks, every chunk is sealed separately, the last chunk is marked to detect truncation.
+package encrypter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	keyFileExt = ".key"
+	keySize    = 32
+	chunkSize  = 64 * 1024
+	prefixSize = 8
+)
+
+var magic = []byte("CBRMENC1")
+
+var (
+	ErrUnknownKey   = errors.New("unknown encryption key")
+	ErrNotEncrypted = errors.New("data is not encrypted")
+	ErrCorrupted    = errors.New("encrypted data is corrupted")
+)
+
+// Keyring contains all known keys, the current key is used to encrypt new archives.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring returns keyring with keys where the map key is the key identifier.
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	for id, key := range keys {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("key [%s]: must be %d bytes length", id, keySize)
+		}
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("key [%s]: wrong identifier length", id)
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key [%s]: %w", current, ErrUnknownKey)
+	}
+	return &Keyring{current: current, keys: keys}, nil
+}
+
+// LoadKeyring reads keys from the folder. Each key is stored in a file <key_id>.key
+// and contains 64 hexadecimal characters.
+func LoadKeyring(folder, current string) (*Keyring, error) {
+	files, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte)
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != keyFileExt {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(folder, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("decode key file %s: %w", file.Name(), err)
+		}
+		keys[strings.TrimSuffix(file.Name(), keyFileExt)] = key
+	}
+	return NewKeyring(current, keys)
+}
+
+// CurrentKey returns the identifier of the key used for encryption.
+func (k *Keyring) CurrentKey() string {
+	return k.current
+}
+
+// Encrypt reads the src until EOF and writes the encrypted data into dst with the current key.
+func (k *Keyring) Encrypt(dst io.Writer, src io.Reader) error {
+	aead, err := newAEAD(k.keys[k.current])
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header := append(append(append([]byte{}, magic...), byte(len(k.current))), k.current...)
+	if _, err := dst.Write(append(header, prefix...)); err != nil {
+		return err
+	}
+
+	var (
+		counter uint32
+		buf     = make([]byte, chunkSize)
+		next    = make([]byte, 1)
+		hasNext bool
+	)
+	for {
+		n := 0
+		if hasNext {
+			buf[0] = next[0]
+			n = 1
+		}
+		m, err := io.ReadFull(src, buf[n:])
+		n += m
+		last := false
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			last = true
+		case err != nil:
+			return err
+		default:
+			// look ahead one byte to find out whether the chunk is the last one
+			_, err := io.ReadFull(src, next)
+			switch {
+			case err == io.EOF:
+				last = true
+			case err != nil:
+				return err
+			}
+			hasNext = !last
+		}
+
+		sealed := aead.Seal(nil, nonce(prefix, counter), buf[:n], chunkAD(last))
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(sealed)))
+		if _, err := dst.Write(append(size, sealed...)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		counter++
+	}
+}
+
+// EncryptReader returns the reader with encrypted data of the src.
+func (k *Keyring) EncryptReader(src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(k.Encrypt(pw, src))
+	}()
+	return pr
+}
+
+// DecryptReader returns the reader with decrypted data of the src, the key is taken from the header.
+func (k *Keyring) DecryptReader(src io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(src)
+	keyID, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("[%s]: %w", keyID, ErrUnknownKey)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, fmt.Errorf("read nonce prefix: %w", ErrCorrupted)
+	}
+	return &decryptReader{src: br, aead: aead, prefix: prefix}, nil
+}
+
+// Inspect returns a reader with the full content of the src and the identifier of the key
+// that encrypted it. An empty identifier means the data is not encrypted.
+func Inspect(src io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReader(src)
+	head, err := br.Peek(len(magic))
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	if !bytes.Equal(head, magic) {
+		return br, "", nil
+	}
+	length, err := br.Peek(len(magic) + 1)
+	if err != nil {
+		return nil, "", ErrCorrupted
+	}
+	header, err := br.Peek(len(magic) + 1 + int(length[len(magic)]))
+	if err != nil {
+		return nil, "", ErrCorrupted
+	}
+	return br, string(header[len(magic)+1:]), nil
+}
+
+func readHeader(r io.Reader) (string, error) {
+	head := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, head); err != nil || !bytes.Equal(head[:len(magic)], magic) {
+		return "", ErrNotEncrypted
+	}
+	keyID := make([]byte, head[len(magic)])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return "", fmt.Errorf("read key identifier: %w", ErrCorrupted)
+	}
+	return string(keyID), nil
+}
+
+type decryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) nextChunk() error {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(d.src, size); err != nil {
+		return fmt.Errorf("read chunk size: %w", ErrCorrupted)
+	}
+	length := binary.BigEndian.Uint32(size)
+	if length > chunkSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("chunk size %d: %w", length, ErrCorrupted)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.src, sealed); err != nil {
+		return fmt.Errorf("read chunk: %w", ErrCorrupted)
+	}
+	nonce := nonce(d.prefix, d.counter)
+	if plain, err := d.aead.Open(nil, nonce, sealed, chunkAD(false)); err == nil {
+		d.buf = plain
+		d.counter++
+		return nil
+	}
+	plain, err := d.aead.Open(nil, nonce, sealed, chunkAD(true))
+	if err != nil {
+		return fmt.Errorf("open chunk %d: %w", d.counter, ErrCorrupted)
+	}
+	d.buf = plain
+	d.done = true
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(prefix []byte, counter uint32) []byte {
+	n := make([]byte, prefixSize+4)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[prefixSize:], counter)
+	return n
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
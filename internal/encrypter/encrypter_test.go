@@ -0,0 +1,85 @@
+package encrypter
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyring(t *testing.T, current string, ids ...string) *Keyring {
+	keys := make(map[string][]byte)
+	for _, id := range ids {
+		key := make([]byte, keySize)
+		rand.Read(key)
+		keys[id] = key
+	}
+	kr, err := NewKeyring(current, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	kr := testKeyring(t, "2024", "2023", "2024")
+
+	testCases := []struct {
+		Name string
+		Size int
+	}{
+		{Name: "empty data", Size: 0},
+		{Name: "less than chunk", Size: 100},
+		{Name: "exactly one chunk", Size: chunkSize},
+		{Name: "several chunks", Size: 3*chunkSize + 17},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			plain := make([]byte, tc.Size)
+			rand.Read(plain)
+
+			var enc bytes.Buffer
+			assert.NoError(t, kr.Encrypt(&enc, bytes.NewReader(plain)))
+
+			r, keyID, err := Inspect(bytes.NewReader(enc.Bytes()))
+			assert.NoError(t, err)
+			assert.Equal(t, "2024", keyID)
+
+			dec, err := kr.DecryptReader(r)
+			if !assert.NoError(t, err) {
+				return
+			}
+			got, err := io.ReadAll(dec)
+			assert.NoError(t, err)
+			assert.Equal(t, plain, got)
+		})
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	kr := testKeyring(t, "k1", "k1")
+	plain := make([]byte, 2*chunkSize+1)
+
+	var enc bytes.Buffer
+	assert.NoError(t, kr.Encrypt(&enc, bytes.NewReader(plain)))
+
+	// cut off the last chunk
+	truncated := enc.Bytes()[:enc.Len()-(1+4+16)]
+	dec, err := kr.DecryptReader(bytes.NewReader(truncated))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.ReadAll(dec)
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
+
+func TestInspectPlainData(t *testing.T) {
+	r, keyID, err := Inspect(bytes.NewReader([]byte("plain gzip data")))
+	assert.NoError(t, err)
+	assert.Equal(t, "", keyID)
+	got, _ := io.ReadAll(r)
+	assert.Equal(t, "plain gzip data", string(got))
+}
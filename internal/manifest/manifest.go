@@ -0,0 +1,211 @@
+// Package manifest describes the archive files with a signed document used as evidence
+// that the archive was not modified after the backup.
+package manifest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// FileExt is appended to the archive file name to get the name of its manifest.
+const FileExt = ".manifest"
+
+var ErrBadSignature = errors.New("manifest signature is not valid")
+
+type Manifest struct {
+	// the data type and the kind of the archive let the catalog be rebuilt without the config of the data types
+	DataID         int       `json:"data_id,omitempty"`
+	SingleTable    bool      `json:"single_table,omitempty"`
+	Table          string    `json:"table"`
+	ContentDate    string    `json:"content_date"`
+	Rows           int64     `json:"rows"`
+	Size           int64     `json:"size"`
+	Checksum       string    `json:"checksum"`
+	DDLHash        string    `json:"ddl_hash"`
+	ServiceVersion string    `json:"service_version"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type signed struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+// Sign returns the manifest document with the signature.
+func Sign(m *Manifest, key ed25519.PrivateKey) ([]byte, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(signed{
+		Manifest:  body,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, body)),
+	}, "", "  ")
+}
+
+// Verify checks the signature of the manifest document and returns the manifest.
+func Verify(document []byte, key ed25519.PublicKey) (*Manifest, error) {
+	var doc signed
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(doc.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("decode signature: %w", err)
+	}
+	// the document is indented for readability, the signature is made on the compact form
+	body := new(bytes.Buffer)
+	if err := json.Compact(body, doc.Manifest); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	if !ed25519.Verify(key, body.Bytes(), signature) {
+		return nil, ErrBadSignature
+	}
+	var m Manifest
+	if err := json.Unmarshal(doc.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// Decode returns the manifest from the document without checking the signature.
+func Decode(document []byte) (*Manifest, error) {
+	var doc signed
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(doc.Manifest, &m); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// HashString returns the SHA-256 checksum of the text in hexadecimal.
+func HashString(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// ddlSubfield is the ID of the subfield of the gzip extra field (RFC 1952) with the definition of the archived table
+var ddlSubfield = [2]byte{'D', 'L'}
+
+// GzipExtra returns the gzip extra field keeping the definition of the archived table, so the definition
+// is kept in the archive file itself. The definition longer than the subfield can keep is not written.
+func GzipExtra(ddl string) []byte {
+	if ddl == "" || len(ddl) > 0xffff-4 {
+		return nil
+	}
+	extra := make([]byte, 4, 4+len(ddl))
+	extra[0], extra[1] = ddlSubfield[0], ddlSubfield[1]
+	binary.LittleEndian.PutUint16(extra[2:], uint16(len(ddl)))
+	return append(extra, ddl...)
+}
+
+// DDLFromGzipExtra returns the definition of the archived table from the gzip extra field, "" if there is none.
+func DDLFromGzipExtra(extra []byte) string {
+	for len(extra) >= 4 {
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return ""
+		}
+		if extra[0] == ddlSubfield[0] && extra[1] == ddlSubfield[1] {
+			return string(extra[4 : 4+size])
+		}
+		extra = extra[4+size:]
+	}
+	return ""
+}
+
+// Checksum counts the SHA-256 checksum and the size of the data written into it.
+type Checksum struct {
+	h    hash.Hash
+	size int64
+}
+
+func NewChecksum() *Checksum {
+	return &Checksum{h: sha256.New()}
+}
+
+func (c *Checksum) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return c.h.Write(p)
+}
+
+func (c *Checksum) Sum() string {
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+func (c *Checksum) Size() int64 {
+	return c.size
+}
+
+// ReadChecksum reads the r until EOF and returns its checksum and size.
+func ReadChecksum(r io.Reader) (string, int64, error) {
+	c := NewChecksum()
+	if _, err := io.Copy(c, r); err != nil {
+		return "", 0, err
+	}
+	return c.Sum(), c.Size(), nil
+}
+
+// LoadPrivateKey reads Ed25519 private key in PEM (PKCS #8) format,
+// e.g. created with: openssl genpkey -algorithm ed25519
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return private, nil
+}
+
+// LoadPublicKey reads Ed25519 public key in PEM (PKIX) format,
+// e.g. created with: openssl pkey -in private.pem -pubout
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	return public, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block, nil
+}
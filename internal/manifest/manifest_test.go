@@ -0,0 +1,57 @@
+package manifest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{
+		Table:       "raterresult.RT20230101",
+		ContentDate: "2023-01-01",
+		Rows:        42,
+		Checksum:    HashString("archive"),
+	}
+	document, err := Sign(m, private)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, err := Verify(document, public)
+	assert.NoError(t, err)
+	assert.Equal(t, m, got)
+
+	tampered := bytes.Replace(document, []byte(`"rows": 42`), []byte(`"rows": 43`), 1)
+	assert.NotEqual(t, document, tampered)
+	_, err = Verify(tampered, public)
+	assert.ErrorIs(t, err, ErrBadSignature)
+}
+
+func TestGzipExtra(t *testing.T) {
+	const ddl = `CREATE TABLE raterresult."RT20230101" ("ID" integer NOT NULL, "Сумма" numeric);`
+	archive := new(bytes.Buffer)
+	writer := gzip.NewWriter(archive)
+	writer.Extra = GzipExtra(ddl)
+	writer.Write([]byte("id\n1\n"))
+	if !assert.NoError(t, writer.Close()) {
+		return
+	}
+
+	reader, err := gzip.NewReader(archive)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ddl, DDLFromGzipExtra(reader.Extra))
+
+	assert.Empty(t, DDLFromGzipExtra(nil))
+	assert.Empty(t, DDLFromGzipExtra([]byte{'X', 'Y', 1, 0, 'z'}), "other subfields are skipped")
+	assert.Nil(t, GzipExtra(string(make([]byte, 0x10000))), "too long definition is not written")
+}
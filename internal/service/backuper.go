@@ -1,217 +1,497 @@
-package service
-
-import (
-	"captura-backup/internal/datastructs"
-	"captura-backup/internal/storage"
-	"context"
-	"errors"
-	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
-	"sync"
-	"time"
-)
-
-func (s *Service) backupProcess(ctx context.Context, prc *process, wgProcess *sync.WaitGroup) {
-	defer func() {
-		s.stateAndMessage(ctx,
-			STATE_INACTIVE,
-			"Service finished backup process at "+time.Now().Format("02.01.2006 15:04:05"),
-		)
-		wgProcess.Done()
-
-	}()
-
-	_, ok := s.processes.Load(prc.DataID)
-	if ok {
-		s.log.Warn("Backup process: the backup process for this data type is already in progress")
-		return
-	}
-
-	for s.state == STATE_RELOAD {
-		time.Sleep(1 * time.Second)
-	}
-
-	if s.isActiveProcess(PRC_RESTORE) {
-		s.log.Warn("Backup process: the recovery process is already in progress")
-		return
-	}
-
-	s.processes.Store(prc.DataID, prc)
-	defer s.processes.Delete(prc.DataID)
-
-	s.stateAndMessage(ctx,
-		STATE_ACTIVE,
-		"Service started backup process at "+time.Now().Format("02.01.2006 15:04:05"),
-	)
-
-	datas, err := s.storer.DatasToArchive(ctx, prc.DataID)
-	if err != nil {
-		s.log.Errorln("Backup process: getting backup data:", err)
-		return
-	}
-	if len(datas) == 0 {
-		return
-	}
-
-	producer, err := s.filesProducer()
-	if err != nil {
-		s.log.Errorln("Backup process: get files producer:", err)
-		return
-	}
-	defer producer.Close()
-
-	s.log.Infof("Backup process: [DataID:%d] start process", prc.DataID)
-	defer func() {
-		s.log.Infof("Backup process: [DataID:%d] finished process", prc.DataID)
-	}()
-
-	var wgWorker sync.WaitGroup
-DATAS:
-	for _, d := range datas {
-		select {
-		case <-ctx.Done():
-			//прервать или выйти?
-			break DATAS
-		default:
-			s.buferWorkers <- struct{}{}
-			wgWorker.Add(1)
-			data := d
-			go s.backupWorker(ctx, data, producer, &wgWorker)
-		}
-
-	}
-	wgWorker.Wait()
-	//TODO: Уведомление о завершении ?
-}
-
-func (s *Service) backupWorker(ctx context.Context, data *datastructs.ArchiveTable, producer storage.Producer, wg *sync.WaitGroup) {
-
-	defer func() {
-		<-s.buferWorkers
-		wg.Done()
-		s.log.Infof("Backup worker: [DataID:%d Table:%s Entity:%s] finished work", data.ID, data.Name, data.Entity)
-	}()
-	s.log.Infof("Backup worker: [DataID:%d Table:%s Entity:%s] start work", data.ID, data.Name, data.Entity)
-
-	if err := func() error {
-		dates, err := s.storer.DatesToBackup(ctx, data)
-		if err != nil {
-			return fmt.Errorf("getting backup dates: %w", err)
-		}
-
-		if len(dates) == 0 {
-			s.log.Tracef("Backup worker: [DataID:%d Table:%s Entity:%s] no dates for backup", data.ID, data.Name, data.Entity)
-			return nil
-		}
-
-		schemaTbl := strings.Split(data.Name, ".")
-		if len(schemaTbl) < 2 {
-			return errors.New("wrong schema-table name for data backup")
-		}
-
-		storageFolder := filepath.Join(s.ini.Section("storage").Key("path").String(), schemaTbl[0])
-
-		if err := producer.MakeDir(storageFolder); err != nil {
-			return fmt.Errorf("create storage folder: %w", err)
-		}
-
-		for _, day := range dates {
-			var rowsSave int64
-			if data.DoBackup {
-
-				stats := datastructs.ArchAvailableData{
-					DataID:          data.ID,
-					SchemaName:      schemaTbl[0],
-					TableName:       schemaTbl[1],
-					SingleTable:     data.Entity == "table",
-					ContentDate:     day,
-					RestoreTemplate: data.RestoreTemplate,
-				}
-
-				ok, err := s.storer.WasRestoredAndExpired(ctx, stats)
-				if err != nil {
-					return fmt.Errorf("verification of data for the former recovery: %w", err)
-				}
-				if !ok {
-					s.log.Warnf("Backup worker: [Table:%s Date:%s] the backup has been cancelled, the data has been restored and the retention period has not expired yet",
-						data.Name,
-						day.Format("2006-01-02"))
-					continue
-				}
-
-				// /tmp/RouteVKN10.1257894000000000000
-				// fileName := removeQuotes(schemaTbl[1])
-				fileName := func(text string) string {
-					return strings.NewReplacer(`"`, "").Replace(text)
-				}(schemaTbl[1])
-
-				tmpGzFile, err := os.CreateTemp(
-					s.ini.Section("service").Key("tmp_folder").String(),
-					fileName+".*",
-				)
-				if err != nil {
-					return fmt.Errorf("create tmpGz file: %w", err)
-				}
-				defer func() {
-					tmpGzFile.Close()
-					os.Remove(tmpGzFile.Name())
-				}()
-
-				rowsSave, err = s.storer.SaveDataForDay(ctx, data, day, tmpGzFile)
-				if err != nil {
-					return fmt.Errorf("save backup data: %w", err)
-				}
-
-				tmpGzFile.Close()
-
-				gzReader, err := os.Open(tmpGzFile.Name())
-				if err != nil {
-					return fmt.Errorf("read tmpGz file data: %w", err)
-				}
-				defer gzReader.Close()
-
-				path := filepath.Join(storageFolder, day.Format("20060102"))
-				if err := producer.MakeDir(path); err != nil {
-					return fmt.Errorf("create storage folder for backup day: %w", err)
-				}
-
-				absFileName := filepath.Join(path, fileName+".backup.gz")
-				if err := producer.SaveFile(absFileName, gzReader); err != nil {
-					return fmt.Errorf("copy tmp gzFile to storage: %w", err)
-				}
-
-				gzReader.Close()
-				stats.FileName = absFileName
-				stats.ArchivedAt = time.Now()
-				stats.ContentRows = rowsSave
-
-				if err := s.storer.AddArchAvailableData(ctx, stats); err != nil {
-					return fmt.Errorf("add statistics for arch available data: %w", err)
-				}
-			}
-
-			if !s.developMode() {
-				err := s.storer.DeleteDataForDay(ctx, data, day, rowsSave)
-				if err != nil {
-					return fmt.Errorf("delete data from table after backup: %w", err)
-				}
-			}
-
-			s.log.Infof("Backup worker: [DataID:%d Table:%s Entity:%s] successful backup and delete data for Day:%s CountRows:%d",
-				data.ID, data.Name, data.Entity, day.Format("2006-01-02"), rowsSave)
-		}
-
-		if data.Entity == "table" {
-			if !s.developMode() {
-				if err := s.storer.DeleteTable(ctx, data.Name); err != nil {
-					return fmt.Errorf("delete table: %w", err)
-				}
-			}
-		}
-		return nil
-	}(); err != nil {
-		s.log.Errorf("Backup worker: [DataID:%d Table:%s Entity:%s] process archive file:%s", data.ID, data.Name, data.Entity, err)
-	}
-}
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/encrypter"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/storage"
+	"captura-backup/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveExt is the extension of the archive files in the storage
+const archiveExt = ".backup.gz"
+
+func (s *Service) backupProcess(ctx context.Context, prc *process, wgProcess *sync.WaitGroup) {
+	defer func() {
+		s.stateAndMessage(ctx,
+			STATE_INACTIVE,
+			"Service finished backup process at "+time.Now().Format("02.01.2006 15:04:05"),
+		)
+		wgProcess.Done()
+
+	}()
+
+	_, ok := s.processes.Load(prc.DataID)
+	if ok {
+		s.log.Warn("Backup process: the backup process for this data type is already in progress")
+		return
+	}
+
+	for s.state == STATE_RELOAD {
+		time.Sleep(1 * time.Second)
+	}
+
+	if s.isActiveProcess(PRC_RESTORE) {
+		s.log.Warn("Backup process: the recovery process is already in progress")
+		return
+	}
+
+	s.processes.Store(prc.DataID, prc)
+	defer s.processes.Delete(prc.DataID)
+
+	s.stateAndMessage(ctx,
+		STATE_ACTIVE,
+		"Service started backup process at "+time.Now().Format("02.01.2006 15:04:05"),
+	)
+
+	datas, err := s.storer.DatasToArchive(ctx, prc.DataID)
+	if err != nil {
+		s.log.Errorln("Backup process: getting backup data:", err)
+		return
+	}
+	if len(datas) == 0 {
+		return
+	}
+
+	s.log.Infof("Backup process: [DataID:%d] start process", prc.DataID)
+	defer func() {
+		s.log.Infof("Backup process: [DataID:%d] finished process", prc.DataID)
+	}()
+
+	var wgWorker sync.WaitGroup
+DATAS:
+	for _, d := range datas {
+		select {
+		case <-ctx.Done():
+			//прервать или выйти?
+			break DATAS
+		default:
+			s.buferWorkers <- struct{}{}
+			wgWorker.Add(1)
+			data := d
+			go s.backupWorker(ctx, data, &wgWorker)
+		}
+
+	}
+	wgWorker.Wait()
+	//TODO: Уведомление о завершении ?
+}
+
+func (s *Service) backupWorker(ctx context.Context, data *datastructs.ArchiveTable, wg *sync.WaitGroup) {
+	// each worker has its own connections, so the workers are not serialized on one connection
+	producers := s.newProducerSet(ctx)
+
+	defer func() {
+		producers.Close()
+		<-s.buferWorkers
+		wg.Done()
+		s.log.Infof("Backup worker: [DataID:%d Table:%s Entity:%s] finished work", data.ID, data.Name, data.Entity)
+	}()
+	s.log.Infof("Backup worker: [DataID:%d Table:%s Entity:%s] start work", data.ID, data.Name, data.Entity)
+
+	if err := func() error {
+		dates, err := s.storer.DatesToBackup(ctx, data)
+		if err != nil {
+			return fmt.Errorf("getting backup dates: %w", err)
+		}
+
+		// the expired partition without rows has no archive, it is only dropped
+		if len(dates) == 0 && data.Entity == "partition" {
+			if s.developMode() {
+				return nil
+			}
+			holds, err := s.storer.ActiveLegalHolds(ctx)
+			if err != nil {
+				return fmt.Errorf("getting legal holds: %w", err)
+			}
+			if hold := partitionHeldBy(holds, data, strings.SplitN(data.Name, ".", 2)[0]); hold != nil {
+				s.log.Warnf("Backup worker: [DataID:%d Table:%s Entity:%s] the partition is not dropped, the data is under the legal hold %d",
+					data.ID, data.Name, data.Entity, hold.ID)
+				return nil
+			}
+			s.log.Debugf("Backup worker: [DataID:%d Table:%s Entity:%s] the partition has no rows, it is dropped without an archive", data.ID, data.Name, data.Entity)
+			if err := s.storer.DropPartition(ctx, data.Parent, data.Name); err != nil {
+				return fmt.Errorf("drop partition: %w", err)
+			}
+			return nil
+		}
+		if len(dates) == 0 {
+			s.log.Tracef("Backup worker: [DataID:%d Table:%s Entity:%s] no dates for backup", data.ID, data.Name, data.Entity)
+			return nil
+		}
+
+		schemaTbl := strings.Split(data.Name, ".")
+		if len(schemaTbl) < 2 {
+			return errors.New("wrong schema-table name for data backup")
+		}
+
+		if data.Action == "move" && data.DoBackup {
+			return s.moveTable(ctx, data, dates, schemaTbl)
+		}
+
+		var (
+			dest          = s.destinationFor(data.ID)
+			producer      storage.Producer
+			db            store.ArchiveDatabase
+			storageFolder string
+			ddl, ddlHash  string
+		)
+		// the DDL is signed in the manifest, creates the table of the archive database and
+		// restores the dropped table if its template is not set or has changed
+		if s.signKey != nil || dest.database() || data.Entity == "table" && data.DoBackup {
+			if ddl, err = s.storer.TableDDL(ctx, data.Name); err != nil {
+				return fmt.Errorf("getting table DDL: %w", err)
+			}
+		}
+		if data.Entity == "table" && data.DoBackup {
+			data.TableDDL = ddl
+		}
+		if s.signKey != nil {
+			ddlHash = manifest.HashString(ddl)
+		}
+		if dest.database() {
+			if db, err = s.archiveDatabase(ctx, dest); err != nil {
+				return fmt.Errorf("get archive database: %w", err)
+			}
+			if err := db.PrepareTable(ctx, data.Name, ddl); err != nil {
+				return fmt.Errorf("prepare table of archive database: %w", err)
+			}
+		} else {
+			if producer, dest, err = producers.get(dest.name); err != nil {
+				return fmt.Errorf("get files producer: %w", err)
+			}
+			storageFolder = filepath.Join(dest.path, schemaTbl[0])
+
+			if err := producer.MakeDir(storageFolder); err != nil {
+				return fmt.Errorf("create storage folder: %w", err)
+			}
+		}
+
+		holds, err := s.storer.ActiveLegalHolds(ctx)
+		if err != nil {
+			return fmt.Errorf("getting legal holds: %w", err)
+		}
+
+		var (
+			held    bool
+			skipped []string
+			// the restored days are kept in the partition until their retention period expires
+			restored bool
+		)
+		defer func() {
+			if len(skipped) == 0 {
+				return
+			}
+			text := fmt.Sprintf("Backup of the table %s is skipped for %d days, there is not enough space", data.Name, len(skipped))
+			if err := s.sendMessage(s.makeDataToSend("error", text, skipped...)); err != nil {
+				s.log.Errorln("Backup worker: send notification:", err)
+			}
+		}()
+		for _, day := range dates {
+			// the data under legal hold is neither archived nor deleted until the hold is released
+			if hold := heldBy(holds, datastructs.ArchAvailableData{DataID: data.ID, SchemaName: schemaTbl[0], ContentDate: day}); hold != nil {
+				s.log.Warnf("Backup worker: [DataID:%d Table:%s Date:%s] skipped, the data is under the legal hold %d",
+					data.ID, data.Name, day.Format("2006-01-02"), hold.ID)
+				held = true
+				continue
+			}
+
+			var rowsSave int64
+			if data.DoBackup {
+
+				stats := datastructs.ArchAvailableData{
+					DataID:          data.ID,
+					SchemaName:      schemaTbl[0],
+					TableName:       schemaTbl[1],
+					SingleTable:     data.Entity == "table" || data.Entity == "partition",
+					ContentDate:     day,
+					RestoreTemplate: data.RestoreTemplate,
+					Storage:         dest.name,
+					Parent:          data.Parent,
+					PartitionBound:  data.PartitionBound,
+					TableDDL:        data.TableDDL,
+				}
+
+				ok, err := s.storer.WasRestoredAndExpired(ctx, stats)
+				if err != nil {
+					return fmt.Errorf("verification of data for the former recovery: %w", err)
+				}
+				if !ok {
+					s.log.Warnf("Backup worker: [Table:%s Date:%s] the backup has been cancelled, the data has been restored and the retention period has not expired yet",
+						data.Name,
+						day.Format("2006-01-02"))
+					restored = true
+					continue
+				}
+
+				// the day is skipped before the data is copied from the database, if the archive would not fit
+				if err := s.checkCapacity(ctx, producers, dest, data); err != nil {
+					if !errors.Is(err, errNoSpace) {
+						return err
+					}
+					s.log.Warnf("Backup worker: [DataID:%d Table:%s Date:%s] skipped: %s", data.ID, data.Name, day.Format("2006-01-02"), err)
+					skipped = append(skipped, fmt.Sprintf("%s: %s", day.Format("2006-01-02"), err))
+					continue
+				}
+
+				if db != nil {
+					if rowsSave, err = s.backupToDatabase(ctx, db, data, day, stats); err != nil {
+						return fmt.Errorf("copy data to archive database: %w", err)
+					}
+				} else {
+					// /tmp/RouteVKN10.1257894000000000000
+					// fileName := removeQuotes(schemaTbl[1])
+					fileName := func(text string) string {
+						return strings.NewReplacer(`"`, "").Replace(text)
+					}(schemaTbl[1])
+
+					tmpGzFile, err := os.CreateTemp(
+						s.ini.Section("service").Key("tmp_folder").String(),
+						fileName+".*",
+					)
+					if err != nil {
+						return fmt.Errorf("create tmpGz file: %w", err)
+					}
+					defer func() {
+						tmpGzFile.Close()
+						os.Remove(tmpGzFile.Name())
+					}()
+
+					rowsSave, err = s.storer.SaveDataForDay(ctx, data, day, tmpGzFile)
+					if err != nil {
+						return fmt.Errorf("save backup data: %w", err)
+					}
+
+					tmpGzFile.Close()
+
+					archive, err := s.openArchiveSource(tmpGzFile.Name())
+					if err != nil {
+						return fmt.Errorf("read tmpGz file data: %w", err)
+					}
+					defer archive.Close()
+
+					path := filepath.Join(storageFolder, day.Format("20060102"))
+					if err := producer.MakeDir(path); err != nil {
+						return fmt.Errorf("create storage folder for backup day: %w", err)
+					}
+
+					if s.keyring != nil {
+						stats.KeyID = s.keyring.CurrentKey()
+					}
+
+					absFileName := filepath.Join(path, fileName+archiveExt)
+					err = producer.SaveFile(absFileName, archive)
+					archive.Close()
+					if err != nil {
+						return fmt.Errorf("copy tmp gzFile to storage: %w", err)
+					}
+
+					info, err := producer.Stat(absFileName)
+					if err != nil {
+						return fmt.Errorf("stat saved archive file: %w", err)
+					}
+					stats.FileName = absFileName
+					stats.FileSize = info.Size()
+					checksum := archive.checksum
+					stats.Checksum = checksum.Sum()
+					stats.ArchivedAt = time.Now()
+					stats.ContentRows = rowsSave
+
+					if s.signKey != nil {
+						if err := s.saveManifest(producer, stats, checksum.Size(), ddlHash); err != nil {
+							return fmt.Errorf("save archive manifest: %w", err)
+						}
+					}
+
+					if stats.ID, err = s.storer.AddArchAvailableData(ctx, stats); err != nil {
+						return fmt.Errorf("add statistics for arch available data: %w", err)
+					}
+
+					if err := s.writeReplicas(ctx, producers, dest, stats, tmpGzFile.Name(), checksum.Size(), ddlHash); err != nil {
+						if dest.replication == replicateAll {
+							return fmt.Errorf("replicate archive, the data is kept: %w", err)
+						}
+						s.log.Warnf("Backup worker: [ID:%d File:%s] the copies will be retried: %s", stats.ID, stats.FileName, err)
+					}
+				}
+			}
+
+			if !s.developMode() {
+				err := s.storer.DeleteDataForDay(ctx, data, day, rowsSave)
+				if err != nil {
+					return fmt.Errorf("delete data from table after backup: %w", err)
+				}
+			}
+
+			s.log.Infof("Backup worker: [DataID:%d Table:%s Entity:%s] successful backup and delete data for Day:%s CountRows:%d",
+				data.ID, data.Name, data.Entity, day.Format("2006-01-02"), rowsSave)
+		}
+
+		if data.Entity == "table" && !held && len(skipped) == 0 {
+			if !s.developMode() {
+				if err := s.storer.DeleteTable(ctx, data.Name); err != nil {
+					return fmt.Errorf("delete table: %w", err)
+				}
+			}
+		}
+		// the partition is detached and dropped, the restore attaches it again with the same bound
+		if data.Entity == "partition" && !held && !restored && len(skipped) == 0 {
+			if !s.developMode() {
+				if err := s.storer.DropPartition(ctx, data.Parent, data.Name); err != nil {
+					return fmt.Errorf("drop partition: %w", err)
+				}
+			}
+		}
+		return nil
+	}(); err != nil {
+		s.log.Errorf("Backup worker: [DataID:%d Table:%s Entity:%s] process archive file:%s", data.ID, data.Name, data.Entity, err)
+	}
+}
+
+// moveTable moves the expired table into the archive schema and tablespace of the data type instead of
+// exporting its rows, the table stays queryable there. The catalog has one archive of the table with
+// the last date of its data, so the retention keeps the table until all its days expire,
+// the file name of the archive is the name of the moved table.
+func (s *Service) moveTable(ctx context.Context, data *datastructs.ArchiveTable, dates []time.Time, schemaTbl []string) error {
+	holds, err := s.storer.ActiveLegalHolds(ctx)
+	if err != nil {
+		return fmt.Errorf("getting legal holds: %w", err)
+	}
+	last := dates[0]
+	for _, day := range dates {
+		if hold := heldBy(holds, datastructs.ArchAvailableData{DataID: data.ID, SchemaName: schemaTbl[0], ContentDate: day}); hold != nil {
+			s.log.Warnf("Backup worker: [DataID:%d Table:%s Date:%s] the table is not moved, the data is under the legal hold %d",
+				data.ID, data.Name, day.Format("2006-01-02"), hold.ID)
+			return nil
+		}
+		if day.After(last) {
+			last = day
+		}
+	}
+
+	stats := datastructs.ArchAvailableData{
+		DataID:          data.ID,
+		SchemaName:      schemaTbl[0],
+		TableName:       schemaTbl[1],
+		SingleTable:     true,
+		ContentDate:     last,
+		RestoreTemplate: data.RestoreTemplate,
+		Action:          data.Action,
+	}
+	ok, err := s.storer.WasRestoredAndExpired(ctx, stats)
+	if err != nil {
+		return fmt.Errorf("verification of data for the former recovery: %w", err)
+	}
+	if !ok {
+		s.log.Warnf("Backup worker: [Table:%s Date:%s] the move has been cancelled, the table has been restored and the retention period has not expired yet",
+			data.Name,
+			last.Format("2006-01-02"))
+		return nil
+	}
+	if s.developMode() {
+		return nil
+	}
+
+	schema := data.ArchiveSchema
+	if schema == "" {
+		schema = schemaTbl[0]
+	}
+	if stats.SourceTablespace, stats.ContentRows, err = s.storer.MoveTable(ctx, data.Name, data.ArchiveSchema, data.ArchiveTablespace); err != nil {
+		return fmt.Errorf("move table: %w", err)
+	}
+	stats.FileName = schema + "." + schemaTbl[1]
+	stats.ArchivedAt = time.Now()
+	if _, err := s.storer.AddArchAvailableData(ctx, stats); err != nil {
+		return fmt.Errorf("add statistics for arch available data of the table moved to %s: %w", stats.FileName, err)
+	}
+
+	s.log.Infof("Backup worker: [DataID:%d Table:%s Entity:%s] successful move of the table to %s CountRows:%d",
+		data.ID, data.Name, data.Entity, stats.FileName, stats.ContentRows)
+	return nil
+}
+
+// backupToDatabase copies the rows of the day into the table of the archive database and adds the archive
+// to the catalog, the file name of the archive is the name of the table. The size and the checksum are of the copied CSV.
+func (s *Service) backupToDatabase(ctx context.Context, db store.ArchiveDatabase, data *datastructs.ArchiveTable, day time.Time, stats datastructs.ArchAvailableData) (int64, error) {
+	reader, writer := io.Pipe()
+	checksum := manifest.NewChecksum()
+	saved := make(chan int64, 1)
+	go func() {
+		rows, err := s.storer.CopyDataForDay(ctx, data, day, io.MultiWriter(writer, checksum))
+		saved <- rows
+		writer.CloseWithError(err)
+	}()
+
+	rowsWritten, err := db.WriteRows(ctx, data.Name, data.DateColumn, day, reader)
+	// the copy from the database is stopped if the archive database failed
+	reader.CloseWithError(err)
+	rowsSave := <-saved
+	if err != nil {
+		return 0, err
+	}
+	if rowsWritten != rowsSave {
+		return 0, errors.New("the number of saved and written records do not match")
+	}
+
+	stats.FileName = data.Name
+	stats.FileSize = checksum.Size()
+	stats.Checksum = checksum.Sum()
+	stats.ArchivedAt = time.Now()
+	stats.ContentRows = rowsSave
+	if _, err := s.storer.AddArchAvailableData(ctx, stats); err != nil {
+		return 0, fmt.Errorf("add statistics for arch available data: %w", err)
+	}
+	return rowsSave, nil
+}
+
+// archiveSource reads the archive from the local gzip file, encrypted by the current key if the encryption
+// is enabled, and counts the checksum of the data. Rewind reopens the file, so the failed upload can be retried.
+type archiveSource struct {
+	name     string
+	keyring  *encrypter.Keyring
+	checksum *manifest.Checksum
+	file     *os.File
+	reader   io.ReadCloser
+}
+
+func (s *Service) openArchiveSource(name string) (*archiveSource, error) {
+	a := &archiveSource{name: name, keyring: s.keyring}
+	return a, a.open()
+}
+
+func (a *archiveSource) open() error {
+	file, err := os.Open(a.name)
+	if err != nil {
+		return err
+	}
+	a.file, a.checksum = file, manifest.NewChecksum()
+	a.reader = io.NopCloser(io.TeeReader(file, a.checksum))
+	if a.keyring != nil {
+		a.reader = a.keyring.EncryptReader(a.reader)
+	}
+	return nil
+}
+
+func (a *archiveSource) Read(p []byte) (int, error) {
+	return a.reader.Read(p)
+}
+
+func (a *archiveSource) Close() error {
+	a.reader.Close()
+	return a.file.Close()
+}
+
+// Rewind reads the archive again from the start, the checksum is counted again.
+func (a *archiveSource) Rewind() error {
+	a.Close()
+	return a.open()
+}
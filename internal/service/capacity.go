@@ -0,0 +1,100 @@
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/local"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errNoSpace = errors.New("not enough space")
+
+// checkCapacity checks that the tmp folder, the storage of the destination and its replicas have the space
+// for the archive of one day of the data. The size of the archive is estimated by the statistics of the table
+// multiplied by the archive_size_ratio. If the size or the free space can not be found out, the capacity is not checked.
+// The full replica of the async replication does not stop the backup, its copy is retried by the replication process.
+func (s *Service) checkCapacity(ctx context.Context, producers *producerSet, dest *destination, data *datastructs.ArchiveTable) error {
+	// the free space of the archive database is not checked
+	if dest.database() {
+		return nil
+	}
+	size, err := s.storer.EstimateDaySize(ctx, data)
+	if err != nil {
+		s.log.Warnf("Backup worker: [DataID:%d Table:%s] estimate the archive size, the free space is not checked: %s", data.ID, data.Name, err)
+		return nil
+	}
+	need := int64(float64(size) * s.ini.Section("storage").Key("archive_size_ratio").MustFloat64(0.5))
+
+	tmpFolder := s.ini.Section("service").Key("tmp_folder").MustString(os.TempDir())
+	if free, err := local.NewProducer().FreeSpace(tmpFolder); err == nil && free < need {
+		return fmt.Errorf("tmp_folder %s: %w, the archive needs about %d MB, free %d MB", tmpFolder, errNoSpace, need>>20, free>>20)
+	}
+
+	producer, _, err := producers.get(dest.name)
+	if err != nil {
+		return err
+	}
+	if err := s.checkStorageSpace(ctx, producer, dest, need); err != nil {
+		return err
+	}
+	for _, name := range dest.replicas {
+		producer, replica, err := producers.get(name)
+		if err == nil {
+			err = s.checkStorageSpace(ctx, producer, replica, need)
+		}
+		if err == nil {
+			continue
+		}
+		if dest.replication != replicateAsync {
+			return err
+		}
+		s.log.Warnf("Backup worker: [DataID:%d Table:%s] the copy is left to the replication process: %s", data.ID, data.Name, err)
+	}
+	return nil
+}
+
+// checkStorageSpace checks that the storage of the destination has the space of the needed size,
+// the unknown free space is not checked.
+func (s *Service) checkStorageSpace(ctx context.Context, producer storage.Producer, dest *destination, need int64) error {
+	free, err := s.storageFreeSpace(ctx, producer, dest)
+	if err != nil {
+		s.log.Warnf("Backup worker: [Storage:%s] get the free space, the free space is not checked: %s", dest.name, err)
+		return nil
+	}
+	if free >= 0 && free < need {
+		return fmt.Errorf("storage [%s]: %w, the archive needs about %d MB, free %d MB", dest.name, errNoSpace, need>>20, free>>20)
+	}
+	return nil
+}
+
+// storageFreeSpace returns the free space of the storage limited by the quota of the destination,
+// -1 means the free space is unknown and there is no quota.
+func (s *Service) storageFreeSpace(ctx context.Context, producer storage.Producer, dest *destination) (int64, error) {
+	free, err := producer.FreeSpace(dest.path)
+	if errors.Is(err, storage.ErrFreeSpaceUnknown) {
+		free, err = -1, nil
+	}
+	if err != nil || dest.quota == 0 {
+		return free, err
+	}
+
+	usage, err := s.storer.StorageUsage(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get storage usage: %w", err)
+	}
+	used := usage[dest.name]
+	if dest.name == defaultDestination {
+		used += usage[""]
+	}
+	left := dest.quota - used
+	if left < 0 {
+		left = 0
+	}
+	if free < 0 || left < free {
+		free = left
+	}
+	return free, nil
+}
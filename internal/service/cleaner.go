@@ -1,117 +1,283 @@
-package service
-
-import (
-	"captura-backup/internal/datastructs"
-	"captura-backup/internal/storage"
-	"context"
-	"errors"
-	"path/filepath"
-	"strings"
-	"sync"
-	"time"
-)
-
-func (s *Service) cleaningStorageProcess(ctx context.Context, wg *sync.WaitGroup) {
-	defer func() {
-		s.stateAndMessage(ctx,
-			STATE_INACTIVE,
-			"Service finished clean storage process at "+time.Now().Format("02.01.2006 15:04:05"),
-		)
-		wg.Done()
-	}()
-
-	producer, err := s.filesProducer()
-	if err != nil {
-		s.log.Errorln("Cleaning worker: get files producer for cleaning storage process:", err)
-		return
-	}
-	defer producer.Close()
-
-	storages, err := s.storer.StoragesForCleaner(ctx)
-	if err != nil {
-		s.log.Errorln("Cleaning worker: get list storages for clenaner:", err)
-		return
-	}
-
-	storagePath := s.ini.Section("storage").Key("path").String()
-	dirs, err := producer.ReadDir(storagePath)
-	if err != nil {
-		s.log.Errorln("Cleaning worker: read storages folder:", err)
-		return
-	}
-
-	s.stateAndMessage(ctx,
-		STATE_ACTIVE,
-		"Service started clean storage process at "+time.Now().Format("02.01.2006 15:04:05"),
-	)
-
-	for _, st := range storages {
-		keepDuration := time.Duration(st.KeepArchDays) * 24 * time.Hour
-		for _, dir := range dirs {
-			if dir.IsDir() {
-				if dir.Name() == st.Schemaname {
-
-					dates, err := producer.ReadDir(filepath.Join(storagePath, st.Schemaname))
-					if err != nil {
-						s.log.Errorln("Cleaning worker: read storages folder:", err)
-						return
-					}
-
-					for _, date := range dates {
-						day, err := time.Parse("20060102", date.Name())
-						if err != nil {
-							s.log.Error("Cleaning worker: parse storage dirs like a date:", err)
-							continue
-						}
-						if time.Now().After(day.Add(keepDuration)) {
-
-							if err := s.removeExpiredArchives(ctx, producer, st.Schemaname, date.Name()); err != nil {
-								s.log.Errorln("Cleaning worker: remove expired archives:", err)
-								continue
-							}
-						}
-					}
-
-				}
-			}
-		}
-	}
-
-	//TODO: Уведомление о завершении?
-}
-
-func (s *Service) removeExpiredArchives(ctx context.Context, producer storage.Producer, schema, date string) error {
-
-	storagePath := s.ini.Section("storage").Key("path").String()
-	files, err := producer.ReadDir(filepath.Join(storagePath, schema, date))
-	if err != nil {
-		return err
-	}
-	for _, file := range files {
-		path := filepath.Join(storagePath, schema, date, file.Name())
-		if err := producer.Remove(path); err != nil {
-			return err
-		}
-
-		t := strings.Split(file.Name(), ".")
-		if len(t) < 2 {
-			return errors.New("wrong archive file name")
-		}
-		tbl := t[0]
-		cntDate, err := time.Parse("20060102", date)
-		if err != nil {
-			return err
-		}
-		aad := datastructs.ArchAvailableData{
-			SchemaName:  schema,
-			ContentDate: cntDate,
-			TableName:   tbl,
-			DeletedAt:   time.Now(),
-		}
-		if err := s.storer.UpdateAvailableDataAfterRemoveFile(ctx, aad); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/manifest"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (s *Service) cleaningStorageProcess(ctx context.Context, wg *sync.WaitGroup) {
+	defer func() {
+		s.stateAndMessage(ctx,
+			STATE_INACTIVE,
+			"Service finished clean storage process at "+time.Now().Format("02.01.2006 15:04:05"),
+		)
+		wg.Done()
+	}()
+
+	autoCleaning := s.ini.Section("storage").Key("auto_cleaning").MustBool(false)
+	if !autoCleaning && !s.tieringEnabled() {
+		s.log.Trace("Cleaning worker: auto cleaning and tiering of the storage are disabled")
+		return
+	}
+
+	producers := s.newProducerSet(ctx)
+	defer producers.Close()
+
+	s.stateAndMessage(ctx,
+		STATE_ACTIVE,
+		"Service started clean storage process at "+time.Now().Format("02.01.2006 15:04:05"),
+	)
+
+	if autoCleaning {
+		s.cleanStorage(ctx, producers)
+	}
+	// the archives kept by the retention rules are moved to the cold storages after cleaning
+	if s.tieringEnabled() {
+		s.tierStorage(ctx, producers)
+	}
+}
+
+func (s *Service) cleanStorage(ctx context.Context, producers *producerSet) {
+	dryRun := s.ini.Section("storage").Key("cleaning_dry_run").MustBool(false)
+	removed, errs := s.applyRetention(ctx, producers, dryRun)
+	if !dryRun {
+		errs = append(errs, s.purgeTrash(ctx, producers)...)
+	}
+	if len(removed) == 0 && len(errs) == 0 {
+		return
+	}
+
+	text := fmt.Sprintf("Storage cleaning finished: removed %d archives", len(removed))
+	tmpl := "info"
+	lines := make([]string, 0, len(removed))
+	if dryRun {
+		text = fmt.Sprintf("Storage cleaning dry run: %d archives would be removed", len(removed))
+		for _, archive := range removed {
+			lines = append(lines, archive.FileName)
+		}
+	}
+	if len(errs) != 0 {
+		tmpl = "error"
+		lines = errs
+	}
+	if err := s.sendMessage(s.makeDataToSend(tmpl, text, lines...)); err != nil {
+		s.log.Errorln("Cleaning worker: send notification:", err)
+	}
+}
+
+// Cleanup applies the retention rules to the archives once, in the dry run mode it only
+// reports the archives that would be removed.
+func (s *Service) Cleanup(dryRun bool) error {
+	ctx := context.Background()
+
+	closeStore, err := s.connectStore(ctx)
+	if err != nil {
+		return fmt.Errorf("database connect: %w", err)
+	}
+	defer closeStore()
+
+	producers := s.newProducerSet(ctx)
+	defer producers.Close()
+
+	removed, errs := s.applyRetention(ctx, producers, dryRun)
+	if !dryRun {
+		errs = append(errs, s.purgeTrash(ctx, producers)...)
+	}
+	if dryRun {
+		s.log.Infof("Cleanup: %d archives would be removed", len(removed))
+	} else {
+		s.log.Infof("Cleanup: removed %d archives", len(removed))
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%d archives could not be removed", len(errs))
+	}
+	return nil
+}
+
+// applyRetention removes the archives that are not kept by the retention rules of their data type
+// and returns the removed archives. In the dry run mode the archives are only logged.
+func (s *Service) applyRetention(ctx context.Context, producers *producerSet, dryRun bool) ([]datastructs.ArchAvailableData, []string) {
+	storages, err := s.storer.StoragesForCleaner(ctx)
+	if err != nil {
+		s.log.Errorln("Cleaning worker: get list storages for clenaner:", err)
+		return nil, []string{err.Error()}
+	}
+	holds, err := s.storer.ActiveLegalHolds(ctx)
+	if err != nil {
+		s.log.Errorln("Cleaning worker: get legal holds:", err)
+		return nil, []string{err.Error()}
+	}
+
+	var (
+		now     = time.Now()
+		minDays = s.ini.Section("storage").Key("keep_period").MustInt(0)
+		removed []datastructs.ArchAvailableData
+		errs    []string
+	)
+	for _, st := range storages {
+		// the storage_settings of the data type override the retention rules of the config
+		if d := s.destinationFor(st.DataID); d.settings {
+			if !d.autoCleaning {
+				s.log.Tracef("Cleaning worker: [DataID:%d] auto cleaning of the storage [%s] is disabled", st.DataID, d.name)
+				continue
+			}
+			if d.storagePeriod > 0 {
+				st.KeepArchDays = d.storagePeriod
+			}
+		}
+		archives, err := s.storer.AvailableArchives(ctx, st.DataID, time.Time{}, now)
+		if err != nil {
+			s.log.Errorf("Cleaning worker: [DataID:%d] get archives: %s", st.DataID, err)
+			errs = append(errs, fmt.Sprintf("data type %d: %s", st.DataID, err))
+			continue
+		}
+		for _, archive := range expiredArchives(archives, st, now, minDays) {
+			if hold := heldBy(holds, archive); hold != nil {
+				s.log.Debugf("Cleaning worker: [ID:%d File:%s] kept by the legal hold %d", archive.ID, archive.FileName, hold.ID)
+				continue
+			}
+			if dryRun {
+				s.log.Infof("Cleaning worker: [ID:%d File:%s] would be removed", archive.ID, archive.FileName)
+				removed = append(removed, archive)
+				continue
+			}
+			if err := s.removeArchive(ctx, producers, archive, st.DateColumn); err != nil {
+				s.log.Errorf("Cleaning worker: [ID:%d File:%s] remove archive: %s", archive.ID, archive.FileName, err)
+				errs = append(errs, fmt.Sprintf("%s: %s", archive.FileName, err))
+				continue
+			}
+			s.log.Infof("Cleaning worker: [ID:%d File:%s] removed", archive.ID, archive.FileName)
+			removed = append(removed, archive)
+		}
+	}
+	return removed, errs
+}
+
+// removeArchive removes the archive with its copies and marks it as deleted in the catalog.
+// The archive whose file is already missing is only marked as deleted. The rows of the archive
+// in the archive database are found by the date column of the data type, the moved table is dropped
+// if it is still in the archive schema or tablespace.
+func (s *Service) removeArchive(ctx context.Context, producers *producerSet, archive datastructs.ArchAvailableData, dateColumn string) error {
+	if archive.Action == "move" {
+		tablespace, err := s.storer.TableTablespace(ctx, archive.FileName)
+		if err != nil {
+			return fmt.Errorf("get tablespace of moved table: %w", err)
+		}
+		// the table restored into its source schema and tablespace is the live table again
+		schema := strings.SplitN(archive.FileName, ".", 2)[0]
+		if tablespace != "" && (schema != archive.SchemaName || tablespace != archive.SourceTablespace) {
+			if err := s.storer.DeleteTable(ctx, archive.FileName); err != nil {
+				return fmt.Errorf("drop moved table: %w", err)
+			}
+		} else {
+			s.log.Infof("Cleaning worker: [ID:%d Table:%s] the table is not in the archive, it is not dropped", archive.ID, archive.FileName)
+		}
+		return s.storer.MarkArchiveDeleted(ctx, archive.ID, time.Now())
+	}
+	dest, err := s.destination(archive.Storage)
+	if err != nil {
+		return err
+	}
+	if dest.database() {
+		db, err := s.archiveDatabase(ctx, dest)
+		if err != nil {
+			return err
+		}
+		if _, err := db.DeleteRows(ctx, archive.FileName, dateColumn, archive.ContentDate); err != nil {
+			return fmt.Errorf("delete rows from archive database: %w", err)
+		}
+		return s.storer.MarkArchiveDeleted(ctx, archive.ID, time.Now())
+	}
+	if err := s.removeArchiveFiles(producers, archive); err != nil {
+		return err
+	}
+	if err := s.removeCopies(ctx, producers, archive); err != nil {
+		return fmt.Errorf("remove archive copies: %w", err)
+	}
+	return s.storer.MarkArchiveDeleted(ctx, archive.ID, time.Now())
+}
+
+// removeArchiveFiles moves the archive file with its manifest to the trash of its storage or,
+// if the trash is disabled, removes them.
+func (s *Service) removeArchiveFiles(producers *producerSet, archive datastructs.ArchAvailableData) error {
+	producer, dest, err := producers.get(archive.Storage)
+	if err != nil {
+		return err
+	}
+	if trash := s.trashFolder(dest); trash != "" {
+		return s.moveToTrash(producer, trash, archive)
+	}
+	if _, err := producer.Stat(archive.FileName); err == nil {
+		if err := producer.Remove(archive.FileName); err != nil {
+			return err
+		}
+	}
+	if _, err := producer.Stat(archive.FileName + manifest.FileExt); err == nil {
+		if err := producer.Remove(archive.FileName + manifest.FileExt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expiredArchives returns the archives not kept by the grandfather-father-son rules of the data type.
+// Archives of a table archived by records make a series, archives of single tables make one series
+// of the data type. Within a series an archive is kept if any of the rules keeps its content date:
+// the date is within keep_arch_days (but not less than minDays), it is one of the last keep_last dates,
+// it is the last date of its month within keep_months, or it is the last date of its year and keep_yearly is set.
+func expiredArchives(archives []datastructs.ArchAvailableData, st datastructs.ArchiveStorage, now time.Time, minDays int) []datastructs.ArchAvailableData {
+	seriesKey := func(a datastructs.ArchAvailableData) string {
+		if a.SingleTable {
+			return ""
+		}
+		return a.TableName
+	}
+
+	series := make(map[string][]time.Time)
+	seen := make(map[string]bool)
+	for _, archive := range archives {
+		key := seriesKey(archive)
+		if day := key + "|" + archive.ContentDate.Format("20060102"); !seen[day] {
+			seen[day] = true
+			series[key] = append(series[key], archive.ContentDate)
+		}
+	}
+
+	keepDays := st.KeepArchDays
+	if keepDays < minDays {
+		keepDays = minDays
+	}
+	dailyFrom := now.AddDate(0, 0, -keepDays)
+	monthlyFrom := now.AddDate(0, -st.KeepMonths, 0)
+
+	kept := make(map[string]bool)
+	for key, dates := range series {
+		sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+		for i, day := range dates {
+			last := i == len(dates)-1
+			yearEnd := last || dates[i+1].Year() != day.Year()
+			monthEnd := yearEnd || dates[i+1].Month() != day.Month()
+			switch {
+			case !day.Before(dailyFrom),
+				len(dates)-i <= st.KeepLast,
+				monthEnd && st.KeepMonths > 0 && !day.Before(monthlyFrom),
+				yearEnd && st.KeepYearly:
+				kept[key+"|"+day.Format("20060102")] = true
+			}
+		}
+	}
+
+	var expired []datastructs.ArchAvailableData
+	for _, archive := range archives {
+		if !kept[seriesKey(archive)+"|"+archive.ContentDate.Format("20060102")] {
+			expired = append(expired, archive)
+		}
+	}
+	return expired
+}
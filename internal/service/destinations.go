@@ -0,0 +1,557 @@
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/local"
+	"captura-backup/internal/storage/remote/ftp"
+	"captura-backup/internal/storage/remote/sftp"
+	"captura-backup/internal/storage/remote/webdav"
+	"captura-backup/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// defaultDestination is the name of the storage configured in the [storage] and [remote.cfg] sections,
+// the archives of the catalog without the storage name belong to it
+const defaultDestination = "default"
+
+// defaultResumeRetries is the number of reconnects to resume the interrupted transfer of the remote storage
+const defaultResumeRetries = 3
+
+// destination is a named storage profile, the archives of each data type are written to one of them
+type destination struct {
+	name     string
+	protocol string // local, ftp, sftp, webdav or postgres
+	path     string
+	remote   storage.RemoteConfig
+	// the archive database of the postgres protocol, the host, port, user and password are in remote
+	dbname, sslmode string
+	// the destinations with copies of the archives and the replication policy
+	replicas    []string
+	replication string
+	// the destination of the archives older than coldAfter days
+	cold      string
+	coldAfter int
+	// the number of the open connections to the storage
+	poolSize int
+	// the retry policy of the transient errors of the storage
+	retry storage.RetryConfig
+	// the transfer rate limits of the storage, nil means no limit
+	upload, download *storage.Limiter
+	// the quota of the archive files in bytes, 0 means no quota
+	quota int64
+	// the profile of the storage_settings rows, their storage period overrides keep_arch_days
+	// and the archives of the profile without auto cleaning are not removed by the retention rules
+	settings      bool
+	storagePeriod int
+	autoCleaning  bool
+}
+
+type destinations struct {
+	sync.RWMutex
+	profiles map[string]*destination
+	// the data type ID and the name of its destination
+	routes map[int]string
+	// the producer pools of the destinations by name, they are created on the first use
+	pools map[string]*storage.Pool
+	// the connections to the archive databases by name, they are created on the first use
+	databases map[string]store.ArchiveDatabase
+	// the transfer rate limits of all storages together
+	upload, download *storage.Limiter
+}
+
+// loadDestinations reads the storage profiles: the default one from the [storage] and [remote.cfg] sections,
+// the named ones from the [storage.<name>] sections and from the storage_settings and config_sftp tables.
+// The data types listed in data_ids of the section or in storage_settings are routed to the profile,
+// the others to the default storage.
+func (s *Service) loadDestinations(ctx context.Context) error {
+	// by default each worker has its own connection to the storage
+	poolSize := s.ini.Section("storage").Key("pool_size").MustInt(s.ini.Section("service").Key("limit_workers").MustInt(5))
+	profiles := map[string]*destination{
+		defaultDestination: {
+			name:     defaultDestination,
+			protocol: s.ini.Section("storage").Key("use_remote").MustString("local"),
+			path:     s.ini.Section("storage").Key("path").String(),
+			remote:   remoteConfig(s.ini.Section("remote.cfg")),
+			dbname:   s.ini.Section("remote.cfg").Key("database").String(),
+			sslmode:  s.ini.Section("remote.cfg").Key("sslmode").MustString("disable"),
+			poolSize: poolSize,
+			retry:    retryConfig(s.ini.Section("storage")),
+		},
+	}
+	storagePolicies(profiles[defaultDestination], s.ini.Section("storage"))
+	if err := transferLimits(profiles[defaultDestination], s.ini.Section("storage")); err != nil {
+		return fmt.Errorf("[storage]: %w", err)
+	}
+	upload, err := transferLimiter(s.ini.Section("storage"), "total_upload_limit")
+	if err != nil {
+		return fmt.Errorf("[storage]: %w", err)
+	}
+	download, err := transferLimiter(s.ini.Section("storage"), "total_download_limit")
+	if err != nil {
+		return fmt.Errorf("[storage]: %w", err)
+	}
+	routes := make(map[int]string)
+
+	for _, section := range s.ini.Sections() {
+		name := strings.TrimPrefix(section.Name(), "storage.")
+		if name == section.Name() || name == "" {
+			continue
+		}
+		if name == defaultDestination {
+			return fmt.Errorf("[%s]: the name of the storage is reserved", section.Name())
+		}
+		profiles[name] = &destination{
+			name:     name,
+			protocol: section.Key("use_remote").MustString("local"),
+			path:     section.Key("path").String(),
+			remote:   remoteConfig(section),
+			dbname:   section.Key("database").String(),
+			sslmode:  section.Key("sslmode").MustString("disable"),
+			poolSize: section.Key("pool_size").MustInt(poolSize),
+			retry:    retryConfig(section),
+		}
+		storagePolicies(profiles[name], section)
+		if err := transferLimits(profiles[name], section); err != nil {
+			return fmt.Errorf("[%s]: %w", section.Name(), err)
+		}
+		for _, id := range section.Key("data_ids").Ints(",") {
+			routes[id] = name
+		}
+	}
+
+	if s.storer != nil {
+		settings, err := s.storer.StorageDestinations(ctx)
+		if err != nil {
+			return fmt.Errorf("getting storage settings: %w", err)
+		}
+		// the rows of one storage name share the profile, so they must describe the same storage
+		owners := make(map[string]int)
+		for _, st := range settings {
+			if st.Name == defaultDestination {
+				return fmt.Errorf("storage settings of data type %d: the name of the storage is reserved", st.DataID)
+			}
+			if p, ok := profiles[st.Name]; ok {
+				owner, ok := owners[st.Name]
+				if !ok {
+					return fmt.Errorf("storage settings of data type %d: the storage [%s] is configured in the section [storage.%s]",
+						st.DataID, st.Name, st.Name)
+				}
+				if p.protocol != st.Protocol || p.path != st.Path || p.storagePeriod != st.StoragePeriod || p.autoCleaning != st.AutoCleaning {
+					return fmt.Errorf("storage settings of data type %d: the storage [%s] differs from the settings of data type %d",
+						st.DataID, st.Name, owner)
+				}
+				routes[st.DataID] = st.Name
+				continue
+			}
+			owners[st.Name] = st.DataID
+			profiles[st.Name] = &destination{
+				name:          st.Name,
+				protocol:      st.Protocol,
+				path:          st.Path,
+				poolSize:      poolSize,
+				retry:         retryConfig(s.ini.Section("storage")),
+				settings:      true,
+				storagePeriod: st.StoragePeriod,
+				autoCleaning:  st.AutoCleaning,
+				remote: storage.RemoteConfig{
+					Host:           st.Host,
+					Port:           st.Port,
+					AuthMethod:     st.AuthMethod,
+					User:           st.User,
+					Password:       st.Password,
+					PrivateKeyFile: st.PrivateKey,
+					ResumeRetries:  defaultResumeRetries,
+					Timeout:        st.Timeout,
+				},
+			}
+			if err := transferLimits(profiles[st.Name], s.ini.Section("storage")); err != nil {
+				return fmt.Errorf("[storage]: %w", err)
+			}
+			routes[st.DataID] = st.Name
+		}
+	}
+
+	for name, profile := range profiles {
+		// the rows in the archive database are neither copied nor moved as the files
+		if profile.database() {
+			if profile.dbname == "" {
+				return fmt.Errorf("storage [%s]: the database is not specified", name)
+			}
+			if len(profile.replicas) != 0 || profile.cold != "" {
+				return fmt.Errorf("storage [%s]: the archive database has no replicas and cold storage", name)
+			}
+		} else if profile.path == "" {
+			return fmt.Errorf("storage [%s]: the path is not specified", name)
+		}
+		for _, replica := range profile.replicas {
+			if r, ok := profiles[replica]; !ok || replica == name || r.database() {
+				return fmt.Errorf("storage [%s]: wrong replica storage [%s]", name, replica)
+			}
+		}
+		if profile.cold != "" {
+			if c, ok := profiles[profile.cold]; !ok || profile.cold == name || c.database() {
+				return fmt.Errorf("storage [%s]: wrong cold storage [%s]", name, profile.cold)
+			}
+			if profile.coldAfter <= 0 {
+				return fmt.Errorf("storage [%s]: cold_after_days must be greater than 0", name)
+			}
+		}
+	}
+	for id, name := range routes {
+		if _, ok := profiles[name]; !ok {
+			return fmt.Errorf("data type %d: unknown storage [%s]", id, name)
+		}
+	}
+
+	s.destinations.Lock()
+	s.destinations.profiles = profiles
+	s.destinations.routes = routes
+	s.destinations.upload, s.destinations.download = upload, download
+	pools, databases := s.destinations.pools, s.destinations.databases
+	s.destinations.pools = make(map[string]*storage.Pool)
+	s.destinations.databases = make(map[string]store.ArchiveDatabase)
+	s.destinations.Unlock()
+
+	// the connections with the previous settings are closed when the running processes return them
+	for _, pool := range pools {
+		pool.Close()
+	}
+	for _, db := range databases {
+		// Close waits for the running copies
+		go db.Close()
+	}
+	return nil
+}
+
+// closePools closes the connections to the storages.
+func (s *Service) closePools() {
+	s.destinations.Lock()
+	defer s.destinations.Unlock()
+	for name, pool := range s.destinations.pools {
+		pool.Close()
+		delete(s.destinations.pools, name)
+	}
+	for name, db := range s.destinations.databases {
+		db.Close()
+		delete(s.destinations.databases, name)
+	}
+}
+
+// database reports whether the archives of the destination are kept in the archive database instead of the files.
+func (d *destination) database() bool {
+	return d.protocol == "postgres"
+}
+
+// fileArchives returns the archives kept in the files of the storages, the processes working with
+// the archive files skip the archives kept in the archive database and the moved tables.
+func (s *Service) fileArchives(archives []datastructs.ArchAvailableData) []datastructs.ArchAvailableData {
+	files := make([]datastructs.ArchAvailableData, 0, len(archives))
+	for _, archive := range archives {
+		if archive.Action == "move" {
+			continue
+		}
+		if d, err := s.destination(archive.Storage); err != nil || !d.database() {
+			files = append(files, archive)
+		}
+	}
+	return files
+}
+
+// archiveDatabase returns the connection to the archive database of the destination.
+func (s *Service) archiveDatabase(ctx context.Context, d *destination) (store.ArchiveDatabase, error) {
+	if s.archiveDB != nil {
+		return s.archiveDB, nil
+	}
+	s.destinations.RLock()
+	db, ok := s.destinations.databases[d.name]
+	s.destinations.RUnlock()
+	if ok {
+		return db, nil
+	}
+
+	db, err := s.connectArchiveDatabase(ctx, d)
+	if err != nil {
+		return nil, fmt.Errorf("storage [%s]: %w", d.name, err)
+	}
+	s.destinations.Lock()
+	defer s.destinations.Unlock()
+	if s.destinations.databases == nil {
+		s.destinations.databases = make(map[string]store.ArchiveDatabase)
+	}
+	// the connection of the worker connected first is kept
+	if existing, ok := s.destinations.databases[d.name]; ok {
+		db.Close()
+		return existing, nil
+	}
+	s.destinations.databases[d.name] = db
+	return db, nil
+}
+
+// producerPool returns the pool of the connections to the storage of the destination.
+func (s *Service) producerPool(d *destination) *storage.Pool {
+	s.destinations.Lock()
+	defer s.destinations.Unlock()
+	if s.destinations.pools == nil {
+		s.destinations.pools = make(map[string]*storage.Pool)
+	}
+	pool, ok := s.destinations.pools[d.name]
+	if !ok {
+		pool = storage.NewPool(d.poolSize, func() (storage.Producer, error) {
+			return s.filesProducer(d)
+		})
+		s.destinations.pools[d.name] = pool
+	}
+	return pool
+}
+
+func remoteConfig(section *ini.Section) storage.RemoteConfig {
+	return storage.RemoteConfig{
+		URL:                  section.Key("url").String(),
+		Host:                 section.Key("host").String(),
+		Port:                 section.Key("port").String(),
+		AuthMethod:           section.Key("auth_method").String(),
+		User:                 section.Key("user").String(),
+		Password:             section.Key("pass").String(),
+		PrivateKeyFile:       section.Key("privat_key").String(),
+		PrivateKeyPassphrase: section.Key("key_passphrase").String(),
+		KnownHostsFile:       section.Key("known_hosts").String(),
+		HostKeyFingerprint:   section.Key("host_key_fingerprint").String(),
+		TrustOnFirstUse:      section.Key("trust_on_first_use").MustBool(false),
+		AgentSocket:          section.Key("agent_socket").String(),
+		TLSMode:              section.Key("ftps").String(),
+		TLSCAFile:            section.Key("tls_ca_file").String(),
+		TLSCertFile:          section.Key("tls_cert_file").String(),
+		TLSKeyFile:           section.Key("tls_key_file").String(),
+		TLSServerName:        section.Key("tls_server_name").String(),
+		TLSFingerprint:       section.Key("tls_fingerprint").String(),
+		RequireFTPS:          section.Key("require_ftps").MustBool(false),
+		ResumeRetries:        section.Key("resume_retries").MustInt(defaultResumeRetries),
+		Timeout:              section.Key("timeout").MustInt64(10),
+	}
+}
+
+// retryConfig reads the retry policy of the transient errors of the storage.
+func retryConfig(section *ini.Section) storage.RetryConfig {
+	return storage.RetryConfig{
+		Attempts: section.Key("retry_attempts").MustInt(3),
+		Delay:    time.Duration(section.Key("retry_delay").MustInt(1)) * time.Second,
+		MaxDelay: time.Duration(section.Key("retry_max_delay").MustInt(30)) * time.Second,
+	}
+}
+
+// transferLimits reads the upload and download rate limits of the destination.
+func transferLimits(d *destination, section *ini.Section) (err error) {
+	if d.upload, err = transferLimiter(section, "upload_limit"); err != nil {
+		return err
+	}
+	d.download, err = transferLimiter(section, "download_limit")
+	return err
+}
+
+// transferLimiter reads the rate limit of the key, see storage.ParseRate. Nil is returned if the transfer is not limited.
+func transferLimiter(section *ini.Section, key string) (*storage.Limiter, error) {
+	rate, err := storage.ParseRate(section.Key(key).String())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	if rate.Unlimited() {
+		return nil, nil
+	}
+	return storage.NewLimiter(rate), nil
+}
+
+// storagePolicies reads the replicas, the cold storage and the quota of the destination. They are read
+// only from the section itself, the [storage.<name>] sections would inherit them from [storage].
+func storagePolicies(d *destination, section *ini.Section) {
+	d.replication = section.Key("replication").In(replicateAll, []string{replicateAll, replicateAsync})
+	for _, key := range section.KeyStrings() {
+		switch key {
+		case "replicas":
+			d.replicas = section.Key(key).Strings(",")
+		case "cold_storage":
+			d.cold = section.Key(key).String()
+			d.coldAfter = section.Key("cold_after_days").MustInt(0)
+		case "quota":
+			d.quota = section.Key(key).MustInt64(0) << 30
+		}
+	}
+}
+
+// destinationFor returns the destination of the archives of the data type.
+func (s *Service) destinationFor(dataID int) *destination {
+	s.destinations.RLock()
+	defer s.destinations.RUnlock()
+	if name, ok := s.destinations.routes[dataID]; ok {
+		return s.destinations.profiles[name]
+	}
+	return s.destinations.profiles[defaultDestination]
+}
+
+// destination returns the destination by its name, the empty name means the default storage.
+func (s *Service) destination(name string) (*destination, error) {
+	if name == "" {
+		name = defaultDestination
+	}
+	s.destinations.RLock()
+	defer s.destinations.RUnlock()
+	d, ok := s.destinations.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage [%s]", name)
+	}
+	return d, nil
+}
+
+// allDestinations returns all destinations sorted by name.
+func (s *Service) allDestinations() []*destination {
+	s.destinations.RLock()
+	defer s.destinations.RUnlock()
+	all := make([]*destination, 0, len(s.destinations.profiles))
+	for _, d := range s.destinations.profiles {
+		all = append(all, d)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return all
+}
+
+// replicaOnly reports whether the destination keeps only the copies of the archives of other destinations.
+func (s *Service) replicaOnly(d *destination) bool {
+	s.destinations.RLock()
+	defer s.destinations.RUnlock()
+	if d.name == defaultDestination {
+		return false
+	}
+	for _, name := range s.destinations.routes {
+		if name == d.name {
+			return false
+		}
+	}
+	for _, profile := range s.destinations.profiles {
+		for _, replica := range profile.replicas {
+			if replica == d.name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relocatePath returns the path of the archive in the other destination, the archive keeps
+// the same path relative to the storage root, e.g. for a copy in the replica or in the cold storage.
+func relocatePath(from, to *destination, fileName string) (string, error) {
+	rel, err := filepath.Rel(from.path, fileName)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("archive %s is not in the storage [%s]", fileName, from.name)
+	}
+	return filepath.Join(to.path, rel), nil
+}
+
+// filesProducer connects to the storage of the destination.
+func (s *Service) filesProducer(d *destination) (storage.Producer, error) {
+	cfg := d.remote
+
+	var producer storage.Producer
+
+	if dial, ok := s.dialers[d.protocol]; ok {
+		return dial()
+	}
+
+	switch d.protocol {
+	case "local":
+		return local.NewProducer(), nil
+	case "sftp":
+		client, err := sftp.NewClient(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("new sftp client: %w", err)
+		}
+		producer = sftp.NewProducer(client, &cfg)
+
+	case "ftp":
+		client, err := ftp.NewClient(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("new ftp client: %w", err)
+		}
+		producer = ftp.NewProducer(client, &cfg)
+
+	case "webdav":
+		var err error
+		if producer, err = webdav.NewProducer(&cfg); err != nil {
+			return nil, fmt.Errorf("new webdav client: %w", err)
+		}
+
+	default:
+		return nil, errors.New("[" + d.protocol + "] unsupported protocol")
+	}
+
+	if err := producer.Ping(); err != nil {
+		return nil, fmt.Errorf("remote %s failed ping : %w", d.protocol, err)
+	}
+
+	return producer, nil
+}
+
+// producerSet leases the producers of the destinations from their pools on demand, so the process or
+// the worker working with archives of several destinations uses one connection to each of them.
+// Close returns the producers to the pools.
+type producerSet struct {
+	s         *Service
+	ctx       context.Context // the wait for the producer of the pool is stopped by the context
+	mu        sync.Mutex
+	producers map[string]storage.Producer
+}
+
+func (s *Service) newProducerSet(ctx context.Context) *producerSet {
+	return &producerSet{s: s, ctx: ctx, producers: make(map[string]storage.Producer)}
+}
+
+// get returns the producer and the destination by the name of the destination, the empty name means the default storage.
+func (ps *producerSet) get(name string) (storage.Producer, *destination, error) {
+	d, err := ps.s.destination(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if producer, ok := ps.producers[d.name]; ok {
+		return producer, d, nil
+	}
+	producer, err := ps.s.producerPool(d).Get(ps.ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("storage [%s]: %w", d.name, err)
+	}
+	retry := d.retry
+	// the transfers resumed by the producer are not retried again, the errors of the ftp download
+	// are returned by the reader after ReadFile, so its retries would never happen
+	resumed := (d.protocol == "ftp" || d.protocol == "sftp") && d.remote.ResumeRetries > 0
+	retry.NoSaveRetry = resumed
+	retry.NoReadRetry = resumed || d.protocol == "ftp"
+	retry.OnRetry = func(op, path string, attempt int, delay time.Duration, err error) {
+		ps.s.log.Warnf("Storage: [Storage:%s] %s %s failed, retry %d of %d in %s: %s",
+			d.name, op, path, attempt, retry.Attempts-1, delay.Round(time.Millisecond), err)
+	}
+	ps.s.destinations.RLock()
+	upload := []*storage.Limiter{ps.s.destinations.upload, d.upload}
+	download := []*storage.Limiter{ps.s.destinations.download, d.download}
+	ps.s.destinations.RUnlock()
+	producer = storage.WithRetry(ps.ctx, storage.WithThrottle(producer, upload, download), retry)
+	ps.producers[d.name] = producer
+	return producer, d, nil
+}
+
+func (ps *producerSet) Close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for name, producer := range ps.producers {
+		producer.Close()
+		delete(ps.producers, name)
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"regexp"
+	"time"
+)
+
+// rangeBound is the range bound of the partition by dates, e.g. FOR VALUES FROM ('2020-01-01') TO ('2020-02-01')
+var rangeBound = regexp.MustCompile(`FROM \('(\d{4}-\d{2}-\d{2})[^']*'\) TO \('(\d{4}-\d{2}-\d{2})[^']*'\)`)
+
+// heldBy returns the first legal hold that covers the archive or nil. The archive without ID
+// describes the source data of the day, it is covered by holds on the data type, schema and dates only.
+func heldBy(holds []datastructs.LegalHold, archive datastructs.ArchAvailableData) *datastructs.LegalHold {
+	for i, h := range holds {
+		switch {
+		case h.AvailableDataID != 0 && h.AvailableDataID != archive.ID:
+		case h.DataID != 0 && h.DataID != archive.DataID:
+		case h.SchemaName != "" && h.SchemaName != archive.SchemaName:
+		case !h.DateFrom.IsZero() && archive.ContentDate.Before(h.DateFrom):
+		case !h.DateTo.IsZero() && archive.ContentDate.After(h.DateTo):
+		default:
+			return &holds[i]
+		}
+	}
+	return nil
+}
+
+// partitionHeldBy returns the first legal hold that covers a day of the range of the partition or nil,
+// the partition with another bound is covered by the holds without dates only.
+func partitionHeldBy(holds []datastructs.LegalHold, data *datastructs.ArchiveTable, schema string) *datastructs.LegalHold {
+	archive := datastructs.ArchAvailableData{DataID: data.ID, SchemaName: schema}
+	bound := rangeBound.FindStringSubmatch(data.PartitionBound)
+	if bound == nil {
+		return heldBy(holds, archive)
+	}
+	from, err := time.Parse("2006-01-02", bound[1])
+	if err != nil {
+		return heldBy(holds, archive)
+	}
+	to, err := time.Parse("2006-01-02", bound[2])
+	if err != nil {
+		return heldBy(holds, archive)
+	}
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		archive.ContentDate = day
+		if hold := heldBy(holds, archive); hold != nil {
+			return hold
+		}
+	}
+	return nil
+}
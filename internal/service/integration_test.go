@@ -0,0 +1,253 @@
+package service
+
+import (
+	"captura-backup/internal/storage/remote/sftp/sftptest"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/ini.v1"
+)
+
+// The integration tests run the processes of the service against the PostgreSQL server launched from
+// the binaries in PG_BIN (e.g. PG_BIN=/usr/lib/postgresql/15/bin) and the in-process sftp server.
+// They are skipped if PG_BIN is not set.
+
+// freePort returns the free TCP port of the loopback interface.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startPostgres initializes the cluster in the temp folder, starts the server and creates the database,
+// the server is stopped by the cleanup of the test. It returns the port of the server.
+func startPostgres(t *testing.T, database string) int {
+	bin := os.Getenv("PG_BIN")
+	if bin == "" {
+		t.Skip("PG_BIN is not set, the integration test needs the PostgreSQL binaries")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("PostgreSQL can not be run by root")
+	}
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	if out, err := exec.Command(filepath.Join(bin, "initdb"), "-D", data, "-U", "postgres", "-A", "trust", "-E", "UTF8").CombinedOutput(); err != nil {
+		t.Fatalf("initdb: %s: %s", err, out)
+	}
+	port := freePort(t)
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1", port, dir)
+	pgCtl := filepath.Join(bin, "pg_ctl")
+	if out, err := exec.Command(pgCtl, "-D", data, "-o", options, "-l", filepath.Join(dir, "postgres.log"), "-w", "start").CombinedOutput(); err != nil {
+		t.Fatalf("pg_ctl start: %s: %s", err, out)
+	}
+	t.Cleanup(func() {
+		exec.Command(pgCtl, "-D", data, "-m", "immediate", "stop").Run()
+	})
+
+	pool, err := pgxpool.Connect(context.Background(), fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if _, err := pool.Exec(context.Background(), "CREATE DATABASE "+database); err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+// integrationSchema creates the partitions of raterresult (the data type 6 of tables.sql) with the template
+// of the restore, and the function cloning the template which is expected in the public schema.
+const integrationSchema = `
+CREATE OR REPLACE FUNCTION public.f_clone_table_structure(s_table text, r_template regclass)
+RETURNS void
+LANGUAGE plpgsql AS $$
+BEGIN
+	EXECUTE format('CREATE TABLE %s (LIKE %s INCLUDING ALL)', s_table, r_template);
+END;
+$$;
+
+CREATE SCHEMA raterresult;
+CREATE TABLE raterresult._template_rt ("St_Date" date NOT NULL, "CallID" int8 NOT NULL, "Cost" numeric(12,4) NULL);
+CREATE TABLE raterresult."RT20230101" (LIKE raterresult._template_rt INCLUDING ALL);
+CREATE TABLE raterresult."RT20230102" (LIKE raterresult._template_rt INCLUDING ALL);
+INSERT INTO raterresult."RT20230101" VALUES ('2023-01-01', 1, 0.5), ('2023-01-01', 2, NULL), ('2023-01-01', 3, 1.25);
+INSERT INTO raterresult."RT20230102" VALUES ('2023-01-02', 4, 2), ('2023-01-02', 5, 3.5);
+
+-- the archives of the last day are kept by the cleaning
+UPDATE archive_manager.config_table_list SET keep_arch_days = 1, keep_last = 1 WHERE schemaname = 'raterresult';
+`
+
+// newIntegrationService creates the service with the database and the sftp storage, the database
+// is created by the scripts of the sql folder and seeded by integrationSchema.
+func newIntegrationService(t *testing.T) (*Service, *pgxpool.Pool, string) {
+	pgPort := startPostgres(t, "captdb")
+	sftpServer := sftptest.NewServer(t, nil)
+	archive := filepath.Join(t.TempDir(), "archive")
+
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, fmt.Sprintf("postgres://postgres@127.0.0.1:%d/captdb?sslmode=disable", pgPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	for _, script := range []string{"tables.sql", "functions.sql"} {
+		sql, err := os.ReadFile(filepath.Join("..", "..", "sql", script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pool.Exec(ctx, string(sql)); err != nil {
+			t.Fatalf("%s: %s", script, err)
+		}
+	}
+	if _, err := pool.Exec(ctx, integrationSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{SpaceBeforeInlineComment: true},
+		filepath.Join("..", "..", "configs", "database.conf"),
+		[]byte(`
+[service]
+tmp_folder    = `+t.TempDir()+`
+limit_workers = 2
+
+[logger]
+level = error
+
+[database]
+host = 127.0.0.1
+port = `+strconv.Itoa(pgPort)+`
+
+[storage]
+path          = `+archive+`
+use_remote    = sftp
+auto_cleaning = true
+keep_period   = 0
+
+[remote.cfg]
+host                 = `+sftpServer.Host+`
+port                 = `+sftpServer.Port+`
+user                 = `+sftptest.User+`
+pass                 = `+sftptest.Password+`
+auth_method          = password
+host_key_fingerprint = `+sftpServer.Fingerprint()+`
+timeout              = 5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeStore, err := srv.connectStore(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeStore)
+	t.Cleanup(srv.closePools)
+	if err := srv.checkStorageFolder(); err != nil {
+		t.Fatal(err)
+	}
+	return srv, pool, archive
+}
+
+// catalogRow is the row of arch_available_data checked by the integration tests
+type catalogRow struct {
+	Table       string
+	ContentDate string
+	ContentRows int64
+	FileName    string
+	Deleted     bool
+	Restored    bool
+}
+
+func catalog(t *testing.T, pool *pgxpool.Pool) []catalogRow {
+	rows, err := pool.Query(context.Background(),
+		`SELECT tblname, content_date::text, content_rows, file_name, deleted_at IS NOT NULL, restored_at IS NOT NULL
+		FROM archive_manager.arch_available_data ORDER BY content_date`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var catalog []catalogRow
+	for rows.Next() {
+		var r catalogRow
+		if err := rows.Scan(&r.Table, &r.ContentDate, &r.ContentRows, &r.FileName, &r.Deleted, &r.Restored); err != nil {
+			t.Fatal(err)
+		}
+		catalog = append(catalog, r)
+	}
+	return catalog
+}
+
+func tableRows(t *testing.T, pool *pgxpool.Pool, table string) (int, bool) {
+	var exists bool
+	if err := pool.QueryRow(context.Background(), "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		return 0, false
+	}
+	var rows int
+	if err := pool.QueryRow(context.Background(), "SELECT count(*) FROM "+table).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	return rows, true
+}
+
+func TestIntegrationBackupCleanRestore(t *testing.T) {
+	srv, pool, archive := newIntegrationService(t)
+	ctx := context.Background()
+	first := filepath.Join(archive, "raterresult", "20230101", "RT20230101"+archiveExt)
+	second := filepath.Join(archive, "raterresult", "20230102", "RT20230102"+archiveExt)
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.backupProcess(ctx, &process{DataID: 6, Current: PRC_BACKUP}, wg)
+	})
+	assert.FileExists(t, first)
+	assert.FileExists(t, second)
+	for _, table := range []string{`raterresult."RT20230101"`, `raterresult."RT20230102"`} {
+		_, exists := tableRows(t, pool, table)
+		assert.False(t, exists, "the archived table %s is dropped", table)
+	}
+	assert.Equal(t, []catalogRow{
+		{Table: `"RT20230101"`, ContentDate: "2023-01-01", ContentRows: 3, FileName: first},
+		{Table: `"RT20230102"`, ContentDate: "2023-01-02", ContentRows: 2, FileName: second},
+	}, catalog(t, pool))
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.cleaningStorageProcess(ctx, wg)
+	})
+	assert.NoFileExists(t, first, "the archive is not kept by the retention rules")
+	assert.FileExists(t, second, "the archive of the last day is kept")
+	if rows := catalog(t, pool); assert.Len(t, rows, 2) {
+		assert.True(t, rows[0].Deleted)
+		assert.False(t, rows[1].Deleted)
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.restoreProcess(ctx, &process{DataID: 6, Current: PRC_RESTORE, RestoreToDate: time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)}, wg)
+	})
+	rows, exists := tableRows(t, pool, `raterresult."RT20230102"`)
+	assert.True(t, exists, "the table is created by the template")
+	assert.Equal(t, 2, rows)
+	_, exists = tableRows(t, pool, `raterresult."RT20230101"`)
+	assert.False(t, exists, "the deleted archive is not restored")
+	if rows := catalog(t, pool); assert.Len(t, rows, 2) {
+		assert.False(t, rows[0].Restored)
+		assert.True(t, rows[1].Restored)
+	}
+}
@@ -0,0 +1,329 @@
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/encrypter"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/storage"
+	"captura-backup/internal/store"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// archiveFile is the archive file found in the storage folder
+type archiveFile struct {
+	schema string
+	day    time.Time
+	path   string
+	info   fs.FileInfo
+}
+
+// RebuildCatalog walks the storage folders of all destinations except the replicas and fills the catalog of available archives again.
+// The storage layout is <storage path>/<schema>/<YYYYMMDD>/<table>.backup.gz, the data of each archive
+// is taken from its manifest or, if there is no manifest, it is counted from the archive itself.
+// The files at the path of a primary archive in its replica are the copies, they are recorded in arch_copies
+// and are not added as the primary archives even if the replica keeps the primary archives of other data types.
+func (s *Service) RebuildCatalog() error {
+	ctx := context.Background()
+
+	if err := s.loadKeyring(); err != nil {
+		return fmt.Errorf("load encryption keys: %w", err)
+	}
+	if err := s.loadManifestKeys(); err != nil {
+		return err
+	}
+
+	closeStore, err := s.connectStore(ctx)
+	if err != nil {
+		return fmt.Errorf("database connect: %w", err)
+	}
+	defer closeStore()
+
+	producers := s.newProducerSet(ctx)
+	defer producers.Close()
+
+	// the files of all storages are listed first to tell the copies from the primary archives
+	files := make(map[string][]archiveFile)
+	paths := make(map[string]map[string]bool)
+	for _, dest := range s.allDestinations() {
+		if dest.database() {
+			s.log.Infof("Rebuild catalog: [Storage:%s] skipped, the archives are kept in the archive database", dest.name)
+			continue
+		}
+		producer, _, err := producers.get(dest.name)
+		if err != nil {
+			return fmt.Errorf("get files producer: %w", err)
+		}
+		paths[dest.name] = make(map[string]bool)
+		if err := s.walkArchives(producer, dest.path, func(schema string, day time.Time, path string, file fs.FileInfo) error {
+			files[dest.name] = append(files[dest.name], archiveFile{schema: schema, day: day, path: path, info: file})
+			paths[dest.name][path] = true
+			return nil
+		}); err != nil {
+			return fmt.Errorf("storage [%s]: %w", dest.name, err)
+		}
+	}
+	copies := make(map[string]map[string]bool)
+	for _, dest := range s.allDestinations() {
+		if s.replicaOnly(dest) {
+			continue
+		}
+		for _, name := range dest.replicas {
+			replica, err := s.destination(name)
+			if err != nil {
+				return err
+			}
+			if copies[name] == nil {
+				copies[name] = make(map[string]bool)
+			}
+			for _, file := range files[dest.name] {
+				if path, err := relocatePath(dest, replica, file.path); err == nil && paths[name][path] {
+					copies[name][path] = true
+				}
+			}
+		}
+	}
+
+	var added, failed int
+	for _, dest := range s.allDestinations() {
+		if _, ok := files[dest.name]; !ok {
+			continue
+		}
+		if s.replicaOnly(dest) {
+			s.log.Infof("Rebuild catalog: [Storage:%s] skipped, the storage keeps only the copies of the archives", dest.name)
+			continue
+		}
+		producer, _, err := producers.get(dest.name)
+		if err != nil {
+			return fmt.Errorf("get files producer: %w", err)
+		}
+		for _, file := range files[dest.name] {
+			if copies[dest.name][file.path] {
+				s.log.Debugf("Rebuild catalog: [Storage:%s File:%s] skipped, the file is a copy of the archive", dest.name, file.path)
+				continue
+			}
+			data, err := s.archiveMetadata(ctx, producer, file.schema, file.day, file.path, file.info)
+			if err == nil {
+				data.Storage = dest.name
+				data.ID, err = s.storer.AddArchAvailableData(ctx, data)
+			}
+			if err != nil {
+				failed++
+				s.log.Errorf("Rebuild catalog: [Storage:%s File:%s] %s", dest.name, file.path, err)
+				continue
+			}
+			added++
+			s.log.Infof("Rebuild catalog: [Storage:%s File:%s] added with %d rows", dest.name, file.path, data.ContentRows)
+			s.rebuildCopies(ctx, dest, data, copies)
+		}
+	}
+
+	s.log.Infof("Rebuild catalog: added %d archives, failed %d", added, failed)
+	if failed != 0 {
+		return fmt.Errorf("%d archives could not be added to the catalog", failed)
+	}
+	return nil
+}
+
+// rebuildCopies records the copies of the archive found in the replicas of the destination
+func (s *Service) rebuildCopies(ctx context.Context, dest *destination, data datastructs.ArchAvailableData, copies map[string]map[string]bool) {
+	for _, name := range dest.replicas {
+		replica, err := s.destination(name)
+		if err != nil {
+			continue
+		}
+		path, err := relocatePath(dest, replica, data.FileName)
+		if err != nil || !copies[name][path] {
+			continue
+		}
+		c := datastructs.ArchiveCopy{AvailableDataID: data.ID, Storage: name, FileName: path, Status: copyStatusOK}
+		if err := s.storer.SaveArchiveCopy(ctx, c); err != nil {
+			s.log.Errorf("Rebuild catalog: [Storage:%s File:%s] save archive copy: %s", name, path, err)
+		}
+	}
+}
+
+// walkArchives calls the fn for each archive file in the storage folder
+func (s *Service) walkArchives(producer storage.Producer, storagePath string, fn func(schema string, day time.Time, path string, file fs.FileInfo) error) error {
+	schemas, err := producer.ReadDir(storagePath)
+	if err != nil {
+		return fmt.Errorf("read storage folder: %w", err)
+	}
+	trash := s.ini.Section("storage").Key("trash_folder").MustString(".trash")
+	for _, schema := range schemas {
+		if !schema.IsDir() || schema.Name() == trash {
+			continue
+		}
+		dates, err := producer.ReadDir(filepath.Join(storagePath, schema.Name()))
+		if err != nil {
+			return fmt.Errorf("read schema folder: %w", err)
+		}
+		for _, date := range dates {
+			day, err := time.Parse("20060102", date.Name())
+			if err != nil || !date.IsDir() {
+				s.log.Warnf("Walk storage: skip %s: not a folder of the backup day", filepath.Join(schema.Name(), date.Name()))
+				continue
+			}
+			files, err := producer.ReadDir(filepath.Join(storagePath, schema.Name(), date.Name()))
+			if err != nil {
+				return fmt.Errorf("read backup day folder: %w", err)
+			}
+			for _, file := range files {
+				if file.IsDir() || !strings.HasSuffix(file.Name(), archiveExt) {
+					continue
+				}
+				if err := fn(schema.Name(), day, filepath.Join(storagePath, schema.Name(), date.Name(), file.Name()), file); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// archiveMetadata returns the catalog fields of the archive. The data type is found by the config of the data types,
+// if the config is lost with the catalog, the data type is taken from the manifest or, without the manifest,
+// the archive is added with the unknown data type 0 and restored by the restore of all data types.
+func (s *Service) archiveMetadata(ctx context.Context, producer storage.Producer, schema string, day time.Time, path string, info fs.FileInfo) (datastructs.ArchAvailableData, error) {
+	table := strings.TrimSuffix(info.Name(), archiveExt)
+	m, err := s.readManifest(producer, path)
+	if err != nil {
+		return datastructs.ArchAvailableData{}, err
+	}
+
+	data, err := s.storer.ArchiveDataType(ctx, schema, table)
+	unknown := errors.Is(err, store.ErrNoDataType)
+	if err != nil && !unknown {
+		return data, fmt.Errorf("find data type of the table %s.%s: %w", schema, table, err)
+	}
+	if unknown {
+		data = datastructs.ArchAvailableData{SchemaName: schema, TableName: quoteIdent(table)}
+		if m != nil {
+			data.DataID = m.DataID
+			data.SingleTable = m.SingleTable
+			data.TableName = strings.TrimPrefix(m.Table, schema+".")
+		}
+		s.log.Warnf("Rebuild catalog: [File:%s] no data type of the table %s.%s in the config, the archive is added with the data type %d",
+			path, schema, table, data.DataID)
+	}
+	data.FileName = path
+	data.FileSize = info.Size()
+	data.ContentDate = day
+	data.ArchivedAt = info.ModTime()
+
+	file, err := producer.ReadFile(path)
+	if err != nil {
+		return data, fmt.Errorf("read archive file: %w", err)
+	}
+	defer file.Close()
+
+	archive, keyID, err := encrypter.Inspect(file)
+	if err != nil {
+		return data, fmt.Errorf("read archive header: %w", err)
+	}
+	data.KeyID = keyID
+
+	if m != nil {
+		data.ContentRows = m.Rows
+		data.Checksum = m.Checksum
+		data.ArchivedAt = m.CreatedAt
+		return data, nil
+	}
+
+	if keyID != "" {
+		if s.keyring == nil {
+			return data, fmt.Errorf("archive encrypted with the key [%s], but encryption is not configured", keyID)
+		}
+		if archive, err = s.keyring.DecryptReader(archive); err != nil {
+			return data, fmt.Errorf("decrypt archive file: %w", err)
+		}
+	}
+	checksum := manifest.NewChecksum()
+	gzReader, err := gzip.NewReader(io.TeeReader(archive, checksum))
+	if err != nil {
+		return data, fmt.Errorf("read archive file: %w", err)
+	}
+	defer gzReader.Close()
+	data.TableDDL = manifest.DDLFromGzipExtra(gzReader.Extra)
+	// the definition is written only into the archives of the single tables
+	if unknown {
+		data.SingleTable = data.TableDDL != ""
+	}
+
+	rows, err := countCSVRows(gzReader)
+	if err != nil {
+		return data, fmt.Errorf("count archive rows: %w", err)
+	}
+	// the bytes after the gzip stream not read by the gzip reader are counted too, the checksum
+	// of the catalog is counted on the whole file as by the backup
+	if _, err := io.Copy(checksum, archive); err != nil {
+		return data, fmt.Errorf("read archive file: %w", err)
+	}
+	data.ContentRows = rows
+	data.Checksum = checksum.Sum()
+	return data, nil
+}
+
+// readManifest returns the manifest of the archive or nil if the archive has no manifest.
+// The signature is checked if the verify key is configured.
+func (s *Service) readManifest(producer storage.Producer, path string) (*manifest.Manifest, error) {
+	if _, err := producer.Stat(path + manifest.FileExt); err != nil {
+		return nil, nil
+	}
+	document, err := producer.ReadFile(path + manifest.FileExt)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	defer document.Close()
+	body, err := io.ReadAll(document)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if s.verifyKey == nil {
+		return manifest.Decode(body)
+	}
+	return manifest.Verify(body, s.verifyKey)
+}
+
+// plainIdent is the identifier that quote_ident leaves without the quotes
+var plainIdent = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// quoteIdent quotes the table name as quote_ident does for the names of the catalog
+func quoteIdent(name string) string {
+	if plainIdent.MatchString(name) {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// countCSVRows returns the number of records in the CSV data created by COPY without the header
+func countCSVRows(r io.Reader) (int64, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = ';'
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	var rows int64
+	for {
+		_, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		rows++
+	}
+	if rows > 0 {
+		rows--
+	}
+	return rows, nil
+}
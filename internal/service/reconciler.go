@@ -0,0 +1,266 @@
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/storage"
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kinds of discrepancies between the storage and the catalog
+const (
+	issueOrphanedFile      = "orphaned_file"
+	issueMissingFile       = "missing_file"
+	issueSizeMismatch      = "size_mismatch"
+	issueDeletedFileExists = "deleted_file_exists"
+	issueMissingCopy       = "missing_copy"
+)
+
+// the maximum number of issues listed in the notification, the full list is in the report table
+const reconcileNotifyLimit = 100
+
+// The process compares the archive files in the storage with the catalog and writes the found
+// discrepancies into the report table. In the fix mode orphaned files are added to the catalog,
+// rows of missing files are marked as deleted, files of deleted rows are removed and missing copies
+// are left to the replication process.
+// Size mismatches are only reported, they should be checked with the verification of archives.
+func (s *Service) reconcileProcess(ctx context.Context, prc *process, wgProcess *sync.WaitGroup) {
+	defer func() {
+		s.stateAndMessage(ctx,
+			STATE_INACTIVE,
+			"Service finished reconcile process at "+time.Now().Format("02.01.2006 15:04:05"),
+		)
+		wgProcess.Done()
+	}()
+
+	if _, ok := s.processes.LoadOrStore(prc.Current, prc); ok {
+		s.log.Warn("Reconcile process: the reconcile process is already in progress")
+		return
+	}
+	defer s.processes.Delete(prc.Current)
+
+	producers := s.newProducerSet(ctx)
+	defer producers.Close()
+
+	s.stateAndMessage(ctx,
+		STATE_ACTIVE,
+		"Service started reconcile process at "+time.Now().Format("02.01.2006 15:04:05"),
+	)
+
+	checkedAt := time.Now()
+	issues, err := s.reconcile(ctx, producers, prc.Fix)
+	if err != nil {
+		s.log.Errorln("Reconcile process:", err)
+		if err := s.sendMessage(s.makeDataToSend("error", "Reconciliation of the storage and the catalog failed", err.Error())); err != nil {
+			s.log.Errorln("Reconcile process: send notification:", err)
+		}
+		return
+	}
+
+	if err := s.storer.SaveReconcileReport(ctx, checkedAt, issues); err != nil {
+		s.log.Errorln("Reconcile process: save report:", err)
+	}
+
+	var (
+		fixed int
+		lines []string
+	)
+	for _, issue := range issues {
+		line := fmt.Sprintf("%s: %s", issue.Issue, issue.FileName)
+		if issue.Details != "" {
+			line += " (" + issue.Details + ")"
+		}
+		if issue.Fixed {
+			fixed++
+			line += " - fixed"
+		}
+		s.log.Warnf("Reconcile process: %s", line)
+		if len(lines) < reconcileNotifyLimit {
+			lines = append(lines, line)
+		}
+	}
+	if len(issues) > reconcileNotifyLimit {
+		lines = append(lines, fmt.Sprintf("... and %d more, see the reconcile report", len(issues)-reconcileNotifyLimit))
+	}
+
+	text := fmt.Sprintf("Reconciliation finished: found %d issues, fixed %d", len(issues), fixed)
+	s.log.Infof("Reconcile process: %s", text)
+	tmpl := "info"
+	if len(issues) != 0 {
+		tmpl = "error"
+	}
+	if err := s.sendMessage(s.makeDataToSend(tmpl, text, lines...)); err != nil {
+		s.log.Errorln("Reconcile process: send notification:", err)
+	}
+}
+
+// reconcile returns the discrepancies between the storages and the catalog, and fixes them if fix is set.
+func (s *Service) reconcile(ctx context.Context, producers *producerSet, fix bool) ([]datastructs.ReconcileIssue, error) {
+	archives, err := s.storer.CatalogArchives(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting catalog archives: %w", err)
+	}
+	archives = s.fileArchives(archives)
+
+	type stored struct {
+		dest     string
+		producer storage.Producer
+		schema   string
+		day      time.Time
+		path     string
+		file     fs.FileInfo
+	}
+	// the files are found by the name of the destination and the path
+	files := make(map[string]stored)
+	for _, dest := range s.allDestinations() {
+		if dest.database() {
+			continue
+		}
+		producer, _, err := producers.get(dest.name)
+		if err != nil {
+			return nil, fmt.Errorf("get files producer: %w", err)
+		}
+		if err := s.walkArchives(producer, dest.path, func(schema string, day time.Time, path string, file fs.FileInfo) error {
+			files[dest.name+":"+path] = stored{dest: dest.name, producer: producer, schema: schema, day: day, path: path, file: file}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("storage [%s]: %w", dest.name, err)
+		}
+	}
+
+	holds, err := s.storer.ActiveLegalHolds(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting legal holds: %w", err)
+	}
+
+	copies, err := s.storer.ArchiveCopies(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("getting archive copies: %w", err)
+	}
+
+	var issues []datastructs.ReconcileIssue
+	// the storages with the written copy of the archive, the archive without the primary file is kept for them
+	replicated := make(map[int][]string)
+	for _, c := range copies {
+		key := c.Storage + ":" + c.FileName
+		_, exists := files[key]
+		delete(files, key)
+		if exists && c.Status == copyStatusOK {
+			replicated[c.AvailableDataID] = append(replicated[c.AvailableDataID], c.Storage)
+			continue
+		}
+		if exists || c.Status != copyStatusOK {
+			continue
+		}
+		issue := datastructs.ReconcileIssue{AvailableDataID: c.AvailableDataID, Issue: issueMissingCopy, FileName: c.FileName, Details: "storage " + c.Storage}
+		if fix {
+			c.Status, c.Error = copyStatusPending, "the file is missing in the storage"
+			if err := s.storer.SaveArchiveCopy(ctx, c); err != nil {
+				s.log.Errorf("Reconcile process: [ID:%d Storage:%s] mark copy as pending: %s", c.AvailableDataID, c.Storage, err)
+			} else {
+				issue.Fixed = true
+			}
+		}
+		issues = append(issues, issue)
+	}
+
+	for _, archive := range archives {
+		key := archive.Storage + ":" + archive.FileName
+		if archive.Storage == "" {
+			key = defaultDestination + ":" + archive.FileName
+		}
+		file, exists := files[key]
+		delete(files, key)
+
+		issue := datastructs.ReconcileIssue{AvailableDataID: archive.ID, FileName: archive.FileName}
+		switch {
+		case !archive.DeletedAt.IsZero() && exists:
+			issue.Issue = issueDeletedFileExists
+			issue.Details = "deleted at " + archive.DeletedAt.Format("02.01.2006 15:04:05")
+			if hold := heldBy(holds, archive); hold != nil {
+				issue.Details += fmt.Sprintf(", kept by the legal hold %d", hold.ID)
+			} else if fix {
+				issue.Fixed = s.reconcileRemoveFile(file.producer, file.dest, archive)
+			}
+		case !archive.DeletedAt.IsZero():
+			continue
+		case !exists:
+			issue.Issue = issueMissingFile
+			if storages := replicated[archive.ID]; len(storages) != 0 {
+				issue.Details = "copies are available in the storages " + strings.Join(storages, ", ")
+			} else if fix {
+				if err := s.storer.MarkArchiveDeleted(ctx, archive.ID, time.Now()); err != nil {
+					s.log.Errorf("Reconcile process: [ID:%d] mark archive as deleted: %s", archive.ID, err)
+				} else {
+					issue.Fixed = true
+				}
+			}
+		case archive.FileSize != 0 && archive.FileSize != file.file.Size():
+			issue.Issue = issueSizeMismatch
+			issue.Details = fmt.Sprintf("catalog size %d, file size %d", archive.FileSize, file.file.Size())
+		default:
+			continue
+		}
+		issues = append(issues, issue)
+	}
+
+	// the files left are not in the catalog
+	orphaned := make([]string, 0, len(files))
+	for key := range files {
+		orphaned = append(orphaned, key)
+	}
+	sort.Strings(orphaned)
+	for _, key := range orphaned {
+		file := files[key]
+		issue := datastructs.ReconcileIssue{Issue: issueOrphanedFile, FileName: file.path, Details: "storage " + file.dest}
+		if fix {
+			data, err := s.archiveMetadata(ctx, file.producer, file.schema, file.day, file.path, file.file)
+			if err == nil {
+				data.Storage = file.dest
+				_, err = s.storer.AddArchAvailableData(ctx, data)
+			}
+			if err != nil {
+				issue.Details += ": " + err.Error()
+				s.log.Errorf("Reconcile process: [Storage:%s File:%s] add archive to the catalog: %s", file.dest, file.path, err)
+			} else {
+				issue.Fixed = true
+			}
+		}
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
+
+// reconcileRemoveFile removes the file of the deleted archive with its manifest,
+// the file is moved to the trash of the destination if the trash is enabled.
+func (s *Service) reconcileRemoveFile(producer storage.Producer, destName string, archive datastructs.ArchAvailableData) bool {
+	path := archive.FileName
+	dest, err := s.destination(destName)
+	if err != nil {
+		s.log.Errorf("Reconcile process: [File:%s] %s", path, err)
+		return false
+	}
+	if trash := s.trashFolder(dest); trash != "" {
+		if err := s.moveToTrash(producer, trash, archive); err != nil {
+			s.log.Errorf("Reconcile process: [File:%s] move file of deleted archive to trash: %s", path, err)
+			return false
+		}
+		return true
+	}
+	if err := producer.Remove(path); err != nil {
+		s.log.Errorf("Reconcile process: [File:%s] remove file of deleted archive: %s", path, err)
+		return false
+	}
+	if _, err := producer.Stat(path + manifest.FileExt); err == nil {
+		if err := producer.Remove(path + manifest.FileExt); err != nil {
+			s.log.Errorf("Reconcile process: [File:%s] remove manifest of deleted archive: %s", path, err)
+		}
+	}
+	return true
+}
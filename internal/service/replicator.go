@@ -0,0 +1,274 @@
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// replication policies of the destination
+const (
+	// all copies must be written before the data is deleted from the database
+	replicateAll = "all"
+	// the data is deleted after the primary copy is written, the failed copies are retried by the replication process
+	replicateAsync = "async"
+)
+
+// statuses of the archive copies
+const (
+	copyStatusOK      = "ok"
+	copyStatusPending = "pending"
+	copyStatusDeleted = "deleted"
+)
+
+// defaultReplicationInterval is the period of the retries of the pending copies in minutes
+const defaultReplicationInterval = 10
+
+// writeReplicas writes the copies of the new archive from the local gzip file to the replicas of the destination
+// and records their status in the catalog. The failed copies are recorded as pending.
+func (s *Service) writeReplicas(ctx context.Context, producers *producerSet, dest *destination, data datastructs.ArchAvailableData, gzFile string, size int64, ddlHash string) error {
+	var errs []string
+	for _, name := range dest.replicas {
+		c := datastructs.ArchiveCopy{AvailableDataID: data.ID, Storage: name, Status: copyStatusOK}
+		err := func() error {
+			producer, replica, err := producers.get(name)
+			if err != nil {
+				return err
+			}
+			if c.FileName, err = relocatePath(dest, replica, data.FileName); err != nil {
+				return err
+			}
+			if err := producer.MakedirAll(filepath.Dir(c.FileName)); err != nil {
+				return fmt.Errorf("create storage folder: %w", err)
+			}
+
+			archive, err := s.openArchiveSource(gzFile)
+			if err != nil {
+				return err
+			}
+			err = producer.SaveFile(c.FileName, archive)
+			archive.Close()
+			if err != nil {
+				return fmt.Errorf("save archive copy: %w", err)
+			}
+
+			if s.signKey != nil {
+				copied := data
+				copied.FileName = c.FileName
+				if err := s.saveManifest(producer, copied, size, ddlHash); err != nil {
+					return fmt.Errorf("save archive manifest: %w", err)
+				}
+			}
+			return nil
+		}()
+		if err != nil {
+			c.Status, c.Error = copyStatusPending, err.Error()
+			errs = append(errs, fmt.Sprintf("storage [%s]: %s", name, err))
+		}
+		if c.FileName == "" {
+			c.FileName = data.FileName
+		}
+		if err := s.storer.SaveArchiveCopy(ctx, c); err != nil {
+			errs = append(errs, fmt.Sprintf("storage [%s]: save copy status: %s", name, err))
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// The process writes the pending copies of the archives from their primary copies.
+func (s *Service) replicationProcess(ctx context.Context, prc *process, wgProcess *sync.WaitGroup) {
+	defer wgProcess.Done()
+
+	if _, ok := s.processes.LoadOrStore(prc.Current, prc); ok {
+		s.log.Warn("Replication process: the replication process is already in progress")
+		return
+	}
+	defer s.processes.Delete(prc.Current)
+
+	copies, err := s.storer.PendingArchiveCopies(ctx)
+	if err != nil {
+		s.log.Errorln("Replication process: getting pending copies:", err)
+		return
+	}
+	if len(copies) == 0 {
+		return
+	}
+
+	producers := s.newProducerSet(ctx)
+	defer producers.Close()
+
+	var (
+		written int
+		errs    []string
+	)
+COPIES:
+	for _, c := range copies {
+		select {
+		case <-ctx.Done():
+			break COPIES
+		default:
+		}
+
+		if err := s.copyArchive(producers, c); err != nil {
+			s.log.Errorf("Replication process: [ID:%d Storage:%s] attempt %d: %s", c.AvailableDataID, c.Storage, c.Attempts+1, err)
+			errs = append(errs, fmt.Sprintf("%s [%s]: %s", c.SourceFileName, c.Storage, err))
+			c.Status, c.Error = copyStatusPending, err.Error()
+		} else {
+			written++
+			s.log.Debugf("Replication process: [ID:%d Storage:%s] copy written", c.AvailableDataID, c.Storage)
+			c.Status, c.Error = copyStatusOK, ""
+		}
+		if err := s.storer.SaveArchiveCopy(ctx, c); err != nil {
+			s.log.Errorf("Replication process: [ID:%d Storage:%s] save copy status: %s", c.AvailableDataID, c.Storage, err)
+		}
+	}
+
+	text := fmt.Sprintf("Replication finished: written %d of %d pending copies", written, len(copies))
+	s.log.Infof("Replication process: %s", text)
+	if len(errs) != 0 {
+		if err := s.sendMessage(s.makeDataToSend("error", text, errs...)); err != nil {
+			s.log.Errorln("Replication process: send notification:", err)
+		}
+	}
+}
+
+// copyArchive copies the archive file and its manifest from the primary storage to the replica.
+func (s *Service) copyArchive(producers *producerSet, c datastructs.ArchiveCopy) error {
+	source, _, err := producers.get(c.SourceStorage)
+	if err != nil {
+		return err
+	}
+	target, _, err := producers.get(c.Storage)
+	if err != nil {
+		return err
+	}
+	if err := target.MakedirAll(filepath.Dir(c.FileName)); err != nil {
+		return fmt.Errorf("create storage folder: %w", err)
+	}
+	if err := copyFile(source, target, c.SourceFileName, c.FileName); err != nil {
+		return err
+	}
+	if _, err := source.Stat(c.SourceFileName + manifest.FileExt); err == nil {
+		return copyFile(source, target, c.SourceFileName+manifest.FileExt, c.FileName+manifest.FileExt)
+	}
+	return nil
+}
+
+func copyFile(source, target storage.Producer, from, to string) error {
+	file, err := source.ReadFile(from)
+	if err != nil {
+		return fmt.Errorf("read file: %w", err)
+	}
+	if err := target.SaveFile(to, file); err != nil {
+		file.Close()
+		return fmt.Errorf("save file: %w", err)
+	}
+	return file.Close()
+}
+
+// fetchArchive downloads the archive into the file. If the primary copy is missing or its checksum
+// does not match the catalog, the archive is looked for in the cold storage of its destination,
+// in case it was moved there but the catalog was not updated, and then the copies from the replicas are tried.
+func (s *Service) fetchArchive(ctx context.Context, producers *producerSet, data datastructs.ArchAvailableData, file *os.File) error {
+	locations := []datastructs.ArchiveCopy{{Storage: data.Storage, FileName: data.FileName, Status: copyStatusOK}}
+	if hot, err := s.destination(data.Storage); err == nil && hot.cold != "" {
+		if cold, err := s.destination(hot.cold); err == nil {
+			if fileName, err := relocatePath(hot, cold, data.FileName); err == nil {
+				locations = append(locations, datastructs.ArchiveCopy{Storage: cold.name, FileName: fileName, Status: copyStatusOK})
+			}
+		}
+	}
+	if copies, err := s.storer.ArchiveCopies(ctx, data.ID); err != nil {
+		s.log.Warnf("Restore worker: [ID:%d] getting archive copies: %s", data.ID, err)
+	} else {
+		locations = append(locations, copies...)
+	}
+
+	var errs []string
+	for _, location := range locations {
+		if location.Status != copyStatusOK {
+			continue
+		}
+		err := s.downloadArchive(producers, location, data.Checksum, file)
+		if err == nil {
+			if len(errs) != 0 {
+				s.log.Warnf("Restore worker: [ID:%d] the archive is read from the copy in the storage [%s]", data.ID, location.Storage)
+			}
+			return nil
+		}
+		s.log.Warnf("Restore worker: [ID:%d File:%s] %s", data.ID, location.FileName, err)
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("no valid copy of the archive: %s", strings.Join(errs, "; "))
+}
+
+func (s *Service) downloadArchive(producers *producerSet, location datastructs.ArchiveCopy, checksum string, file *os.File) error {
+	producer, _, err := producers.get(location.Storage)
+	if err != nil {
+		return err
+	}
+	archive, err := producer.ReadFile(location.FileName)
+	if err != nil {
+		return fmt.Errorf("read archive file: %w", err)
+	}
+	defer archive.Close()
+
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, archive); err != nil {
+		return fmt.Errorf("copy archive file: %w", err)
+	}
+	if checksum == "" {
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	plain, err := s.archiveReader(file)
+	if err != nil {
+		return fmt.Errorf("decrypt archive file: %w", err)
+	}
+	sum, _, err := manifest.ReadChecksum(plain)
+	if err != nil {
+		return fmt.Errorf("read archive file: %w", err)
+	}
+	if sum != checksum {
+		return errors.New("archive file does not match the catalog checksum")
+	}
+	return nil
+}
+
+// removeCopies removes the copies of the archive like the primary archive and marks them as deleted.
+func (s *Service) removeCopies(ctx context.Context, producers *producerSet, archive datastructs.ArchAvailableData) error {
+	copies, err := s.storer.ArchiveCopies(ctx, archive.ID)
+	if err != nil {
+		return fmt.Errorf("getting archive copies: %w", err)
+	}
+	for _, c := range copies {
+		copied := archive
+		copied.Storage, copied.FileName = c.Storage, c.FileName
+		if err := s.removeArchiveFiles(producers, copied); err != nil {
+			return fmt.Errorf("storage [%s]: %w", c.Storage, err)
+		}
+	}
+	if len(copies) == 0 {
+		return nil
+	}
+	return s.storer.SetArchiveCopiesStatus(ctx, archive.ID, copyStatusDeleted)
+}
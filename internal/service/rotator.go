@@ -0,0 +1,246 @@
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/encrypter"
+	"captura-backup/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// the number of re-encrypted archives after which the progress notification is sent
+const rotationProgressStep = 500
+
+func (s *Service) loadKeyring() error {
+	if !s.ini.Section("storage").Key("encryption").MustBool(false) {
+		s.keyring = nil
+		return nil
+	}
+	keyring, err := encrypter.LoadKeyring(
+		s.ini.Section("storage").Key("keys_folder").String(),
+		s.ini.Section("storage").Key("current_key").String(),
+	)
+	if err != nil {
+		return err
+	}
+	s.keyring = keyring
+	return nil
+}
+
+// archiveReader returns the reader with decrypted data of the archive, if the archive is not encrypted,
+// the data is returned as is.
+func (s *Service) archiveReader(r io.Reader) (io.Reader, error) {
+	archive, keyID, err := encrypter.Inspect(r)
+	if err != nil {
+		return nil, err
+	}
+	if keyID == "" {
+		return archive, nil
+	}
+	if s.keyring == nil {
+		return nil, fmt.Errorf("archive encrypted with the key [%s], but encryption is not configured", keyID)
+	}
+	return s.keyring.DecryptReader(archive)
+}
+
+// The process re-encrypts all available archives whose key differs from the current one.
+// The catalog is updated after each archive, so the interrupted process continues from the place where it stopped.
+func (s *Service) keyRotationProcess(ctx context.Context, prc *process, wgProcess *sync.WaitGroup) {
+	defer func() {
+		s.stateAndMessage(ctx,
+			STATE_INACTIVE,
+			"Service finished key rotation process at "+time.Now().Format("02.01.2006 15:04:05"),
+		)
+		wgProcess.Done()
+	}()
+
+	if s.keyring == nil {
+		s.log.Warn("Key rotation process: encryption of archives is not configured")
+		return
+	}
+
+	if _, ok := s.processes.LoadOrStore(prc.Current, prc); ok {
+		s.log.Warn("Key rotation process: the key rotation process is already in progress")
+		return
+	}
+	defer s.processes.Delete(prc.Current)
+
+	currentKey := s.keyring.CurrentKey()
+	archives, err := s.storer.ArchivesForKeyRotation(ctx, currentKey)
+	if err != nil {
+		s.log.Errorln("Key rotation process: getting archives for re-encryption:", err)
+		return
+	}
+	archives = s.fileArchives(archives)
+	if len(archives) == 0 {
+		s.log.Tracef("Key rotation process: all archives are encrypted with the key [%s]", currentKey)
+		return
+	}
+
+	producers := s.newProducerSet(ctx)
+	defer producers.Close()
+
+	s.stateAndMessage(ctx,
+		STATE_ACTIVE,
+		"Service started key rotation process at "+time.Now().Format("02.01.2006 15:04:05"),
+	)
+	s.log.Infof("Key rotation process: start re-encryption of %d archives with the key [%s]", len(archives), currentKey)
+	s.notifyKeyRotation(fmt.Sprintf("Key rotation started: %d archives will be re-encrypted with the key [%s]", len(archives), currentKey))
+
+	var (
+		rotated int
+		errs    []string
+	)
+ARCHIVES:
+	for i, archive := range archives {
+		select {
+		case <-ctx.Done():
+			s.log.Warn("Key rotation process: the process was interrupted, it will continue from this place on the next start")
+			break ARCHIVES
+		default:
+		}
+
+		if err := s.rotateArchiveKey(ctx, producers, archive); err != nil {
+			s.log.Errorf("Key rotation process: [ID:%d File:%s] re-encrypt archive: %s", archive.ID, archive.FileName, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", archive.FileName, err))
+			continue
+		}
+		rotated++
+		s.log.Debugf("Key rotation process: [ID:%d File:%s] archive re-encrypted with the key [%s]", archive.ID, archive.FileName, currentKey)
+
+		if (i+1)%rotationProgressStep == 0 {
+			s.notifyKeyRotation(fmt.Sprintf("Key rotation progress: processed %d of %d archives, failed %d", i+1, len(archives), len(errs)))
+		}
+	}
+
+	text := fmt.Sprintf("Key rotation finished: re-encrypted %d of %d archives with the key [%s]", rotated, len(archives), currentKey)
+	s.log.Infof("Key rotation process: %s", text)
+	if len(errs) != 0 {
+		if err := s.sendMessage(s.makeDataToSend("error", text, errs...)); err != nil {
+			s.log.Errorln("Key rotation process: send notification:", err)
+		}
+		return
+	}
+	s.notifyKeyRotation(text)
+}
+
+func (s *Service) notifyKeyRotation(text string) {
+	if err := s.sendMessage(s.makeDataToSend("info", text)); err != nil {
+		s.log.Errorln("Key rotation process: send notification:", err)
+	}
+}
+
+// rotateArchiveKey writes the re-encrypted copy of the archive next to it and replaces the archive with the copy.
+// If the archive is already encrypted with the current key (the process was interrupted after replacement),
+// only the catalog is updated.
+func (s *Service) rotateArchiveKey(ctx context.Context, producers *producerSet, data datastructs.ArchAvailableData) error {
+	currentKey := s.keyring.CurrentKey()
+
+	producer, _, err := producers.get(data.Storage)
+	if err != nil {
+		return fmt.Errorf("get files producer: %w", err)
+	}
+
+	tmpName := data.FileName + ".rekey"
+	if err := recoverReplace(producer, tmpName, data.FileName); err != nil {
+		return fmt.Errorf("recover interrupted replacement: %w", err)
+	}
+
+	file, err := producer.ReadFile(data.FileName)
+	if err != nil {
+		return fmt.Errorf("read archive file: %w", err)
+	}
+	defer file.Close()
+
+	archive, keyID, err := encrypter.Inspect(file)
+	if err != nil {
+		return fmt.Errorf("read archive header: %w", err)
+	}
+
+	if keyID != currentKey {
+		plain := archive
+		if keyID != "" {
+			plain, err = s.keyring.DecryptReader(archive)
+			if err != nil {
+				return fmt.Errorf("decrypt archive: %w", err)
+			}
+		}
+
+		encrypted := s.keyring.EncryptReader(plain)
+		err = producer.SaveFile(tmpName, encrypted)
+		encrypted.Close()
+		if err != nil {
+			producer.Remove(tmpName)
+			return fmt.Errorf("save re-encrypted archive: %w", err)
+		}
+		file.Close()
+
+		if err := replaceFile(producer, tmpName, data.FileName); err != nil {
+			return fmt.Errorf("replace archive file: %w", err)
+		}
+	}
+
+	info, err := producer.Stat(data.FileName)
+	if err != nil {
+		return fmt.Errorf("stat re-encrypted archive: %w", err)
+	}
+	if err := s.storer.UpdateArchiveKey(ctx, data.ID, currentKey, info.Size()); err != nil {
+		return fmt.Errorf("update archive key in the catalog: %w", err)
+	}
+	// the copies are written again from the re-encrypted archive by the replication process
+	if err := s.storer.SetArchiveCopiesStatus(ctx, data.ID, copyStatusPending); err != nil {
+		return fmt.Errorf("update archive copies in the catalog: %w", err)
+	}
+	return nil
+}
+
+// replaceFile moves the file to the path of the existing one.
+// If the server does not allow renaming over an existing file, the old file is moved aside
+// and removed only after the new one has taken its place.
+func replaceFile(producer storage.Producer, from, to string) error {
+	err := producer.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := producer.Stat(to); statErr != nil {
+		return err
+	}
+	old := to + ".old"
+	if err := producer.Rename(to, old); err != nil {
+		return fmt.Errorf("move aside replaced file: %w", err)
+	}
+	if err := producer.Rename(from, to); err != nil {
+		producer.Rename(old, to)
+		return err
+	}
+	return producer.Remove(old)
+}
+
+// recoverReplace completes the replacement interrupted between the renames of replaceFile.
+// If the file is missing, the new file takes its place, otherwise the old file moved aside is put back.
+func recoverReplace(producer storage.Producer, from, to string) error {
+	if _, err := producer.Stat(to); !errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	old := to + ".old"
+	if _, err := producer.Stat(from); err == nil {
+		if err := producer.Rename(from, to); err != nil {
+			return fmt.Errorf("move new file in place: %w", err)
+		}
+		if err := producer.Remove(old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove replaced file: %w", err)
+		}
+		return nil
+	}
+	if _, err := producer.Stat(old); err == nil {
+		if err := producer.Rename(old, to); err != nil {
+			return fmt.Errorf("move back replaced file: %w", err)
+		}
+	}
+	return nil
+}
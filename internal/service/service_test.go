@@ -1,59 +1,868 @@
-package service
-
-import (
-	"errors"
-	"testing"
-
-	"github.com/stretchr/testify/assert"
-)
-
-func TestIsActiveProcess(t *testing.T) {
-	srv := &Service{}
-	srv.processes.Store(1, &process{DataID: 1, Current: PRC_BACKUP})
-
-	testCases := []struct {
-		Name         string
-		Expected     bool
-		CompareValue prc
-	}{
-		{
-			Name:         "compare current BACKUP with matching",
-			Expected:     true,
-			CompareValue: PRC_BACKUP,
-		},
-		{
-			Name:         "comparing current BACKUP with another",
-			CompareValue: PRC_RESTORE,
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.Name, func(t *testing.T) {
-			assert.Equal(t, tc.Expected, srv.isActiveProcess(tc.CompareValue))
-		})
-	}
-}
-
-func TestClearProcesses(t *testing.T) {
-	srv := &Service{}
-	srv.processes.Store(1, &process{DataID: 1, Current: PRC_BACKUP})
-	prc, ok := srv.processes.Load(1)
-	if !ok {
-		assert.Error(t, errors.New("could not load value from processes map"))
-	}
-	p := prc.(*process)
-	assert.Equal(t, PRC_BACKUP, p.Current)
-	srv.clearProcesses()
-	assert.Equal(t, false, srv.isActiveProcess(PRC_BACKUP))
-}
-
-func TestCurrentState(t *testing.T) {
-	srv := &Service{
-		state: STATE_ACTIVE,
-	}
-	srv.processes.Store(0, &process{DataID: 0, Current: PRC_RESTORE})
-	// srv.processes.Store(1, &process{DataID: 1, Current: PRC_BACKUP})
-	// srv.processes.Store(2, &process{DataID: 2, Current: PRC_RESTORE})
-	assert.Equal(t,
-		"Service is active with the following processes:[RESTORE]", srv.currentState())
-}
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/local"
+	memstorage "captura-backup/internal/storage/memory"
+	"captura-backup/internal/store/memory"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/ini.v1"
+)
+
+func TestIsActiveProcess(t *testing.T) {
+	srv := &Service{}
+	srv.processes.Store(1, &process{DataID: 1, Current: PRC_BACKUP})
+
+	testCases := []struct {
+		Name         string
+		Expected     bool
+		CompareValue prc
+	}{
+		{
+			Name:         "compare current BACKUP with matching",
+			Expected:     true,
+			CompareValue: PRC_BACKUP,
+		},
+		{
+			Name:         "comparing current BACKUP with another",
+			CompareValue: PRC_RESTORE,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, srv.isActiveProcess(tc.CompareValue))
+		})
+	}
+}
+
+func TestClearProcesses(t *testing.T) {
+	srv := &Service{}
+	srv.processes.Store(1, &process{DataID: 1, Current: PRC_BACKUP})
+	prc, ok := srv.processes.Load(1)
+	if !ok {
+		assert.Error(t, errors.New("could not load value from processes map"))
+	}
+	p := prc.(*process)
+	assert.Equal(t, PRC_BACKUP, p.Current)
+	srv.clearProcesses()
+	assert.Equal(t, false, srv.isActiveProcess(PRC_BACKUP))
+}
+
+func TestCurrentState(t *testing.T) {
+	srv := &Service{
+		state: STATE_ACTIVE,
+	}
+	srv.processes.Store(0, &process{DataID: 0, Current: PRC_RESTORE})
+	// srv.processes.Store(1, &process{DataID: 1, Current: PRC_BACKUP})
+	// srv.processes.Store(2, &process{DataID: 2, Current: PRC_RESTORE})
+	assert.Equal(t,
+		"Service is active with the following processes:[RESTORE]", srv.currentState())
+}
+
+func TestCountCSVRows(t *testing.T) {
+	data := "id;name;comment\n1;a;NULL\n2;b;\"multi\nline\"\n3;c;\"with ; delimiter\"\n"
+	rows, err := countCSVRows(strings.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), rows)
+
+	rows, err = countCSVRows(strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), rows)
+}
+
+func TestExpiredArchives(t *testing.T) {
+	now := time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC)
+	var archives []datastructs.ArchAvailableData
+	for day := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC); day.Before(now); day = day.AddDate(0, 0, 1) {
+		archives = append(archives, datastructs.ArchAvailableData{TableName: "RouteVKN", ContentDate: day, FileName: day.Format("20060102")})
+	}
+
+	expired := func(st datastructs.ArchiveStorage, minDays int) map[string]bool {
+		names := make(map[string]bool)
+		for _, a := range expiredArchives(archives, st, now, minDays) {
+			names[a.FileName] = true
+		}
+		return names
+	}
+
+	t.Run("daily only", func(t *testing.T) {
+		names := expired(datastructs.ArchiveStorage{KeepArchDays: 30}, 0)
+		assert.False(t, names["20240520"])
+		assert.True(t, names["20240510"])
+		assert.True(t, names["20231231"])
+	})
+
+	t.Run("grandfather-father-son", func(t *testing.T) {
+		names := expired(datastructs.ArchiveStorage{KeepArchDays: 30, KeepMonths: 3, KeepYearly: true}, 0)
+		assert.False(t, names["20240430"], "month-end within 3 months")
+		assert.True(t, names["20240229"], "month-end older than 3 months")
+		assert.False(t, names["20231231"], "year-end")
+		assert.False(t, names["20221231"], "year-end")
+		assert.True(t, names["20230630"])
+	})
+
+	t.Run("keep last and minimum period", func(t *testing.T) {
+		names := expired(datastructs.ArchiveStorage{KeepArchDays: 1, KeepLast: 10}, 0)
+		assert.False(t, names["20240605"])
+		assert.True(t, names["20240604"])
+
+		names = expired(datastructs.ArchiveStorage{KeepArchDays: 1}, 60)
+		assert.False(t, names["20240420"])
+		assert.True(t, names["20240410"])
+	})
+}
+
+func TestRecoverReplace(t *testing.T) {
+	const name = "/archive/sales/20200105/orders.backup.gz"
+	testCases := []struct {
+		Name     string
+		Files    map[string]string
+		Expected string
+	}{
+		{Name: "interrupted after the old file is moved aside", Files: map[string]string{name + ".old": "old", name + ".rekey": "new"}, Expected: "new"},
+		{Name: "new file is missing", Files: map[string]string{name + ".old": "old"}, Expected: "old"},
+		{Name: "not interrupted", Files: map[string]string{name: "old", name + ".rekey": "new"}, Expected: "old"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			producer := memstorage.NewProducer()
+			assert.NoError(t, producer.MakedirAll("/archive/sales/20200105"))
+			for file, content := range tc.Files {
+				assert.NoError(t, producer.SaveFile(file, io.NopCloser(strings.NewReader(content))))
+			}
+
+			assert.NoError(t, recoverReplace(producer, name+".rekey", name))
+			file, err := producer.ReadFile(name)
+			if assert.NoError(t, err) {
+				content, _ := io.ReadAll(file)
+				file.Close()
+				assert.Equal(t, tc.Expected, string(content))
+			}
+			_, err = producer.Stat(name + ".old")
+			assert.ErrorIs(t, err, fs.ErrNotExist, "the old file is not left")
+		})
+	}
+}
+
+func TestHeldBy(t *testing.T) {
+	day := func(d string) time.Time {
+		t, _ := time.Parse("2006-01-02", d)
+		return t
+	}
+	holds := []datastructs.LegalHold{
+		{ID: 1, DataID: 2, DateFrom: day("2023-01-01"), DateTo: day("2023-03-31")},
+		{ID: 2, SchemaName: "billdb_inv"},
+		{ID: 3, AvailableDataID: 42},
+	}
+
+	testCases := []struct {
+		Name     string
+		Archive  datastructs.ArchAvailableData
+		Expected int
+	}{
+		{Name: "data type in the date range", Archive: datastructs.ArchAvailableData{DataID: 2, ContentDate: day("2023-03-31")}, Expected: 1},
+		{Name: "data type out of the date range", Archive: datastructs.ArchAvailableData{DataID: 2, ContentDate: day("2023-04-01")}},
+		{Name: "schema", Archive: datastructs.ArchAvailableData{ID: 7, SchemaName: "billdb_inv", ContentDate: day("2020-01-01")}, Expected: 2},
+		{Name: "archive", Archive: datastructs.ArchAvailableData{ID: 42, SchemaName: "sales"}, Expected: 3},
+		{Name: "source data is not covered by the archive hold", Archive: datastructs.ArchAvailableData{SchemaName: "sales"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var got int
+			if hold := heldBy(holds, tc.Archive); hold != nil {
+				got = hold.ID
+			}
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestLoadDestinations(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[storage]
+path = /archive
+
+[storage.offsite]
+path       = /offsite
+use_remote = sftp
+host       = backup.example.com
+data_ids   = 2, 6
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Service{ini: cfg}
+	assert.NoError(t, srv.loadDestinations(context.Background()))
+
+	assert.Equal(t, defaultDestination, srv.destinationFor(1).name)
+	assert.Equal(t, "/archive", srv.destinationFor(1).path)
+	offsite := srv.destinationFor(6)
+	assert.Equal(t, "offsite", offsite.name)
+	assert.Equal(t, "sftp", offsite.protocol)
+	assert.Equal(t, "backup.example.com", offsite.remote.Host)
+
+	d, err := srv.destination("")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultDestination, d.name)
+	_, err = srv.destination("unknown")
+	assert.Error(t, err)
+}
+
+func TestStorageSettingsDestinations(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[storage]
+path = /archive
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storer := memory.New()
+	storer.AddStorageDestination(datastructs.StorageDestination{DataID: 2, Name: "nas", Protocol: "local", Path: "/nas", StoragePeriod: 30})
+	storer.AddStorageDestination(datastructs.StorageDestination{DataID: 3, Name: "nas", Protocol: "local", Path: "/nas", StoragePeriod: 30})
+	srv := &Service{ini: cfg, storer: storer}
+	assert.NoError(t, srv.loadDestinations(context.Background()))
+	assert.Equal(t, "nas", srv.destinationFor(3).name)
+	assert.Equal(t, 30, srv.destinationFor(3).storagePeriod)
+
+	storer.AddStorageDestination(datastructs.StorageDestination{DataID: 4, Name: "nas", Protocol: "local", Path: "/other"})
+	assert.Error(t, srv.loadDestinations(context.Background()))
+}
+
+func TestTransferLimits(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[storage]
+path               = /archive
+total_upload_limit = 4096, 08:00-19:00 1024
+
+[storage.offsite]
+path           = /offsite
+download_limit = 2048
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Service{ini: cfg}
+	assert.NoError(t, srv.loadDestinations(context.Background()))
+	assert.NotNil(t, srv.destinations.upload)
+	assert.Nil(t, srv.destinations.download)
+	offsite, _ := srv.destination("offsite")
+	assert.NotNil(t, offsite.download)
+	assert.Nil(t, offsite.upload)
+
+	cfg.Section("storage.offsite").Key("upload_limit").SetValue("fast")
+	assert.Error(t, srv.loadDestinations(context.Background()))
+}
+
+func TestReplicas(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[storage]
+path        = /archive
+replicas    = mirror
+replication = async
+
+[storage.mirror]
+path = /mirror
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Service{ini: cfg}
+	assert.NoError(t, srv.loadDestinations(context.Background()))
+
+	primary := srv.destinationFor(1)
+	assert.Equal(t, []string{"mirror"}, primary.replicas)
+	assert.Equal(t, replicateAsync, primary.replication)
+	assert.False(t, srv.replicaOnly(primary))
+
+	mirror, err := srv.destination("mirror")
+	assert.NoError(t, err)
+	assert.True(t, srv.replicaOnly(mirror))
+
+	path, err := relocatePath(primary, mirror, "/archive/public/20240131/orders.backup.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "/mirror/public/20240131/orders.backup.gz", path)
+	_, err = relocatePath(primary, mirror, "/other/public/20240131/orders.backup.gz")
+	assert.Error(t, err)
+
+	cfg.Section("storage").Key("replicas").SetValue("unknown")
+	assert.Error(t, srv.loadDestinations(context.Background()))
+}
+
+func TestColdStorage(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[storage]
+path            = /archive
+cold_storage    = cold
+cold_after_days = 90
+
+[storage.cold]
+path       = /cold
+use_remote = ftp
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Service{ini: cfg}
+	assert.NoError(t, srv.loadDestinations(context.Background()))
+	assert.True(t, srv.tieringEnabled())
+
+	hot := srv.destinationFor(1)
+	assert.Equal(t, "cold", hot.cold)
+	assert.Equal(t, 90, hot.coldAfter)
+	cold, err := srv.destination("cold")
+	assert.NoError(t, err)
+	assert.Equal(t, "", cold.cold, "the cold storage is not inherited from [storage]")
+
+	cfg.Section("storage").Key("cold_after_days").SetValue("0")
+	assert.Error(t, srv.loadDestinations(context.Background()))
+}
+
+func TestQuota(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[storage]
+path  = /archive
+quota = 2
+
+[storage.offsite]
+path = /offsite
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Service{ini: cfg}
+	assert.NoError(t, srv.loadDestinations(context.Background()))
+	assert.Equal(t, int64(2)<<30, srv.destinationFor(1).quota)
+	offsite, err := srv.destination("offsite")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offsite.quota, "the quota is not inherited from [storage]")
+}
+
+func TestCheckArchiveFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.backup.gz")
+	if err := os.WriteFile(path, []byte("archive data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, size, _ := manifest.ReadChecksum(strings.NewReader("archive data"))
+
+	srv := &Service{}
+	producer := local.NewProducer()
+	assert.NoError(t, srv.checkArchiveFile(producer, path, datastructs.ArchAvailableData{Checksum: sum}))
+	assert.Error(t, srv.checkArchiveFile(producer, path, datastructs.ArchAvailableData{Checksum: "0000"}))
+	assert.NoError(t, srv.checkArchiveFile(producer, path, datastructs.ArchAvailableData{FileSize: size}))
+	assert.Error(t, srv.checkArchiveFile(producer, path, datastructs.ArchAvailableData{FileSize: size + 1}))
+}
+
+func TestArchiveSourceRewind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.gz")
+	if err := os.WriteFile(path, []byte("archive data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, _, _ := manifest.ReadChecksum(strings.NewReader("archive data"))
+
+	srv := &Service{}
+	archive, err := srv.openArchiveSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	// the failed upload has read the part of the archive
+	archive.Read(make([]byte, 7))
+	assert.NoError(t, archive.Rewind())
+	data, err := io.ReadAll(archive)
+	assert.NoError(t, err)
+	assert.Equal(t, "archive data", string(data))
+	assert.Equal(t, sum, archive.checksum.Sum(), "the checksum is counted again")
+}
+
+// newTestService creates the service with the in-memory storer and storage, the table sales.orders
+// of the data type 1 has the rows of two old days and of today.
+func newTestService(t *testing.T) (*Service, *memory.Store, *memstorage.Producer) {
+	cfg, err := ini.Load([]byte(`
+[service]
+tmp_folder    = ` + t.TempDir() + `
+limit_workers = 2
+
+[logger]
+level = error
+
+[storage]
+path          = /archive
+auto_cleaning = true
+keep_period   = 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storer := memory.New()
+	storer.AddDataType(memory.DataType{
+		ID:           1,
+		Schema:       "sales",
+		TablePattern: "^orders$",
+		Entity:       "record",
+		DateColumn:   `"day"`,
+		RmInterval:   "1 DAY",
+		DoBackup:     true,
+		KeepArchDays: 30,
+	})
+	storer.CreateTable("sales.orders", "id", "day", "amount")
+	today := time.Now().Format("2006-01-02")
+	if err := storer.Insert("sales.orders",
+		[]string{"1", "2020-01-01", "10"},
+		[]string{"2", "2020-01-01", "NULL"},
+		[]string{"3", "2020-01-02", "30"},
+		[]string{"4", today, "40"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	producer := memstorage.NewProducer()
+
+	srv, err := NewFromConfig(cfg, WithStorer(storer), WithProducer("local", func() (storage.Producer, error) {
+		return producer, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.loadDestinations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.checkStorageFolder(); err != nil {
+		t.Fatal(err)
+	}
+	return srv, storer, producer
+}
+
+func runProcess(run func(wg *sync.WaitGroup)) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	run(&wg)
+	wg.Wait()
+}
+
+func TestBackupRestoreClean(t *testing.T) {
+	ctx := context.Background()
+	srv, storer, producer := newTestService(t)
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.backupProcess(ctx, &process{DataID: 1, Current: PRC_BACKUP}, wg)
+	})
+	assert.Equal(t, []string{
+		"/archive/sales/20200101/orders.backup.gz",
+		"/archive/sales/20200102/orders.backup.gz",
+	}, producer.Files())
+	orders, _ := storer.Table("sales.orders")
+	assert.Len(t, orders.Rows, 1, "the archived days are deleted from the table")
+	archives, _ := storer.CatalogArchives(ctx)
+	if assert.Len(t, archives, 2) {
+		assert.Equal(t, int64(2), archives[0].ContentRows)
+		assert.Equal(t, "/archive/sales/20200101/orders.backup.gz", archives[0].FileName)
+		assert.NotEmpty(t, archives[0].Checksum)
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.restoreProcess(ctx, &process{DataID: 1, Current: PRC_RESTORE, RestoreToDate: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, wg)
+	})
+	orders, _ = storer.Table("sales.orders")
+	assert.Len(t, orders.Rows, 3, "the rows of the first day are restored")
+	assert.Contains(t, orders.Rows, []string{"2", "2020-01-01", "NULL"})
+	archives, _ = storer.CatalogArchives(ctx)
+	assert.False(t, archives[0].RestoredAt.IsZero())
+	assert.True(t, archives[1].RestoredAt.IsZero())
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.cleaningStorageProcess(ctx, wg)
+	})
+	assert.Empty(t, producer.Files(), "the archives older than keep_arch_days are removed")
+	archives, _ = storer.AvailableArchives(ctx, 1, time.Time{}, time.Now())
+	assert.Empty(t, archives)
+}
+
+func TestBackupSkippedWithoutSpace(t *testing.T) {
+	ctx := context.Background()
+	srv, storer, producer := newTestService(t)
+	producer.SetFreeSpace(1)
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.backupProcess(ctx, &process{DataID: 1, Current: PRC_BACKUP}, wg)
+	})
+	assert.Empty(t, producer.Files())
+	orders, _ := storer.Table("sales.orders")
+	assert.Len(t, orders.Rows, 4, "the data is kept in the database")
+}
+
+func TestBackupRestoreDatabase(t *testing.T) {
+	ctx := context.Background()
+	srv, storer, producer := newTestService(t)
+	cold := memory.New()
+	srv.archiveDB = cold
+
+	section, _ := srv.ini.NewSection("storage.cold")
+	section.NewKey("use_remote", "postgres")
+	section.NewKey("data_ids", "1")
+	assert.Error(t, srv.loadDestinations(ctx), "the database is not specified")
+	section.NewKey("database", "captdb_cold")
+	if err := srv.loadDestinations(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.backupProcess(ctx, &process{DataID: 1, Current: PRC_BACKUP}, wg)
+	})
+	assert.Empty(t, producer.Files(), "the archives are not written to the files")
+	orders, _ := storer.Table("sales.orders")
+	assert.Len(t, orders.Rows, 1, "the archived days are deleted from the table")
+	archived, ok := cold.Table("sales.orders")
+	if assert.True(t, ok, "the table is created in the archive database") {
+		assert.Equal(t, []string{"id", "day", "amount"}, archived.Columns)
+		assert.Len(t, archived.Rows, 3)
+	}
+	archives, _ := storer.CatalogArchives(ctx)
+	if assert.Len(t, archives, 2) {
+		assert.Equal(t, "cold", archives[0].Storage)
+		assert.Equal(t, "sales.orders", archives[0].FileName)
+		assert.Equal(t, int64(2), archives[0].ContentRows)
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.restoreProcess(ctx, &process{DataID: 1, Current: PRC_RESTORE, RestoreToDate: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, wg)
+	})
+	orders, _ = storer.Table("sales.orders")
+	assert.Len(t, orders.Rows, 3, "the rows of the first day are restored")
+	assert.Contains(t, orders.Rows, []string{"2", "2020-01-01", "NULL"})
+	archived, _ = cold.Table("sales.orders")
+	assert.Len(t, archived.Rows, 3, "the rows are kept in the archive database")
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.cleaningStorageProcess(ctx, wg)
+	})
+	archived, ok = cold.Table("sales.orders")
+	if assert.True(t, ok, "the table left without rows is kept for the concurrent backup") {
+		assert.Empty(t, archived.Rows, "the rows older than keep_arch_days are deleted")
+	}
+	archives, _ = storer.AvailableArchives(ctx, 1, time.Time{}, time.Now())
+	assert.Empty(t, archives)
+}
+
+func TestRestoreTableByDefinition(t *testing.T) {
+	ctx := context.Background()
+	srv, storer, producer := newTestService(t)
+	storer.AddDataType(memory.DataType{
+		ID:           2,
+		Schema:       "sales",
+		TablePattern: `^log_\d{6}$`,
+		Entity:       "table",
+		DateColumn:   "day",
+		RmInterval:   "1 DAY",
+		DoBackup:     true,
+	})
+	storer.CreateTable("sales.log_202001", "id", "day")
+	if err := storer.Insert("sales.log_202001", []string{"1", "2020-01-05"}, []string{"2", "2020-01-06"}); err != nil {
+		t.Fatal(err)
+	}
+	const ddl = "CREATE TABLE sales.log_202001 (id text, day text);"
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.backupProcess(ctx, &process{DataID: 2, Current: PRC_BACKUP}, wg)
+	})
+	_, ok := storer.Table("sales.log_202001")
+	assert.False(t, ok, "the archived table is dropped")
+	archives, _ := storer.CatalogArchives(ctx)
+	if assert.Len(t, archives, 2) {
+		assert.Equal(t, ddl, archives[0].TableDDL)
+	}
+	file, err := producer.ReadFile("/archive/sales/20200105/log_202001.backup.gz")
+	if assert.NoError(t, err) {
+		gzReader, err := gzip.NewReader(file)
+		if assert.NoError(t, err) {
+			assert.Equal(t, ddl, manifest.DDLFromGzipExtra(gzReader.Extra), "the definition is kept in the archive")
+		}
+		file.Close()
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.restoreProcess(ctx, &process{DataID: 2, Current: PRC_RESTORE, RestoreToDate: time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)}, wg)
+	})
+	table, ok := storer.Table("sales.log_202001")
+	if assert.True(t, ok, "the table is created without the template") {
+		assert.Equal(t, []string{"id", "day"}, table.Columns)
+		assert.Equal(t, [][]string{{"1", "2020-01-05"}}, table.Rows)
+	}
+}
+
+func TestRebuildCatalogWithoutDataTypes(t *testing.T) {
+	ctx := context.Background()
+	srv, storer, _ := newTestService(t)
+	storer.AddDataType(memory.DataType{
+		ID:           2,
+		Schema:       "sales",
+		TablePattern: `^log_\d{6}$`,
+		Entity:       "table",
+		DateColumn:   "day",
+		RmInterval:   "1 DAY",
+		DoBackup:     true,
+	})
+	storer.CreateTable("sales.log_202001", "id", "day")
+	if err := storer.Insert("sales.log_202001", []string{"1", "2020-01-05"}); err != nil {
+		t.Fatal(err)
+	}
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.backupProcess(ctx, &process{DataID: 2, Current: PRC_BACKUP}, wg)
+	})
+	backedUp, _ := storer.CatalogArchives(ctx)
+	if !assert.Len(t, backedUp, 1) {
+		return
+	}
+
+	// the schema of the catalog is lost with the config of the data types
+	lost := memory.New()
+	srv.storer = lost
+	if !assert.NoError(t, srv.RebuildCatalog()) {
+		return
+	}
+	archives, _ := lost.CatalogArchives(ctx)
+	if assert.Len(t, archives, 1) {
+		assert.Equal(t, 0, archives[0].DataID)
+		assert.Equal(t, "log_202001", archives[0].TableName)
+		assert.True(t, archives[0].SingleTable, "the archive with the table definition is the single table")
+		assert.Equal(t, backedUp[0].Checksum, archives[0].Checksum, "the checksum is counted on the whole file")
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.restoreProcess(ctx, &process{DataID: 0, Current: PRC_RESTORE, RestoreToDate: time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)}, wg)
+	})
+	table, ok := lost.Table("sales.log_202001")
+	if assert.True(t, ok, "the archive of the unknown data type is restored with all data types") {
+		assert.Equal(t, [][]string{{"1", "2020-01-05"}}, table.Rows)
+	}
+}
+
+func TestRebuildCatalogSkipsCopies(t *testing.T) {
+	ctx := context.Background()
+	srv, storer, producer := newTestService(t)
+	if err := producer.MakedirAll("/mirror"); err != nil {
+		t.Fatal(err)
+	}
+	srv.ini.Section("storage").Key("replicas").SetValue("mirror")
+	mirror := srv.ini.Section("storage.mirror")
+	if _, err := mirror.NewKey("path", "/mirror"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mirror.NewKey("data_ids", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.loadDestinations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	storer.AddDataType(memory.DataType{
+		ID:           2,
+		Schema:       "sales",
+		TablePattern: `^log_\d{6}$`,
+		Entity:       "table",
+		DateColumn:   "day",
+		RmInterval:   "1 DAY",
+		DoBackup:     true,
+	})
+	storer.CreateTable("sales.log_202001", "id", "day")
+	if err := storer.Insert("sales.log_202001", []string{"1", "2020-01-05"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1, 2} {
+		runProcess(func(wg *sync.WaitGroup) {
+			srv.backupProcess(ctx, &process{DataID: id, Current: PRC_BACKUP}, wg)
+		})
+	}
+
+	rebuilt := memory.New()
+	srv.storer = rebuilt
+	if !assert.NoError(t, srv.RebuildCatalog()) {
+		return
+	}
+	archives, _ := rebuilt.CatalogArchives(ctx)
+	for _, archive := range archives {
+		if archive.Storage == "mirror" {
+			assert.Equal(t, "log_202001", archive.TableName, "the copy in the mirror is not added as the primary archive")
+			continue
+		}
+		copies, _ := rebuilt.ArchiveCopies(ctx, archive.ID)
+		if assert.Len(t, copies, 1) {
+			assert.Equal(t, "mirror", copies[0].Storage)
+		}
+	}
+	assert.Len(t, archives, 3)
+}
+
+func TestBackupRestoreMovedTable(t *testing.T) {
+	ctx := context.Background()
+	srv, storer, producer := newTestService(t)
+	storer.AddDataType(memory.DataType{
+		ID:                2,
+		Schema:            "sales",
+		TablePattern:      `^log_\d{6}$`,
+		Entity:            "table",
+		DateColumn:        "day",
+		RmInterval:        "1 DAY",
+		DoBackup:          true,
+		Action:            "move",
+		ArchiveSchema:     "archive",
+		ArchiveTablespace: "cold",
+	})
+	storer.CreateTable("sales.log_202001", "id", "day")
+	if err := storer.Insert("sales.log_202001", []string{"1", "2020-01-06"}, []string{"2", "2020-01-05"}, []string{"3", "2020-01-06"}); err != nil {
+		t.Fatal(err)
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.backupProcess(ctx, &process{DataID: 2, Current: PRC_BACKUP}, wg)
+	})
+	assert.Empty(t, producer.Files(), "the moved table is not exported")
+	_, ok := storer.Table("sales.log_202001")
+	assert.False(t, ok, "the table is moved out of its schema")
+	moved, ok := storer.Table("archive.log_202001")
+	if assert.True(t, ok, "the table is moved to the archive schema") {
+		assert.Equal(t, "cold", moved.Tablespace)
+		assert.Len(t, moved.Rows, 3)
+	}
+	archives, _ := storer.CatalogArchives(ctx)
+	if assert.Len(t, archives, 1) {
+		assert.Equal(t, "move", archives[0].Action)
+		assert.Equal(t, "archive.log_202001", archives[0].FileName)
+		assert.Equal(t, "pg_default", archives[0].SourceTablespace)
+		assert.Equal(t, time.Date(2020, 1, 6, 0, 0, 0, 0, time.UTC), archives[0].ContentDate.UTC())
+		assert.Equal(t, int64(3), archives[0].ContentRows)
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.restoreProcess(ctx, &process{DataID: 2, Current: PRC_RESTORE, RestoreToDate: time.Date(2020, 1, 6, 0, 0, 0, 0, time.UTC)}, wg)
+	})
+	_, ok = storer.Table("archive.log_202001")
+	assert.False(t, ok)
+	restored, ok := storer.Table("sales.log_202001")
+	if assert.True(t, ok, "the table is moved back") {
+		assert.Empty(t, restored.Tablespace, "the table is moved back to the default tablespace")
+		assert.Len(t, restored.Rows, 3)
+	}
+
+	// the expired archive of the restored table does not drop the live table
+	if len(archives) == 1 {
+		assert.NoError(t, srv.removeArchive(ctx, nil, archives[0], "day"))
+		_, ok = storer.Table("sales.log_202001")
+		assert.True(t, ok, "the restored table is kept")
+		archives, _ = storer.CatalogArchives(ctx)
+		if assert.Len(t, archives, 1) {
+			assert.False(t, archives[0].DeletedAt.IsZero(), "the archive is marked deleted")
+		}
+	}
+}
+
+func TestBackupHeldEmptyPartition(t *testing.T) {
+	ctx := context.Background()
+	srv, storer, _ := newTestService(t)
+	storer.AddDataType(memory.DataType{
+		ID:           2,
+		Schema:       "sales",
+		TablePattern: "^events$",
+		Entity:       "partition",
+		DateColumn:   "day",
+		RmInterval:   "1 DAY",
+		DoBackup:     true,
+	})
+	storer.AddLegalHold(datastructs.LegalHold{
+		ID:       1,
+		DataID:   2,
+		DateFrom: time.Date(2019, 12, 15, 0, 0, 0, 0, time.UTC),
+		DateTo:   time.Date(2019, 12, 20, 0, 0, 0, 0, time.UTC),
+	})
+	storer.CreateTable("sales.events", "id", "day")
+	for name, bound := range map[string]string{
+		"sales.events_201911": "FOR VALUES FROM ('2019-11-01') TO ('2019-12-01')",
+		"sales.events_201912": "FOR VALUES FROM ('2019-12-01') TO ('2020-01-01')",
+	} {
+		if err := storer.CreatePartition(name, "sales.events", bound); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.backupProcess(ctx, &process{DataID: 2, Current: PRC_BACKUP}, wg)
+	})
+	_, ok := storer.Table("sales.events_201911")
+	assert.False(t, ok, "the empty partition out of the hold is dropped")
+	_, ok = storer.Table("sales.events_201912")
+	assert.True(t, ok, "the empty partition under the hold is kept")
+}
+
+func TestBackupRestorePartition(t *testing.T) {
+	ctx := context.Background()
+	srv, storer, producer := newTestService(t)
+	storer.AddDataType(memory.DataType{
+		ID:           2,
+		Schema:       "sales",
+		TablePattern: "^events$",
+		Entity:       "partition",
+		DateColumn:   "day",
+		RmInterval:   "1 DAY",
+		DoBackup:     true,
+	})
+	const bound = "FOR VALUES FROM ('2020-01-01') TO ('2020-02-01')"
+	storer.CreateTable("sales.events", "id", "day")
+	for name, bound := range map[string]string{
+		"sales.events_201912":  "FOR VALUES FROM ('2019-12-01') TO ('2020-01-01')",
+		"sales.events_202001":  bound,
+		"sales.events_current": "FOR VALUES FROM ('2020-02-01') TO ('2999-01-01')",
+	} {
+		if err := storer.CreatePartition(name, "sales.events", bound); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storer.Insert("sales.events_202001", []string{"1", "2020-01-05"}, []string{"2", "2020-01-05"}, []string{"3", "2020-01-06"}); err != nil {
+		t.Fatal(err)
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.backupProcess(ctx, &process{DataID: 2, Current: PRC_BACKUP}, wg)
+	})
+	assert.Equal(t, []string{
+		"/archive/sales/20200105/events_202001.backup.gz",
+		"/archive/sales/20200106/events_202001.backup.gz",
+	}, producer.Files())
+	_, ok := storer.Table("sales.events_202001")
+	assert.False(t, ok, "the expired partition is dropped")
+	_, ok = storer.Table("sales.events_201912")
+	assert.False(t, ok, "the empty expired partition is dropped without an archive")
+	_, ok = storer.Table("sales.events_current")
+	assert.True(t, ok, "the partition with the current dates is kept")
+	archives, _ := storer.CatalogArchives(ctx)
+	if assert.Len(t, archives, 2) {
+		assert.Equal(t, "sales.events", archives[0].Parent)
+		assert.Equal(t, bound, archives[0].PartitionBound)
+		assert.True(t, archives[0].SingleTable)
+	}
+
+	runProcess(func(wg *sync.WaitGroup) {
+		srv.restoreProcess(ctx, &process{DataID: 2, Current: PRC_RESTORE, RestoreToDate: time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)}, wg)
+	})
+	partition, ok := storer.Table("sales.events_202001")
+	if assert.True(t, ok, "the partition is created again") {
+		assert.Equal(t, "sales.events", partition.Parent)
+		assert.Equal(t, bound, partition.Bound, "the partition is attached with the original bound")
+		assert.Equal(t, []string{"id", "day"}, partition.Columns)
+		assert.Len(t, partition.Rows, 2)
+	}
+}
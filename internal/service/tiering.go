@@ -0,0 +1,184 @@
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Tiering moves the aged archives to the cold storages once.
+func (s *Service) Tiering() error {
+	ctx := context.Background()
+
+	if err := s.loadKeyring(); err != nil {
+		return fmt.Errorf("load encryption keys: %w", err)
+	}
+
+	closeStore, err := s.connectStore(ctx)
+	if err != nil {
+		return fmt.Errorf("database connect: %w", err)
+	}
+	defer closeStore()
+
+	producers := s.newProducerSet(ctx)
+	defer producers.Close()
+
+	moved, errs := s.tierArchives(ctx, producers)
+	s.log.Infof("Tiering: moved %d archives to the cold storages", len(moved))
+	if len(errs) != 0 {
+		return fmt.Errorf("%d archives could not be moved", len(errs))
+	}
+	return nil
+}
+
+// tierStorage moves the aged archives to the cold storages and notifies about the moved archives and errors.
+func (s *Service) tierStorage(ctx context.Context, producers *producerSet) {
+	moved, errs := s.tierArchives(ctx, producers)
+	if len(moved) == 0 && len(errs) == 0 {
+		return
+	}
+	text := fmt.Sprintf("Storage tiering finished: moved %d archives to the cold storages", len(moved))
+	tmpl := "info"
+	if len(errs) != 0 {
+		tmpl = "error"
+	}
+	if err := s.sendMessage(s.makeDataToSend(tmpl, text, errs...)); err != nil {
+		s.log.Errorln("Tiering worker: send notification:", err)
+	}
+}
+
+// tieringEnabled reports whether any destination has the cold storage.
+func (s *Service) tieringEnabled() bool {
+	for _, d := range s.allDestinations() {
+		if d.cold != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// tierArchives moves the archives older than cold_after_days of their destination to its cold storage
+// and returns the moved archives.
+func (s *Service) tierArchives(ctx context.Context, producers *producerSet) ([]datastructs.ArchAvailableData, []string) {
+	var (
+		moved []datastructs.ArchAvailableData
+		errs  []string
+	)
+	for _, hot := range s.allDestinations() {
+		if hot.cold == "" {
+			continue
+		}
+		archives, err := s.storer.AvailableArchives(ctx, 0, time.Time{}, time.Now().AddDate(0, 0, -hot.coldAfter))
+		if err != nil {
+			s.log.Errorf("Tiering worker: [Storage:%s] get archives: %s", hot.name, err)
+			errs = append(errs, fmt.Sprintf("storage [%s]: %s", hot.name, err))
+			continue
+		}
+		for _, archive := range s.fileArchives(archives) {
+			select {
+			case <-ctx.Done():
+				return moved, errs
+			default:
+			}
+
+			if archive.Storage != hot.name && (archive.Storage != "" || hot.name != defaultDestination) {
+				continue
+			}
+			if err := s.tierArchive(ctx, producers, hot, archive); err != nil {
+				s.log.Errorf("Tiering worker: [ID:%d File:%s] move to the cold storage [%s]: %s", archive.ID, archive.FileName, hot.cold, err)
+				errs = append(errs, fmt.Sprintf("%s: %s", archive.FileName, err))
+				continue
+			}
+			s.log.Infof("Tiering worker: [ID:%d File:%s] moved to the cold storage [%s]", archive.ID, archive.FileName, hot.cold)
+			moved = append(moved, archive)
+		}
+	}
+	return moved, errs
+}
+
+// tierArchive copies the archive with its manifest to the cold storage, verifies the copy, points the catalog
+// to it and removes the hot files. If the hot files could not be removed, they are left to the reconciliation.
+func (s *Service) tierArchive(ctx context.Context, producers *producerSet, hot *destination, archive datastructs.ArchAvailableData) error {
+	source, _, err := producers.get(hot.name)
+	if err != nil {
+		return err
+	}
+	target, cold, err := producers.get(hot.cold)
+	if err != nil {
+		return err
+	}
+	fileName, err := relocatePath(hot, cold, archive.FileName)
+	if err != nil {
+		return err
+	}
+
+	if err := target.MakedirAll(filepath.Dir(fileName)); err != nil {
+		return fmt.Errorf("create storage folder: %w", err)
+	}
+	if err := copyFile(source, target, archive.FileName, fileName); err != nil {
+		return err
+	}
+	if err := s.checkArchiveFile(target, fileName, archive); err != nil {
+		target.Remove(fileName)
+		return fmt.Errorf("verify cold copy: %w", err)
+	}
+	if _, err := source.Stat(archive.FileName + manifest.FileExt); err == nil {
+		if err := copyFile(source, target, archive.FileName+manifest.FileExt, fileName+manifest.FileExt); err != nil {
+			target.Remove(fileName)
+			return fmt.Errorf("copy manifest: %w", err)
+		}
+	}
+
+	if err := s.storer.MoveArchive(ctx, archive.ID, cold.name, fileName); err != nil {
+		return fmt.Errorf("update catalog: %w", err)
+	}
+
+	for _, path := range []string{archive.FileName, archive.FileName + manifest.FileExt} {
+		if _, err := source.Stat(path); err != nil {
+			continue
+		}
+		if err := source.Remove(path); err != nil {
+			s.log.Warnf("Tiering worker: [ID:%d File:%s] remove hot file: %s", archive.ID, path, err)
+		}
+	}
+	return nil
+}
+
+// checkArchiveFile compares the checksum of the archive file with the catalog,
+// the archives without the checksum are compared by the file size.
+func (s *Service) checkArchiveFile(producer storage.Producer, path string, archive datastructs.ArchAvailableData) error {
+	if archive.Checksum == "" {
+		info, err := producer.Stat(path)
+		if err != nil {
+			return fmt.Errorf("stat archive file: %w", err)
+		}
+		if archive.FileSize != 0 && info.Size() != archive.FileSize {
+			return fmt.Errorf("file size %d does not match the catalog size %d", info.Size(), archive.FileSize)
+		}
+		return nil
+	}
+
+	file, err := producer.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read archive file: %w", err)
+	}
+	defer file.Close()
+
+	plain, err := s.archiveReader(file)
+	if err != nil {
+		return fmt.Errorf("decrypt archive file: %w", err)
+	}
+	sum, _, err := manifest.ReadChecksum(plain)
+	if err != nil {
+		return fmt.Errorf("read archive file: %w", err)
+	}
+	if sum != archive.Checksum {
+		return errors.New("archive file does not match the catalog checksum")
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// trashFolder returns the folder of removed archives under the root of the destination or "" if the trash is disabled.
+// The removed archive is kept as <trash>/<YYYYMMDD of removal>/<archive ID>/<file name> with its manifest.
+func (s *Service) trashFolder(d *destination) string {
+	if s.ini.Section("storage").Key("trash_days").MustInt(0) <= 0 {
+		return ""
+	}
+	return filepath.Join(d.path, s.ini.Section("storage").Key("trash_folder").MustString(".trash"))
+}
+
+// moveToTrash moves the archive file and its manifest to the trash, the file already missing is skipped.
+func (s *Service) moveToTrash(producer storage.Producer, trash string, archive datastructs.ArchAvailableData) error {
+	folder := filepath.Join(trash, time.Now().Format("20060102"), strconv.Itoa(archive.ID))
+	for _, path := range []string{archive.FileName, archive.FileName + manifest.FileExt} {
+		if _, err := producer.Stat(path); err != nil {
+			continue
+		}
+		if err := producer.MakedirAll(folder); err != nil {
+			return fmt.Errorf("create trash folder: %w", err)
+		}
+		if err := producer.Rename(path, filepath.Join(folder, filepath.Base(path))); err != nil {
+			return fmt.Errorf("move file to trash: %w", err)
+		}
+	}
+	return nil
+}
+
+// purgeTrash removes the folders of the trash of all destinations removed earlier than the grace period of trash_days.
+// The archives under an active legal hold are kept in the trash until the hold is released.
+func (s *Service) purgeTrash(ctx context.Context, producers *producerSet) []string {
+	if s.ini.Section("storage").Key("trash_days").MustInt(0) <= 0 {
+		return nil
+	}
+	held, err := s.heldDeletedArchives(ctx)
+	if err != nil {
+		s.log.Errorln("Cleaning worker: purge trash:", err)
+		return []string{fmt.Sprintf("purge trash: %s", err)}
+	}
+
+	var errs []string
+	for _, d := range s.allDestinations() {
+		if d.database() {
+			continue
+		}
+		producer, _, err := producers.get(d.name)
+		if err == nil {
+			err = s.purgeTrashFolder(producer, s.trashFolder(d), held)
+		}
+		if err != nil {
+			s.log.Errorf("Cleaning worker: [Storage:%s] %s", d.name, err)
+			errs = append(errs, fmt.Sprintf("storage [%s]: %s", d.name, err))
+		}
+	}
+	return errs
+}
+
+// heldDeletedArchives returns the IDs of the deleted archives under an active legal hold mapped to the hold ID.
+func (s *Service) heldDeletedArchives(ctx context.Context) (map[string]int, error) {
+	holds, err := s.storer.ActiveLegalHolds(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting legal holds: %w", err)
+	}
+	held := make(map[string]int)
+	if len(holds) == 0 {
+		return held, nil
+	}
+	archives, err := s.storer.DeletedArchives(ctx, 0, time.Time{}, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("getting deleted archives: %w", err)
+	}
+	for _, archive := range archives {
+		if hold := heldBy(holds, archive); hold != nil {
+			held[strconv.Itoa(archive.ID)] = hold.ID
+		}
+	}
+	return held, nil
+}
+
+func (s *Service) purgeTrashFolder(producer storage.Producer, trash string, held map[string]int) error {
+	days, err := producer.ReadDir(trash)
+	if err != nil {
+		if _, statErr := producer.Stat(trash); statErr != nil {
+			return nil
+		}
+		return fmt.Errorf("read trash folder: %w", err)
+	}
+	expired := time.Now().AddDate(0, 0, -s.ini.Section("storage").Key("trash_days").MustInt(0))
+	for _, day := range days {
+		removed, err := time.ParseInLocation("20060102", day.Name(), time.Local)
+		if err != nil || !day.IsDir() {
+			s.log.Warnf("Cleaning worker: skip %s: not a folder of the trash day", filepath.Join(trash, day.Name()))
+			continue
+		}
+		if removed.After(expired) {
+			continue
+		}
+		folder := filepath.Join(trash, day.Name())
+		archives, err := producer.ReadDir(folder)
+		if err != nil {
+			return fmt.Errorf("read trash folder %s: %w", day.Name(), err)
+		}
+		var kept int
+		for _, archive := range archives {
+			if hold, ok := held[archive.Name()]; ok {
+				s.log.Debugf("Cleaning worker: [ID:%s] kept in the trash by the legal hold %d", archive.Name(), hold)
+				kept++
+				continue
+			}
+			if err := producer.RemoveAll(filepath.Join(folder, archive.Name())); err != nil {
+				return fmt.Errorf("purge trash folder %s: %w", day.Name(), err)
+			}
+		}
+		if kept != 0 {
+			continue
+		}
+		if err := producer.RemoveAll(folder); err != nil {
+			return fmt.Errorf("purge trash folder %s: %w", day.Name(), err)
+		}
+		s.log.Infof("Cleaning worker: purged trash folder %s", day.Name())
+	}
+	return nil
+}
+
+// RestoreFromTrash moves the removed archives with the content date in the range back into place
+// and marks them as available in the catalog. dataID = 0 means all data types.
+func (s *Service) RestoreFromTrash(dataID int, from, to time.Time) error {
+	ctx := context.Background()
+
+	if s.ini.Section("storage").Key("trash_days").MustInt(0) <= 0 {
+		return errors.New("the trash is not configured")
+	}
+
+	closeStore, err := s.connectStore(ctx)
+	if err != nil {
+		return fmt.Errorf("database connect: %w", err)
+	}
+	defer closeStore()
+
+	producers := s.newProducerSet(ctx)
+	defer producers.Close()
+
+	archives, err := s.storer.DeletedArchives(ctx, dataID, from, to)
+	if err != nil {
+		return fmt.Errorf("getting deleted archives: %w", err)
+	}
+	archives = s.fileArchives(archives)
+
+	var restored, failed int
+	for _, archive := range archives {
+		producer, dest, err := producers.get(archive.Storage)
+		if err != nil {
+			failed++
+			s.log.Errorf("Restore from trash: [ID:%d File:%s] %s", archive.ID, archive.FileName, err)
+			continue
+		}
+		trash := s.trashFolder(dest)
+		days, err := producer.ReadDir(trash)
+		if err != nil {
+			s.log.Debugf("Restore from trash: [ID:%d File:%s] read trash folder: %s", archive.ID, archive.FileName, err)
+			continue
+		}
+		folder := ""
+		for _, day := range days {
+			path := filepath.Join(trash, day.Name(), strconv.Itoa(archive.ID))
+			if _, err := producer.Stat(filepath.Join(path, filepath.Base(archive.FileName))); err == nil {
+				folder = path
+				break
+			}
+		}
+		if folder == "" {
+			s.log.Debugf("Restore from trash: [ID:%d File:%s] not found in the trash", archive.ID, archive.FileName)
+			continue
+		}
+		if err := restoreFromTrash(producer, folder, archive.FileName); err != nil {
+			failed++
+			s.log.Errorf("Restore from trash: [ID:%d File:%s] %s", archive.ID, archive.FileName, err)
+			continue
+		}
+		if err := s.storer.MarkArchiveRestoredFromTrash(ctx, archive.ID); err != nil {
+			failed++
+			s.log.Errorf("Restore from trash: [ID:%d File:%s] update catalog: %s", archive.ID, archive.FileName, err)
+			continue
+		}
+		// the copies are written again from the restored archive by the replication process
+		if err := s.storer.SetArchiveCopiesStatus(ctx, archive.ID, copyStatusPending); err != nil {
+			s.log.Warnf("Restore from trash: [ID:%d File:%s] update archive copies: %s", archive.ID, archive.FileName, err)
+		}
+		restored++
+		s.log.Infof("Restore from trash: [ID:%d File:%s] restored", archive.ID, archive.FileName)
+	}
+
+	s.log.Infof("Restore from trash: restored %d archives, failed %d", restored, failed)
+	if failed != 0 {
+		return fmt.Errorf("%d archives could not be restored from the trash", failed)
+	}
+	return nil
+}
+
+func restoreFromTrash(producer storage.Producer, folder, fileName string) error {
+	if _, err := producer.Stat(fileName); err == nil {
+		return errors.New("the file already exists in the storage")
+	}
+	if err := producer.MakedirAll(filepath.Dir(fileName)); err != nil {
+		return fmt.Errorf("create storage folder: %w", err)
+	}
+	for _, path := range []string{fileName, fileName + manifest.FileExt} {
+		trashed := filepath.Join(folder, filepath.Base(path))
+		if _, err := producer.Stat(trashed); err != nil {
+			continue
+		}
+		if err := producer.Rename(trashed, path); err != nil {
+			return fmt.Errorf("move file from trash: %w", err)
+		}
+	}
+	return producer.Remove(folder)
+}
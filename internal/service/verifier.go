@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bytes"
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/storage"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+func (s *Service) loadManifestKeys() error {
+	s.signKey, s.verifyKey = nil, nil
+	if path := s.ini.Section("storage").Key("manifest_sign_key").String(); path != "" {
+		key, err := manifest.LoadPrivateKey(path)
+		if err != nil {
+			return fmt.Errorf("load sign key: %w", err)
+		}
+		s.signKey = key
+		s.verifyKey = key.Public().(ed25519.PublicKey)
+	}
+	if path := s.ini.Section("storage").Key("manifest_verify_key").String(); path != "" {
+		key, err := manifest.LoadPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("load verify key: %w", err)
+		}
+		s.verifyKey = key
+	}
+	return nil
+}
+
+// saveManifest writes the signed manifest next to the archive file.
+// The checksum and the size in the manifest are counted on the archive data before encryption,
+// so the key rotation does not invalidate manifests.
+func (s *Service) saveManifest(producer storage.Producer, data datastructs.ArchAvailableData, size int64, ddlHash string) error {
+	document, err := manifest.Sign(&manifest.Manifest{
+		DataID:         data.DataID,
+		SingleTable:    data.SingleTable,
+		Table:          data.SchemaName + "." + data.TableName,
+		ContentDate:    data.ContentDate.Format("2006-01-02"),
+		Rows:           data.ContentRows,
+		Size:           size,
+		Checksum:       data.Checksum,
+		DDLHash:        ddlHash,
+		ServiceVersion: version,
+		CreatedAt:      data.ArchivedAt,
+	}, s.signKey)
+	if err != nil {
+		return err
+	}
+	return producer.SaveFile(data.FileName+manifest.FileExt, io.NopCloser(bytes.NewReader(document)))
+}
+
+// Verify checks the signatures of the manifests and the checksums of the archives
+// with the content date in the range. dataID = 0 means all data types.
+func (s *Service) Verify(dataID int, from, to time.Time) error {
+	ctx := context.Background()
+
+	if err := s.loadManifestKeys(); err != nil {
+		return err
+	}
+	if s.verifyKey == nil {
+		return errors.New("the key for verification of manifests is not configured")
+	}
+	if err := s.loadKeyring(); err != nil {
+		return fmt.Errorf("load encryption keys: %w", err)
+	}
+
+	closeStore, err := s.connectStore(ctx)
+	if err != nil {
+		return fmt.Errorf("database connect: %w", err)
+	}
+	defer closeStore()
+
+	archives, err := s.storer.AvailableArchives(ctx, dataID, from, to)
+	if err != nil {
+		return fmt.Errorf("getting archives for verification: %w", err)
+	}
+	archives = s.fileArchives(archives)
+
+	producers := s.newProducerSet(ctx)
+	defer producers.Close()
+
+	var failed int
+	for _, archive := range archives {
+		if err := s.verifyArchive(producers, archive); err != nil {
+			failed++
+			s.log.Errorf("Verify: [ID:%d File:%s] FAILED: %s", archive.ID, archive.FileName, err)
+			continue
+		}
+		s.log.Infof("Verify: [ID:%d File:%s] OK", archive.ID, archive.FileName)
+	}
+
+	s.log.Infof("Verify: checked %d archives from %s to %s, failed %d",
+		len(archives), from.Format("2006-01-02"), to.Format("2006-01-02"), failed)
+	if failed != 0 {
+		return fmt.Errorf("%d of %d archives failed verification", failed, len(archives))
+	}
+	return nil
+}
+
+func (s *Service) verifyArchive(producers *producerSet, data datastructs.ArchAvailableData) error {
+	producer, _, err := producers.get(data.Storage)
+	if err != nil {
+		return fmt.Errorf("get files producer: %w", err)
+	}
+
+	m, err := s.readManifest(producer, data.FileName)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.New("manifest not found")
+	}
+
+	switch {
+	case m.Table != data.SchemaName+"."+data.TableName:
+		return fmt.Errorf("manifest table %s does not match the catalog", m.Table)
+	case m.ContentDate != data.ContentDate.Format("2006-01-02"):
+		return fmt.Errorf("manifest content date %s does not match the catalog", m.ContentDate)
+	case m.Rows != data.ContentRows:
+		return fmt.Errorf("manifest rows %d do not match the catalog rows %d", m.Rows, data.ContentRows)
+	case data.Checksum != "" && m.Checksum != data.Checksum:
+		return errors.New("manifest checksum does not match the catalog")
+	}
+
+	file, err := producer.ReadFile(data.FileName)
+	if err != nil {
+		return fmt.Errorf("read archive file: %w", err)
+	}
+	defer file.Close()
+
+	archive, err := s.archiveReader(file)
+	if err != nil {
+		return fmt.Errorf("decrypt archive file: %w", err)
+	}
+	sum, size, err := manifest.ReadChecksum(archive)
+	if err != nil {
+		return fmt.Errorf("read archive file: %w", err)
+	}
+	if size != m.Size || sum != m.Checksum {
+		return errors.New("archive file does not match the manifest checksum")
+	}
+	return nil
+}
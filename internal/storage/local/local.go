@@ -1,83 +1,98 @@
-package local
-
-import (
-	"errors"
-	"io"
-	"io/fs"
-	"os"
-
-	"captura-backup/internal/storage"
-)
-
-type producer struct{}
-
-func NewProducer() storage.Producer {
-	return new(producer)
-}
-
-func (p *producer) Ping() error {
-	return nil
-}
-
-func (*producer) Close() error {
-	return nil
-}
-
-func (*producer) MakedirAll(path string) error {
-	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
-		return os.MkdirAll(path, 0666)
-	}
-	return nil
-}
-
-func (*producer) ReadFile(path string) (io.ReadCloser, error) {
-	return os.Open(path)
-}
-
-func (p *producer) SaveFile(path string, reader io.ReadCloser) error {
-	bytes, err := io.ReadAll(reader)
-	if err != nil {
-		return err
-	}
-	// file, err := os.OpenFile()
-	return os.WriteFile(path, bytes, 0777)
-}
-
-func (*producer) ReadDir(path string) ([]fs.FileInfo, error) {
-	dir, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	return dir.Readdir(-1)
-}
-
-func (*producer) Remove(path string) error {
-	return os.Remove(path)
-}
-
-func (*producer) RemoveAll(path string) error {
-	return os.RemoveAll(path)
-}
-
-func (*producer) Rename(oldname, newname string) error {
-	return os.Rename(oldname, newname)
-}
-
-func (*producer) DeleteFile(path string) error {
-	return os.Remove(path)
-}
-
-func (*producer) MakeDir(path string) error {
-	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
-		return os.Mkdir(path, 0700)
-	}
-	return nil
-}
-
-func (*producer) DeleteDir(path string) error {
-	return os.Remove(path)
-}
-
-func (p *producer) Stat(path string) (fs.FileInfo, error) {
-	return os.Stat(path)
-}
+package local
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"captura-backup/internal/storage"
+)
+
+type producer struct{}
+
+func NewProducer() storage.Producer {
+	return new(producer)
+}
+
+func (p *producer) Ping() error {
+	return nil
+}
+
+func (*producer) Close() error {
+	return nil
+}
+
+func (*producer) FreeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+func (*producer) MakedirAll(path string) error {
+	return os.MkdirAll(path, 0700)
+}
+
+func (*producer) ReadFile(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (p *producer) SaveFile(path string, reader io.ReadCloser) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if reader != nil {
+		if _, err := io.Copy(file, reader); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+func (*producer) ReadDir(path string) ([]fs.FileInfo, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdir(-1)
+}
+
+func (*producer) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (*producer) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (*producer) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (*producer) DeleteFile(path string) error {
+	return os.Remove(path)
+}
+
+func (*producer) MakeDir(path string) error {
+	err := os.Mkdir(path, 0700)
+	if errors.Is(err, fs.ErrExist) {
+		if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+func (*producer) DeleteDir(path string) error {
+	return os.Remove(path)
+}
+
+func (p *producer) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
@@ -0,0 +1,14 @@
+package local
+
+import (
+	"testing"
+
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.TestProducer(t, func(t *testing.T) (storage.Producer, string) {
+		return NewProducer(), t.TempDir()
+	})
+}
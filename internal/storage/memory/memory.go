@@ -0,0 +1,328 @@
+// Package memory is the storage in memory for the tests of the processes working with the archives.
+package memory
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"captura-backup/internal/storage"
+)
+
+type file struct {
+	data    []byte
+	dir     bool
+	modTime time.Time
+}
+
+// Producer keeps the files and the folders in memory, the errors have the same semantics as the errors
+// of the local file system. The files are kept after Close, so the producer can be returned by every dial of the pool.
+type Producer struct {
+	mu    sync.Mutex
+	files map[string]*file
+	free  int64
+}
+
+func NewProducer() *Producer {
+	return &Producer{
+		files: map[string]*file{"/": {dir: true, modTime: time.Now()}},
+		free:  -1,
+	}
+}
+
+// SetFreeSpace sets the free space returned by FreeSpace, the negative value means the free space is unknown.
+func (p *Producer) SetFreeSpace(free int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.free = free
+}
+
+// Files returns the names of all files (not folders) sorted by name.
+func (p *Producer) Files() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var names []string
+	for name, f := range p.files {
+		if !f.dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// parent checks that the parent folder of the path exists.
+func (p *Producer) parent(op, name string) error {
+	parent, ok := p.files[path.Dir(name)]
+	if !ok {
+		return pathError(op, name, fs.ErrNotExist)
+	}
+	if !parent.dir {
+		return pathError(op, name, syscall.ENOTDIR)
+	}
+	return nil
+}
+
+// children returns the paths of all files and folders under the folder.
+func (p *Producer) children(name string) []string {
+	prefix := name + "/"
+	if name == "/" {
+		prefix = "/"
+	}
+	var children []string
+	for child := range p.files {
+		if child != name && strings.HasPrefix(child, prefix) {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+func (p *Producer) Ping() error {
+	return nil
+}
+
+func (p *Producer) FreeSpace(name string) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.files[clean(name)]; !ok {
+		return 0, pathError("statfs", name, fs.ErrNotExist)
+	}
+	if p.free < 0 {
+		return 0, storage.ErrFreeSpaceUnknown
+	}
+	return p.free, nil
+}
+
+func (p *Producer) Close() error {
+	return nil
+}
+
+func (p *Producer) Stat(name string) (fs.FileInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.files[clean(name)]
+	if !ok {
+		return nil, pathError("stat", name, fs.ErrNotExist)
+	}
+	return fileInfo{name: path.Base(clean(name)), file: *f}, nil
+}
+
+func (p *Producer) ReadFile(name string) (io.ReadCloser, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.files[clean(name)]
+	if !ok {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+	if f.dir {
+		return nil, pathError("read", name, syscall.EISDIR)
+	}
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (p *Producer) SaveFile(name string, reader io.ReadCloser) error {
+	var data []byte
+	if reader != nil {
+		var err error
+		if data, err = io.ReadAll(reader); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name = clean(name)
+	if err := p.parent("open", name); err != nil {
+		return err
+	}
+	if f, ok := p.files[name]; ok && f.dir {
+		return pathError("open", name, syscall.EISDIR)
+	}
+	p.files[name] = &file{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (p *Producer) DeleteFile(name string) error {
+	return p.Remove(name)
+}
+
+func (p *Producer) MakeDir(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name = clean(name)
+	if f, ok := p.files[name]; ok {
+		if !f.dir {
+			return pathError("mkdir", name, syscall.EEXIST)
+		}
+		return nil
+	}
+	if err := p.parent("mkdir", name); err != nil {
+		return err
+	}
+	p.files[name] = &file{dir: true, modTime: time.Now()}
+	return nil
+}
+
+func (p *Producer) ReadDir(name string) ([]fs.FileInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name = clean(name)
+	f, ok := p.files[name]
+	if !ok {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+	if !f.dir {
+		return nil, pathError("readdirent", name, syscall.ENOTDIR)
+	}
+	var infos []fs.FileInfo
+	for _, child := range p.children(name) {
+		if path.Dir(child) == name {
+			infos = append(infos, fileInfo{name: path.Base(child), file: *p.files[child]})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (p *Producer) DeleteDir(name string) error {
+	return p.Remove(name)
+}
+
+func (p *Producer) MakedirAll(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name = clean(name)
+	var parents []string
+	for dir := name; dir != "/"; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		f, ok := p.files[parents[i]]
+		switch {
+		case !ok:
+			p.files[parents[i]] = &file{dir: true, modTime: time.Now()}
+		case !f.dir:
+			return pathError("mkdir", parents[i], syscall.ENOTDIR)
+		}
+	}
+	return nil
+}
+
+func (p *Producer) Rename(oldname, newname string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	oldname, newname = clean(oldname), clean(newname)
+	f, ok := p.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if err := p.parent("rename", newname); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if oldname == newname {
+		return nil
+	}
+	if target, ok := p.files[newname]; ok {
+		switch {
+		case f.dir && !target.dir:
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTDIR}
+		case !f.dir && target.dir:
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EEXIST}
+		case target.dir && len(p.children(newname)) != 0:
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if f.dir && strings.HasPrefix(newname, oldname+"/") {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+	if f.dir {
+		for _, child := range p.children(oldname) {
+			p.files[newname+strings.TrimPrefix(child, oldname)] = p.files[child]
+			delete(p.files, child)
+		}
+	}
+	p.files[newname] = f
+	delete(p.files, oldname)
+	return nil
+}
+
+func (p *Producer) Remove(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name = clean(name)
+	f, ok := p.files[name]
+	if !ok {
+		return pathError("remove", name, fs.ErrNotExist)
+	}
+	if f.dir && len(p.children(name)) != 0 {
+		return pathError("remove", name, syscall.ENOTEMPTY)
+	}
+	if name == "/" {
+		return pathError("remove", name, syscall.EBUSY)
+	}
+	delete(p.files, name)
+	return nil
+}
+
+func (p *Producer) RemoveAll(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name = clean(name)
+	if _, ok := p.files[name]; !ok {
+		return nil
+	}
+	for _, child := range p.children(name) {
+		delete(p.files, child)
+	}
+	if name != "/" {
+		delete(p.files, name)
+	}
+	return nil
+}
+
+type fileInfo struct {
+	name string
+	file file
+}
+
+func (i fileInfo) Name() string {
+	return i.name
+}
+
+func (i fileInfo) Size() int64 {
+	return int64(len(i.file.data))
+}
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.file.dir {
+		return fs.ModeDir | 0700
+	}
+	return 0600
+}
+
+func (i fileInfo) ModTime() time.Time {
+	return i.file.modTime
+}
+
+func (i fileInfo) IsDir() bool {
+	return i.file.dir
+}
+
+func (i fileInfo) Sys() interface{} {
+	return nil
+}
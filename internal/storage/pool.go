@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+var ErrPoolClosed = errors.New("producer pool is closed")
+
+// Pool keeps the open producers of one storage for reuse by the processes and their workers.
+// The idle producer is checked by Ping before it is leased, the broken one is replaced with the new connection.
+// At most size producers are open at once, Get waits for the producer returned by Close,
+// the cancel of the context or the Close of the pool.
+type Pool struct {
+	dial  func() (Producer, error)
+	slots chan struct{}
+	done  chan struct{}
+
+	mu     sync.Mutex
+	idle   []Producer
+	closed bool
+}
+
+func NewPool(size int, dial func() (Producer, error)) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{dial: dial, slots: make(chan struct{}, size), done: make(chan struct{})}
+}
+
+// Get leases the producer of the pool, Close of the leased producer returns it to the pool.
+func (p *Pool) Get(ctx context.Context) (Producer, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+		return nil, ErrPoolClosed
+	}
+	for {
+		producer, err := p.takeIdle()
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		if producer == nil {
+			break
+		}
+		if err := producer.Ping(); err == nil {
+			return &leased{pool: p, producer: producer}, nil
+		}
+		producer.Close()
+	}
+
+	producer, err := p.dial()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return &leased{pool: p, producer: producer}, nil
+}
+
+func (p *Pool) takeIdle() (Producer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	if len(p.idle) == 0 {
+		return nil, nil
+	}
+	producer := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return producer, nil
+}
+
+func (p *Pool) put(producer Producer) error {
+	defer func() { <-p.slots }()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return producer.Close()
+	}
+	p.idle = append(p.idle, producer)
+	return nil
+}
+
+// Close closes the idle producers, the leased ones are closed when they are returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		close(p.done)
+	}
+	p.closed = true
+	var err error
+	for _, producer := range p.idle {
+		if closeErr := producer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	p.idle = nil
+	return err
+}
+
+// leased is the producer of the pool. After the failed operation the connection is checked by Ping,
+// the broken one is replaced with the new connection, so the next operations do not fail on it.
+type leased struct {
+	pool *Pool
+
+	mu       sync.Mutex
+	producer Producer
+	released bool
+}
+
+func (l *leased) current() Producer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.producer
+}
+
+// check reconnects the broken producer after the error, the error is returned unchanged.
+// The errors of the files do not mean the broken connection.
+func (l *leased) check(err error) error {
+	if err == nil || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrExist) || errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.producer.Ping() == nil {
+		return err
+	}
+	if producer, dialErr := l.pool.dial(); dialErr == nil {
+		l.producer.Close()
+		l.producer = producer
+	}
+	return err
+}
+
+func (l *leased) Ping() error {
+	return l.check(l.current().Ping())
+}
+
+func (l *leased) FreeSpace(path string) (int64, error) {
+	free, err := l.current().FreeSpace(path)
+	if errors.Is(err, ErrFreeSpaceUnknown) {
+		return free, err
+	}
+	return free, l.check(err)
+}
+
+// Close returns the producer to the pool.
+func (l *leased) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return nil
+	}
+	l.released = true
+	return l.pool.put(l.producer)
+}
+
+func (l *leased) Stat(path string) (fs.FileInfo, error) {
+	info, err := l.current().Stat(path)
+	return info, l.check(err)
+}
+
+func (l *leased) ReadFile(path string) (io.ReadCloser, error) {
+	file, err := l.current().ReadFile(path)
+	return file, l.check(err)
+}
+
+func (l *leased) SaveFile(path string, reader io.ReadCloser) error {
+	return l.check(l.current().SaveFile(path, reader))
+}
+
+func (l *leased) DeleteFile(path string) error {
+	return l.check(l.current().DeleteFile(path))
+}
+
+func (l *leased) MakeDir(path string) error {
+	return l.check(l.current().MakeDir(path))
+}
+
+func (l *leased) ReadDir(path string) ([]fs.FileInfo, error) {
+	infos, err := l.current().ReadDir(path)
+	return infos, l.check(err)
+}
+
+func (l *leased) DeleteDir(path string) error {
+	return l.check(l.current().DeleteDir(path))
+}
+
+func (l *leased) MakedirAll(path string) error {
+	return l.check(l.current().MakedirAll(path))
+}
+
+func (l *leased) Rename(oldname, newname string) error {
+	return l.check(l.current().Rename(oldname, newname))
+}
+
+func (l *leased) Remove(path string) error {
+	return l.check(l.current().Remove(path))
+}
+
+func (l *leased) RemoveAll(path string) error {
+	return l.check(l.current().RemoveAll(path))
+}
@@ -0,0 +1,144 @@
+package storage_test
+
+import (
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/local"
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errBroken = errors.New("connection lost")
+
+// testProducer is the local producer with the connection which can be broken
+type testProducer struct {
+	storage.Producer
+	mu     sync.Mutex
+	broken bool
+	closed bool
+}
+
+func (p *testProducer) Ping() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.broken {
+		return errBroken
+	}
+	return nil
+}
+
+func (p *testProducer) MakeDir(path string) error {
+	if err := p.Ping(); err != nil {
+		return err
+	}
+	return p.Producer.MakeDir(path)
+}
+
+func (p *testProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *testProducer) breakConn() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.broken = true
+}
+
+func newTestPool(size int) (*storage.Pool, *[]*testProducer) {
+	var (
+		mu     sync.Mutex
+		dialed []*testProducer
+	)
+	return storage.NewPool(size, func() (storage.Producer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		p := &testProducer{Producer: local.NewProducer()}
+		dialed = append(dialed, p)
+		return p, nil
+	}), &dialed
+}
+
+func TestPoolReuse(t *testing.T) {
+	pool, dialed := newTestPool(2)
+	defer pool.Close()
+
+	first, err := pool.Get(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, first.Close())
+	second, err := pool.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, *dialed, 1, "the idle producer is reused")
+
+	// the broken idle producer is replaced with the new connection
+	assert.NoError(t, second.Close())
+	(*dialed)[0].breakConn()
+	third, err := pool.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, *dialed, 2)
+	assert.True(t, (*dialed)[0].closed)
+	third.Close()
+}
+
+func TestPoolSize(t *testing.T) {
+	pool, dialed := newTestPool(1)
+	defer pool.Close()
+
+	first, err := pool.Get(context.Background())
+	assert.NoError(t, err)
+
+	leased := make(chan storage.Producer)
+	go func() {
+		second, _ := pool.Get(context.Background())
+		leased <- second
+	}()
+	select {
+	case <-leased:
+		t.Fatal("the second producer is leased over the pool size")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Close()
+	second := <-leased
+	assert.NotNil(t, second)
+	assert.Len(t, *dialed, 1)
+
+	// the wait for the producer is stopped by the context and by the close of the pool
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.Get(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pool.Close()
+	}()
+	_, err = pool.Get(context.Background())
+	assert.ErrorIs(t, err, storage.ErrPoolClosed)
+	second.Close()
+
+	assert.NoError(t, pool.Close())
+	_, err = pool.Get(context.Background())
+	assert.ErrorIs(t, err, storage.ErrPoolClosed)
+}
+
+func TestPoolReconnect(t *testing.T) {
+	pool, dialed := newTestPool(1)
+	defer pool.Close()
+
+	producer, err := pool.Get(context.Background())
+	assert.NoError(t, err)
+	defer producer.Close()
+
+	dir := t.TempDir()
+	(*dialed)[0].breakConn()
+	assert.Error(t, producer.MakeDir(filepath.Join(dir, "first")), "the operation fails on the broken connection")
+	assert.NoError(t, producer.MakeDir(filepath.Join(dir, "second")), "the next operation uses the new connection")
+	assert.Len(t, *dialed, 2)
+	assert.True(t, (*dialed)[0].closed)
+}
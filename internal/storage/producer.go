@@ -1,64 +1,126 @@
-// Interface for operations with files via remote protocols sftp, ftp
-package storage
-
-import (
-	"errors"
-	"io"
-	"io/fs"
-
-	"github.com/pkg/sftp"
-)
-
-var (
-	ErrUnsupportedServer = errors.New("unsupported server")
-)
-
-//RemoteConfig expected values:
-// AuthMethod : "key", "password", "keyboard".
-// The default ftp port:21, ssh and sftp port:22".
-type RemoteConfig struct {
-	Host              string
-	Port              string
-	AuthMethod        string
-	User              string
-	Password          string
-	PrivateKeyFile    string
-	Timeout           int64
-	ClientOptionsSFTP []sftp.ClientOption
-	DebugLoger        io.Writer
-}
-
-type Producer interface {
-	Ping() error
-	Close() error
-
-	Stat(path string) (fs.FileInfo, error)
-	ReadFile(path string) (io.ReadCloser, error)
-	
-	// SaveFile writes data to the named file, creating it if necessary. If the file does not exist, SaveFile creates it with permissions perm (before umask); otherwise SaveFile truncates it before writing, without changing permissions.
-	// To create an empty file instead of the Reader, pass the nil
-	SaveFile(path string, reader io.ReadCloser) error
-	DeleteFile(path string) error
-
-	MakeDir(path string) error
-	ReadDir(path string) ([]fs.FileInfo, error)
-	DeleteDir(path string) error
-
-	// MkdirAll creates a directory named path, along with any necessary parents,
-	// and returns nil, or else returns an error.
-	// If path is already a directory, MkdirAll does nothing and returns nil.
-	// If path contains a regular file, an error is returned
-	MakedirAll(path string) error
-
-	//Rename file or directory
-	Rename(oldname, newname string) error
-
-	//Remove removes the named file or empty directory.
-	//An error will be returned if no file or directory with the specified path exists, or if the specified directory is not empty.
-	//If there is an other error, the error chain will contain fs.ErrInvalid
-	Remove(path string) error
-
-	//RemoveAll removes path and any children it contains. It removes everything it can but returns the first error it encounters.
-	//If the path does not exist, RemoveAll returns nil (no error). If there is an other error, the error chain maybe contain fs.ErrInvalid
-	RemoveAll(path string) error
-}
+// Interface for operations with files via remote protocols sftp, ftp
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/pkg/sftp"
+)
+
+var (
+	ErrUnsupportedServer = errors.New("unsupported server")
+	ErrFreeSpaceUnknown  = errors.New("free space of the storage is unknown")
+)
+
+//RemoteConfig expected values:
+// AuthMethod : "key", "password", "keyboard", "agent", for webdav "basic" or "digest".
+// The default ftp port:21 (990 for the implicit FTPS), ssh and sftp port:22".
+// The sftp host key is checked by HostKeyFingerprint if it is set, otherwise by the KnownHostsFile
+// (~/.ssh/known_hosts by default). With TrustOnFirstUse the key of an unknown host is added to the KnownHostsFile.
+// The "agent" authentication uses the ssh-agent on the AgentSocket, by default from SSH_AUTH_SOCK.
+// TLSMode : "" (plain ftp), "explicit" (AUTH TLS) or "implicit" FTPS. The server certificate is checked
+// by the TLSFingerprint (SHA-256 of the certificate) if it is set, otherwise by the TLSCAFile or the system roots.
+// In FTPS modes the data channel is always protected, RequireFTPS rejects the plain ftp connection.
+// ResumeRetries is the number of reconnects to resume the interrupted upload or download from the transferred offset.
+// URL is the root of the webdav share, e.g. https://cloud.example.com/remote.php/dav/files/backup, if not set
+// it is https://Host:Port. The TLS options of FTPS are used for the https connection.
+type RemoteConfig struct {
+	URL                  string
+	Host                 string
+	Port                 string
+	AuthMethod           string
+	User                 string
+	Password             string
+	PrivateKeyFile       string
+	PrivateKeyPassphrase string
+	KnownHostsFile       string
+	HostKeyFingerprint   string
+	TrustOnFirstUse      bool
+	AgentSocket          string
+	TLSMode              string
+	TLSCAFile            string
+	TLSCertFile          string
+	TLSKeyFile           string
+	TLSServerName        string
+	TLSFingerprint       string
+	RequireFTPS          bool
+	ResumeRetries        int
+	Timeout              int64
+	ClientOptionsSFTP    []sftp.ClientOption
+	DebugLoger           io.Writer
+}
+
+type Producer interface {
+	Ping() error
+
+	// FreeSpace returns the free space in bytes available to the user on the file system of the path.
+	// If the protocol can not report it, ErrFreeSpaceUnknown is returned
+	FreeSpace(path string) (int64, error)
+	Close() error
+
+	// The errors of the missing paths contain fs.ErrNotExist in the chain, as the errors of the local file system.
+	// The conformance of the producer is checked by storagetest.TestProducer
+	Stat(path string) (fs.FileInfo, error)
+	ReadFile(path string) (io.ReadCloser, error)
+
+	// SaveFile writes data to the named file, creating it if necessary. If the file does not exist, SaveFile creates it with permissions perm (before umask); otherwise SaveFile truncates it before writing, without changing permissions.
+	// To create an empty file instead of the Reader, pass the nil
+	SaveFile(path string, reader io.ReadCloser) error
+	DeleteFile(path string) error
+
+	// MakeDir creates the directory with the full access of the owner. If path is already a directory, MakeDir does nothing and returns nil.
+	// If the parent does not exist, the error chain contains fs.ErrNotExist
+	MakeDir(path string) error
+	ReadDir(path string) ([]fs.FileInfo, error)
+	DeleteDir(path string) error
+
+	// MkdirAll creates a directory named path, along with any necessary parents,
+	// and returns nil, or else returns an error.
+	// If path is already a directory, MkdirAll does nothing and returns nil.
+	// If path contains a regular file, an error is returned
+	MakedirAll(path string) error
+
+	//Rename file or directory, the existing file newname is replaced
+	Rename(oldname, newname string) error
+
+	//Remove removes the named file or empty directory.
+	//If no file or directory with the specified path exists, the error chain contains fs.ErrNotExist,
+	//if the specified directory is not empty, the error chain contains fs.ErrExist (as syscall.ENOTEMPTY)
+	Remove(path string) error
+
+	//RemoveAll removes path and any children it contains. It removes everything it can but returns the first error it encounters.
+	//If the path does not exist, RemoveAll returns nil (no error)
+	RemoveAll(path string) error
+}
+
+// RemoveTree implements RemoveAll by Stat, ReadDir and Remove of the producer for the protocols
+// without the recursive removal.
+func RemoveTree(p Producer, path string) error {
+	info, err := p.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		infos, err := p.ReadDir(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for _, info := range infos {
+			if childErr := RemoveTree(p, path+"/"+info.Name()); childErr != nil && err == nil {
+				err = childErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := p.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
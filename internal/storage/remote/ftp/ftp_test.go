@@ -0,0 +1,547 @@
+package ftp
+
+import (
+	"bufio"
+	"bytes"
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/storagetest"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testServer is the minimal FTP server with explicit and implicit TLS, enough for the transfers of the client
+type testServer struct {
+	port      string
+	implicit  bool
+	tlsConfig *tls.Config
+	cert      *x509.Certificate
+
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	// the protection level of the data channel of the last transfer
+	prot string
+	// the number of the next transfers interrupted after dropAfter bytes
+	drops     int
+	dropAfter int64
+}
+
+func newTestServer(t *testing.T, implicit bool) *testServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ftp.test"},
+		DNSNames:              []string{"ftp.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	srv := &testServer{
+		implicit:  implicit,
+		cert:      cert,
+		files:     make(map[string][]byte),
+		dirs:      map[string]bool{"/": true},
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	_, srv.port, _ = net.SplitHostPort(listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+// caFile writes the server certificate as the CA file
+func (srv *testServer) caFile(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func (srv *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	if srv.implicit {
+		conn = tls.Server(conn, srv.tlsConfig)
+	}
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	var (
+		passive    net.Listener
+		prot       = "C"
+		rest       int64
+		renameFrom string
+	)
+	defer func() {
+		if passive != nil {
+			passive.Close()
+		}
+	}()
+	dataConn := func() (net.Conn, error) {
+		if passive == nil {
+			return nil, io.ErrClosedPipe
+		}
+		defer func() {
+			passive.Close()
+			passive = nil
+		}()
+		dc, err := passive.Accept()
+		if err != nil {
+			return nil, err
+		}
+		srv.mu.Lock()
+		srv.prot = prot
+		srv.mu.Unlock()
+		if prot == "P" {
+			return tls.Server(dc, srv.tlsConfig), nil
+		}
+		return dc, nil
+	}
+
+	// interrupted reports whether the transfer is interrupted and returns the limit of the transferred bytes
+	interrupted := func() (int64, bool) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if srv.drops == 0 {
+			return 0, false
+		}
+		srv.drops--
+		return srv.dropAfter, true
+	}
+
+	reply("220 test server ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg := strings.TrimSpace(line), ""
+		if i := strings.IndexByte(cmd, ' '); i != -1 {
+			cmd, arg = cmd[:i], cmd[i+1:]
+		}
+
+		switch strings.ToUpper(cmd) {
+		case "AUTH":
+			reply("234 AUTH TLS ok")
+			conn = tls.Server(conn, srv.tlsConfig)
+			r = bufio.NewReader(conn)
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			reply("230 logged in")
+		case "PBSZ":
+			reply("200 PBSZ=0")
+		case "PROT":
+			prot = arg
+			reply("200 protection level set")
+		case "FEAT":
+			reply("211-Features:\r\n REST STREAM\r\n SIZE\r\n EPSV\r\n211 End")
+		case "TYPE":
+			reply("200 type set")
+		case "REST":
+			rest, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting at %d", rest)
+		case "EPSV":
+			if passive, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 can not open data connection")
+				continue
+			}
+			_, port, _ := net.SplitHostPort(passive.Addr().String())
+			reply("229 Entering Extended Passive Mode (|||%s|)", port)
+		case "SIZE":
+			srv.mu.Lock()
+			data, ok := srv.files[arg]
+			srv.mu.Unlock()
+			if !ok {
+				reply("550 file not found")
+				continue
+			}
+			reply("213 %d", len(data))
+		case "MLST":
+			fact, ok := srv.fact(arg)
+			if !ok {
+				reply("550 file not found")
+				continue
+			}
+			reply("250-Listing %s\r\n %s\r\n250 End", arg, fact)
+		case "MLSD":
+			srv.mu.Lock()
+			dir := srv.dirs[arg]
+			srv.mu.Unlock()
+			if !dir {
+				reply("550 directory not found")
+				continue
+			}
+			reply("150 opening data connection")
+			dc, err := dataConn()
+			if err != nil {
+				reply("425 can not open data connection")
+				continue
+			}
+			for _, child := range srv.children(arg) {
+				fact, _ := srv.fact(child)
+				fmt.Fprintf(dc, "%s\r\n", fact)
+			}
+			dc.Close()
+			reply("226 transfer complete")
+		case "MKD":
+			srv.mu.Lock()
+			_, file := srv.files[arg]
+			ok := srv.dirs[path.Dir(arg)] && !srv.dirs[arg] && !file
+			if ok {
+				srv.dirs[arg] = true
+			}
+			srv.mu.Unlock()
+			if !ok {
+				reply("550 can not create directory")
+				continue
+			}
+			reply("257 \"%s\" created", arg)
+		case "RMD":
+			srv.mu.Lock()
+			ok := srv.dirs[arg] && len(srv.childrenLocked(arg)) == 0
+			if ok {
+				delete(srv.dirs, arg)
+			}
+			srv.mu.Unlock()
+			if !ok {
+				reply("550 can not remove directory")
+				continue
+			}
+			reply("250 directory removed")
+		case "DELE":
+			srv.mu.Lock()
+			_, ok := srv.files[arg]
+			delete(srv.files, arg)
+			srv.mu.Unlock()
+			if !ok {
+				reply("550 file not found")
+				continue
+			}
+			reply("250 file deleted")
+		case "RNFR":
+			if _, ok := srv.fact(arg); !ok {
+				reply("550 file not found")
+				continue
+			}
+			renameFrom = arg
+			reply("350 ready for RNTO")
+		case "RNTO":
+			srv.rename(renameFrom, arg)
+			reply("250 renamed")
+		case "STOR":
+			reply("150 opening data connection")
+			dc, err := dataConn()
+			if err != nil {
+				reply("425 can not open data connection")
+				continue
+			}
+			var src io.Reader = dc
+			limit, drop := interrupted()
+			if drop {
+				src = io.LimitReader(dc, limit)
+			}
+			data, err := io.ReadAll(src)
+			dc.Close()
+			srv.mu.Lock()
+			srv.files[arg] = append(srv.files[arg][:rest:rest], data...)
+			srv.mu.Unlock()
+			rest = 0
+			if err != nil || drop {
+				reply("426 transfer aborted")
+				continue
+			}
+			reply("226 transfer complete")
+		case "RETR":
+			srv.mu.Lock()
+			data, ok := srv.files[arg]
+			srv.mu.Unlock()
+			if !ok {
+				reply("550 file not found")
+				continue
+			}
+			reply("150 opening data connection")
+			dc, err := dataConn()
+			if err != nil {
+				reply("425 can not open data connection")
+				continue
+			}
+			data, rest = data[rest:], 0
+			if limit, drop := interrupted(); drop {
+				data = data[:limit]
+				err = io.ErrClosedPipe
+			}
+			if _, copyErr := io.Copy(dc, bytes.NewReader(data)); copyErr != nil {
+				err = copyErr
+			}
+			dc.Close()
+			if err != nil {
+				reply("426 transfer aborted")
+				continue
+			}
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// fact returns the MLST facts of the file or the directory
+func (srv *testServer) fact(name string) (string, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	modify := time.Now().UTC().Format("20060102150405")
+	if srv.dirs[name] {
+		return fmt.Sprintf("type=dir;modify=%s;unix.mode=0700; %s", modify, name), true
+	}
+	if data, ok := srv.files[name]; ok {
+		return fmt.Sprintf("type=file;size=%d;modify=%s;unix.mode=0600; %s", len(data), modify, name), true
+	}
+	return "", false
+}
+
+func (srv *testServer) children(dir string) []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.childrenLocked(dir)
+}
+
+// childrenLocked returns the files and the directories in the directory
+func (srv *testServer) childrenLocked(dir string) []string {
+	var children []string
+	for name := range srv.files {
+		if path.Dir(name) == dir {
+			children = append(children, name)
+		}
+	}
+	for name := range srv.dirs {
+		if name != "/" && path.Dir(name) == dir {
+			children = append(children, name)
+		}
+	}
+	return children
+}
+
+// rename moves the file or the directory with the children, the existing file is replaced
+func (srv *testServer) rename(from, to string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	moved := func(name string) bool {
+		return name == from || strings.HasPrefix(name, from+"/")
+	}
+	files, dirs := make(map[string][]byte), make(map[string]bool)
+	for name, data := range srv.files {
+		if moved(name) {
+			delete(srv.files, name)
+			files[to+strings.TrimPrefix(name, from)] = data
+		}
+	}
+	for name := range srv.dirs {
+		if moved(name) {
+			delete(srv.dirs, name)
+			dirs[to+strings.TrimPrefix(name, from)] = true
+		}
+	}
+	for name, data := range files {
+		srv.files[name] = data
+	}
+	for name := range dirs {
+		srv.dirs[name] = true
+	}
+}
+
+func (srv *testServer) config(mode string) *storage.RemoteConfig {
+	return &storage.RemoteConfig{
+		Host:     "127.0.0.1",
+		Port:     srv.port,
+		User:     "backup",
+		Password: "secret",
+		TLSMode:  mode,
+		Timeout:  5,
+	}
+}
+
+// roundTrip stores the file and reads it back
+func roundTrip(t *testing.T, c *storage.RemoteConfig) error {
+	client, err := NewClient(c)
+	if err != nil {
+		return err
+	}
+	p := NewProducer(client, c)
+	defer p.Close()
+
+	if err := p.SaveFile("/archive.gz", io.NopCloser(strings.NewReader("archive data"))); err != nil {
+		return err
+	}
+	file, err := p.ReadFile("/archive.gz")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	assert.Equal(t, "archive data", string(data))
+	return nil
+}
+
+func TestExplicitTLS(t *testing.T) {
+	srv := newTestServer(t, false)
+
+	c := srv.config("explicit")
+	assert.Error(t, roundTrip(t, c), "the self-signed certificate is not trusted")
+
+	c.TLSCAFile = srv.caFile(t)
+	assert.NoError(t, roundTrip(t, c))
+	assert.Equal(t, "P", srv.prot, "the data channel is protected")
+
+	c.TLSServerName = "other.test"
+	assert.Error(t, roundTrip(t, c), "the certificate is not valid for the server name")
+}
+
+func TestImplicitTLS(t *testing.T) {
+	srv := newTestServer(t, true)
+
+	c := srv.config("implicit")
+	c.TLSCAFile = srv.caFile(t)
+	assert.NoError(t, roundTrip(t, c))
+	assert.Equal(t, "P", srv.prot, "the data channel is protected")
+}
+
+func TestCertificatePinning(t *testing.T) {
+	srv := newTestServer(t, false)
+	sum := sha256.Sum256(srv.cert.Raw)
+
+	c := srv.config("explicit")
+	// the pinned certificate is trusted without the CA and the server name
+	c.TLSServerName = "other.test"
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = fmt.Sprintf("%02X", b)
+	}
+	c.TLSFingerprint = "SHA256 Fingerprint=" + strings.Join(hexes, ":")
+	assert.NoError(t, roundTrip(t, c))
+
+	c.TLSFingerprint = strings.Repeat("00", sha256.Size)
+	assert.Error(t, roundTrip(t, c))
+}
+
+func TestRequireFTPS(t *testing.T) {
+	srv := newTestServer(t, false)
+
+	c := srv.config("")
+	assert.NoError(t, roundTrip(t, c))
+	assert.Equal(t, "C", srv.prot)
+
+	c.RequireFTPS = true
+	assert.Error(t, roundTrip(t, c))
+
+	c.TLSMode = "unknown"
+	assert.Error(t, roundTrip(t, c))
+}
+
+func TestResume(t *testing.T) {
+	srv := newTestServer(t, false)
+	data := bytes.Repeat([]byte("archive data "), 100000)
+	interrupt := func(transfers int) {
+		srv.mu.Lock()
+		srv.drops, srv.dropAfter = transfers, 300000
+		srv.mu.Unlock()
+	}
+
+	c := srv.config("")
+	c.ResumeRetries = 2
+	client, err := NewClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProducer(client, c)
+	defer p.Close()
+
+	interrupt(2)
+	assert.NoError(t, p.SaveFile("/archive.gz", io.NopCloser(io.MultiReader(bytes.NewReader(data)))))
+	assert.Equal(t, data, srv.files["/archive.gz"], "the upload is resumed twice")
+
+	interrupt(2)
+	file, err := p.ReadFile("/archive.gz")
+	if assert.NoError(t, err) {
+		read, err := io.ReadAll(file)
+		assert.NoError(t, err)
+		assert.Equal(t, data, read, "the download is resumed twice")
+		file.Close()
+	}
+
+	interrupt(3)
+	assert.Error(t, p.SaveFile("/archive.gz", io.NopCloser(bytes.NewReader(data))), "the retries are exhausted")
+	interrupt(3)
+	file, err = p.ReadFile("/archive.gz")
+	if assert.NoError(t, err) {
+		_, err := io.ReadAll(file)
+		assert.Error(t, err)
+		file.Close()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.TestProducer(t, func(t *testing.T) (storage.Producer, string) {
+		c := newTestServer(t, false).config("")
+		client, err := NewClient(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewProducer(client, c), "/"
+	})
+}
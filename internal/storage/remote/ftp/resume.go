@@ -0,0 +1,213 @@
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/secsy/goftp"
+)
+
+// replayWindow is the size of the tail of the uploaded data kept in memory to resume the upload
+// from the size of the file on the server, it covers the data sent, but not written by the server.
+const replayWindow = 16 << 20
+
+var errReplayWindow = errors.New("the resume offset is out of the replay window")
+
+// replayReader keeps the last read bytes of the source, so the upload can be resumed
+// from the offset within the window without reading the source again.
+type replayReader struct {
+	src    io.Reader
+	buf    []byte
+	start  int64 // offset of buf[0] in the source
+	offset int64 // current offset of the reader
+}
+
+func newReplayReader(src io.Reader) *replayReader {
+	return &replayReader{src: src}
+}
+
+func (r *replayReader) Read(b []byte) (int, error) {
+	end := r.start + int64(len(r.buf))
+	if r.offset < end {
+		n := copy(b, r.buf[r.offset-r.start:])
+		r.offset += int64(n)
+		return n, nil
+	}
+
+	n, err := r.src.Read(b)
+	r.buf = append(r.buf, b[:n]...)
+	r.offset += int64(n)
+	if len(r.buf) > 2*replayWindow {
+		drop := len(r.buf) - replayWindow
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+		r.start += int64(drop)
+	}
+	return n, err
+}
+
+// Rewind moves the reader back to the offset within the window.
+func (r *replayReader) Rewind(offset int64) error {
+	if offset < r.start || offset > r.start+int64(len(r.buf)) {
+		return fmt.Errorf("offset %d: %w", offset, errReplayWindow)
+	}
+	r.offset = offset
+	return nil
+}
+
+// retryable reports whether the interrupted transfer can be resumed after the error,
+// the permanent replies of the server (5xx) and the closed reader of the download are not retried.
+func retryable(err error) bool {
+	var ftpErr goftp.Error
+	if errors.As(err, &ftpErr) && ftpErr.Code() >= 500 {
+		return false
+	}
+	return !errors.Is(err, errReplayWindow) && !errors.Is(err, io.ErrClosedPipe)
+}
+
+// store uploads the source to the path, the interrupted upload is resumed on the new connection
+// from the size of the file on the server up to resumeRetries times.
+func (p *producer) store(path string, src io.Reader) error {
+	reader := newReplayReader(src)
+	var offset int64
+	for attempt := 0; ; attempt++ {
+		n, err := p.transfer("STOR", path, offset, nil, reader)
+		if err == nil {
+			return nil
+		}
+		if attempt >= p.resumeRetries || !retryable(err) {
+			return err
+		}
+		if n == 0 {
+			// nothing was sent, the upload is repeated from the same offset
+			if err := reader.Rewind(offset); err != nil {
+				return err
+			}
+			continue
+		}
+		size, sizeErr := p.size(path)
+		if sizeErr != nil {
+			return fmt.Errorf("%s (resume failed: %s)", err, sizeErr)
+		}
+		if err := reader.Rewind(size); err != nil {
+			return err
+		}
+		offset = size
+	}
+}
+
+// retrieve downloads the path to the writer, the interrupted download is resumed on the new connection
+// from the received size up to resumeRetries times.
+func (p *producer) retrieve(path string, dest io.Writer) error {
+	var offset int64
+	for attempt := 0; ; attempt++ {
+		n, err := p.transfer("RETR", path, offset, dest, nil)
+		offset += n
+		if err == nil {
+			return nil
+		}
+		if attempt >= p.resumeRetries || !retryable(err) {
+			return err
+		}
+	}
+}
+
+// transfer runs the data command on the new connection from the offset and returns the number of transferred bytes.
+func (p *producer) transfer(cmd, path string, offset int64, dest io.Writer, src io.Reader) (int64, error) {
+	conn, err := p.c.OpenRawConn()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if err := sendCommand(conn, 200, "TYPE I"); err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		if err := sendCommand(conn, 350, "REST %d", offset); err != nil {
+			return 0, err
+		}
+	}
+	getter, err := conn.PrepareDataConn()
+	if err != nil {
+		return 0, err
+	}
+	code, msg, err := conn.SendCommand("%s %s", cmd, path)
+	if err != nil {
+		return 0, err
+	}
+	if code < 100 || code >= 200 {
+		return 0, replyError{code, msg}
+	}
+	dc, err := getter()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if src != nil {
+		n, err = io.Copy(dc, src)
+	} else {
+		n, err = io.Copy(dest, dc)
+	}
+	if closeErr := dc.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+
+	code, msg, err = conn.ReadResponse()
+	if err != nil {
+		return n, err
+	}
+	if code < 200 || code >= 300 {
+		return n, replyError{code, msg}
+	}
+	return n, nil
+}
+
+// size returns the size of the file on the server.
+func (p *producer) size(path string) (int64, error) {
+	conn, err := p.c.OpenRawConn()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if err := sendCommand(conn, 200, "TYPE I"); err != nil {
+		return 0, err
+	}
+	code, msg, err := conn.SendCommand("SIZE %s", path)
+	if err != nil {
+		return 0, err
+	}
+	if code != 213 {
+		return 0, replyError{code, msg}
+	}
+	return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+}
+
+func sendCommand(conn goftp.RawConn, expected int, f string, args ...interface{}) error {
+	code, msg, err := conn.SendCommand(f, args...)
+	if err != nil {
+		return err
+	}
+	if code != expected {
+		return replyError{code, msg}
+	}
+	return nil
+}
+
+// replyError is the unexpected reply of the server, it implements goftp.Error.
+type replyError struct {
+	code int
+	msg  string
+}
+
+func (e replyError) Error() string   { return fmt.Sprintf("unexpected response: %d-%s", e.code, e.msg) }
+func (e replyError) Temporary() bool { return e.code >= 400 && e.code < 500 }
+func (e replyError) Code() int       { return e.code }
+func (e replyError) Message() string { return e.msg }
@@ -0,0 +1,120 @@
+package sftp
+
+import (
+	"captura-backup/internal/storage"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsMu serializes the writes of the trusted keys into the known_hosts files
+var knownHostsMu sync.Mutex
+
+// hostKeyCallback returns the check of the server host key: by the pinned fingerprint if it is set,
+// otherwise by the known_hosts file. The changed key of a known host is always rejected.
+func hostKeyCallback(c *storage.RemoteConfig) (ssh.HostKeyCallback, error) {
+	if c.HostKeyFingerprint != "" {
+		fingerprint := strings.TrimSpace(c.HostKeyFingerprint)
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if ssh.FingerprintSHA256(key) == fingerprint || ssh.FingerprintLegacyMD5(key) == fingerprint {
+				return nil
+			}
+			return fmt.Errorf("ssh: host key %s of %s does not match the pinned fingerprint", ssh.FingerprintSHA256(key), hostname)
+		}, nil
+	}
+
+	file := c.KnownHostsFile
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("find known_hosts file: %w", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	if c.TrustOnFirstUse {
+		if err := createKnownHosts(file); err != nil {
+			return nil, err
+		}
+	}
+	check, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("read known_hosts file: %w", err)
+	}
+	if !c.TrustOnFirstUse {
+		return check, nil
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		// the host is unknown if there are no keys for it in the file
+		if !errors.As(err, &keyErr) || len(keyErr.Want) != 0 {
+			return err
+		}
+		return addKnownHost(file, hostname, key)
+	}, nil
+}
+
+func createKnownHosts(file string) error {
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return fmt.Errorf("create known_hosts folder: %w", err)
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("create known_hosts file: %w", err)
+	}
+	return f.Close()
+}
+
+func addKnownHost(file, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("add host key to known_hosts: %w", err)
+	}
+	if _, err := f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n"); err != nil {
+		f.Close()
+		return fmt.Errorf("add host key to known_hosts: %w", err)
+	}
+	return f.Close()
+}
+
+// parsePrivateKey parses the private key, the passphrase is used if the key is protected.
+func parsePrivateKey(privateKey []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+	if passphrase == "" {
+		return nil, errors.New("ssh: the private key is passphrase protected, but the passphrase is not specified")
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(passphrase))
+}
+
+// dialAgent connects to the ssh-agent on the socket, by default from the SSH_AUTH_SOCK variable.
+func dialAgent(socket string) (net.Conn, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		return nil, errors.New("ssh: the ssh-agent socket is not specified and SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("connect to ssh-agent: %w", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,104 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	gosftp "github.com/pkg/sftp"
+)
+
+// chunkSize is the size of the data written to the server at once, the failed chunk is written again after reconnect.
+const chunkSize = 1 << 20
+
+// remoteFile is the file which is reopened on the new connection after the connection is lost,
+// the transfer continues from the offset up to retries times.
+type remoteFile struct {
+	p       *producer
+	client  *gosftp.Client
+	file    *gosftp.File
+	path    string
+	flag    int
+	offset  int64
+	retries int
+}
+
+func (p *producer) openFile(path string, flag, reopenFlag int) (*remoteFile, error) {
+	client := p.client()
+	file, err := client.OpenFile(path, flag)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteFile{p: p, client: client, file: file, path: path, flag: reopenFlag, retries: p.resumeRetries}, nil
+}
+
+func (f *remoteFile) Read(b []byte) (int, error) {
+	for {
+		n, err := f.file.Read(b)
+		f.offset += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			// the error is returned by the next read
+			return n, nil
+		}
+		if err := f.resume(err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (f *remoteFile) Write(b []byte) (int, error) {
+	for {
+		_, err := f.file.Seek(f.offset, io.SeekStart)
+		if err == nil {
+			_, err = f.file.Write(b)
+		}
+		if err == nil {
+			f.offset += int64(len(b))
+			return len(b), nil
+		}
+		if err := f.resume(err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (f *remoteFile) Close() error {
+	return f.file.Close()
+}
+
+// resume reconnects to the server and reopens the file, if the transfer can be resumed after the error.
+func (f *remoteFile) resume(err error) error {
+	if f.retries <= 0 || !retryable(err) {
+		return err
+	}
+	f.retries--
+	f.file.Close()
+
+	client, reconnectErr := f.p.reconnect(f.client)
+	if reconnectErr != nil {
+		return fmt.Errorf("%s (resume failed: %s)", err, reconnectErr)
+	}
+	file, openErr := client.OpenFile(f.path, f.flag)
+	if openErr != nil {
+		return fmt.Errorf("%s (resume failed: %s)", err, openErr)
+	}
+	if _, seekErr := file.Seek(f.offset, io.SeekStart); seekErr != nil {
+		file.Close()
+		return fmt.Errorf("%s (resume failed: %s)", err, seekErr)
+	}
+	f.client, f.file = client, file
+	return nil
+}
+
+// retryable reports whether the error is the lost connection, the errors of the server are not retried.
+func retryable(err error) bool {
+	var status *gosftp.StatusError
+	if errors.As(err, &status) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+	return true
+}
@@ -1,245 +1,240 @@
-package sftp
-
-import (
-	"captura-backup/internal/storage"
-	"io"
-	"io/fs"
-	"io/ioutil"
-	"os"
-	"strings"
-	"time"
-
-	"golang.org/x/crypto/ssh"
-
-	"errors"
-
-	gosftp "github.com/pkg/sftp"
-)
-
-type producer struct {
-	c *gosftp.Client
-}
-
-func NewProducer(client *gosftp.Client) storage.Producer {
-	return &producer{client}
-}
-
-func NewClient(c *storage.RemoteConfig) (*gosftp.Client, error) {
-	if c.Port == "" {
-		c.Port = "22"
-	}
-	cfg := &ssh.ClientConfig{
-		User:            c.User,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         time.Duration(c.Timeout) * time.Second,
-	}
-
-	switch c.AuthMethod {
-	case "key":
-		privateKey, err := ioutil.ReadFile(c.PrivateKeyFile)
-		if err != nil {
-			return nil, err
-		}
-		signer, err := ssh.ParsePrivateKey(privateKey)
-		if err != nil {
-			return nil, err
-		}
-		cfg.Auth = []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		}
-	case "password":
-		cfg.Auth = []ssh.AuthMethod{
-			ssh.Password(c.Password),
-		}
-	case "keyboard":
-		cfg.Auth = []ssh.AuthMethod{
-			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
-				// Just sends the password back for all questions
-				answers := make([]string, len(questions))
-				for i := range answers {
-					answers[i] = c.Password
-				}
-				return answers, nil
-			}),
-		}
-	default:
-		err := errors.New("[" + c.AuthMethod + "] unsupported authentication method")
-		return nil, err
-	}
-
-	sshClient, err := ssh.Dial("tcp", c.Host+":"+c.Port, cfg)
-	if err != nil {
-		return nil, err
-	}
-
-	return gosftp.NewClient(sshClient, c.ClientOptionsSFTP...)
-}
-
-func (p *producer) Ping() error {
-	info, err := p.c.Stat("")
-	if err != nil {
-		return err
-	}
-	if info == nil {
-		return storage.ErrUnsupportedServer
-	}
-	return nil
-}
-
-func (p *producer) Close() error {
-	return p.c.Close()
-}
-
-func (p *producer) MakedirAll(path string) error {
-	return p.c.MkdirAll(path)
-}
-
-func (p *producer) ReadFile(path string) (io.ReadCloser, error) {
-	return p.c.Open(path)
-}
-
-func (p *producer) SaveFile(path string, reader io.ReadCloser) error {
-	file, err := p.c.OpenFile(path, os.O_RDWR|os.O_TRUNC|os.O_CREATE)
-	// file, err := p.c.Create(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	srcBytes, err := io.ReadAll(reader)
-	if err != nil {
-		return err
-	}
-	dstBytes, err := file.Write(srcBytes)
-	if err != nil {
-		return err
-	}
-	if len(srcBytes) != dstBytes {
-		return errors.New("data sizes do not match")
-	}
-	return nil
-}
-
-func (p *producer) ReadDir(path string) ([]fs.FileInfo, error) {
-	return p.c.ReadDir(path)
-}
-
-func (p *producer) Remove(path string) error {
-	err := p.c.Remove(path)
-	if err != nil && err == fs.ErrPermission {
-		return p.c.RemoveDirectory(path)
-	}
-	return err
-}
-
-func (p *producer) Rename(oldname, newname string) error {
-	return p.c.Rename(oldname, newname)
-}
-
-func (p *producer) DeleteFile(path string) error {
-	return p.c.Remove(path)
-}
-
-func (p *producer) MakeDir(path string) error {
-	return p.c.Mkdir(path)
-}
-
-func (p *producer) DeleteDir(path string) error {
-	return p.c.RemoveDirectory(path)
-}
-
-func (p *producer) RemoveAll(path string) error {
-	return p.RemoveAllRecursive(path)
-}
-
-func (p *producer) Stat(path string) (fs.FileInfo, error) {
-	return p.c.Stat(path)
-}
-
-// RemoveAll removes path and any children it contains.
-// It removes everything it can but returns the first error
-// it encounters. If the path does not exist, RemoveAll
-// returns nil (no error).
-func (p *producer) RemoveAllRecursive(path string) error {
-
-	if path == "" {
-		// fail silently to retain compatibility with previous behavior
-		// of RemoveAll. See issue 28830.
-		return nil
-	}
-	// Simple case: if Remove works, we're done.
-	err := p.Remove(path)
-	switch {
-	case err == nil:
-		return nil
-	case err != nil:
-		if errors.Is(err, fs.ErrNotExist) {
-			return nil
-		}
-		if status, ok := err.(*gosftp.StatusError); ok {
-			if !strings.Contains(status.Error(), "Directory is not empty") {
-				return err
-			}
-		}
-	}
-
-DIR:
-	for {
-		infos, err := p.ReadDir(path)
-		if err != nil {
-			if errors.Is(err, fs.ErrNotExist) {
-				return nil
-			}
-			return err
-		}
-		entities := len(infos)
-		if entities == 0 {
-			break
-		}
-		var names []string
-		for {
-			numErr := 0
-			names := func() []string {
-				for _, info := range infos {
-					names = append(names, info.Name())
-				}
-				return names
-			}()
-			if len(names) == 0 {
-				break DIR
-			}
-			for _, name := range names {
-				err1 := p.RemoveAllRecursive(path + "/" + name)
-				if err == nil {
-					err = err1
-				}
-				if err1 != nil {
-					numErr++
-				}
-			}
-			// If we can delete any entry, break to start new iteration.
-			// Otherwise, we discard current names, get next entries and try deleting them.
-			if numErr != entities {
-				break
-			}
-		}
-
-		if len(names) < entities {
-			err1 := p.DeleteDir(path)
-			if err1 == nil || (err1 != nil && errors.Is(err1, fs.ErrNotExist)) {
-				return nil
-			}
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	// Remove directory.
-	err1 := p.DeleteDir(path)
-	if err1 == nil || (err1 != nil && errors.Is(err1, fs.ErrNotExist)) {
-		return nil
-	}
-
-	return err1
-}
+package sftp
+
+import (
+	"captura-backup/internal/storage"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"errors"
+
+	gosftp "github.com/pkg/sftp"
+)
+
+type producer struct {
+	mu            sync.Mutex
+	c             *gosftp.Client
+	cfg           storage.RemoteConfig
+	resumeRetries int
+}
+
+// NewProducer returns the producer of the client, after the connection is lost the producer reconnects
+// with the config and resumes the interrupted transfer up to ResumeRetries times.
+func NewProducer(client *gosftp.Client, c *storage.RemoteConfig) storage.Producer {
+	return &producer{c: client, cfg: *c, resumeRetries: c.ResumeRetries}
+}
+
+func (p *producer) client() *gosftp.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.c
+}
+
+// reconnect replaces the broken client with the new connection, if it was not replaced yet.
+func (p *producer) reconnect(broken *gosftp.Client) (*gosftp.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.c != broken {
+		return p.c, nil
+	}
+	client, err := NewClient(&p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	broken.Close()
+	p.c = client
+	return client, nil
+}
+
+func NewClient(c *storage.RemoteConfig) (*gosftp.Client, error) {
+	if c.Port == "" {
+		c.Port = "22"
+	}
+	hostKeyCallback, err := hostKeyCallback(c)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ssh.ClientConfig{
+		User:            c.User,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Duration(c.Timeout) * time.Second,
+	}
+
+	switch c.AuthMethod {
+	case "key":
+		privateKey, err := ioutil.ReadFile(c.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := parsePrivateKey(privateKey, c.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Auth = []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		}
+	case "agent":
+		// the agent is needed only for the authentication while dialing
+		conn, err := dialAgent(c.AgentSocket)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		cfg.Auth = []ssh.AuthMethod{
+			ssh.PublicKeysCallback(agent.NewClient(conn).Signers),
+		}
+	case "password":
+		cfg.Auth = []ssh.AuthMethod{
+			ssh.Password(c.Password),
+		}
+	case "keyboard":
+		cfg.Auth = []ssh.AuthMethod{
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				// Just sends the password back for all questions
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = c.Password
+				}
+				return answers, nil
+			}),
+		}
+	default:
+		err := errors.New("[" + c.AuthMethod + "] unsupported authentication method")
+		return nil, err
+	}
+
+	sshClient, err := ssh.Dial("tcp", c.Host+":"+c.Port, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := gosftp.NewClient(sshClient, c.ClientOptionsSFTP...)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Ping checks the connection by the stat of the working directory, the servers reject the empty path.
+func (p *producer) Ping() error {
+	info, err := p.client().Stat(".")
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return storage.ErrUnsupportedServer
+	}
+	return nil
+}
+
+// FreeSpace uses the statvfs@openssh.com extension.
+func (p *producer) FreeSpace(path string) (int64, error) {
+	stat, err := p.client().StatVFS(path)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", err, storage.ErrFreeSpaceUnknown)
+	}
+	return int64(stat.Frsize * stat.Bavail), nil
+}
+
+func (p *producer) Close() error {
+	return p.client().Close()
+}
+
+func (p *producer) MakedirAll(path string) error {
+	return p.client().MkdirAll(path)
+}
+
+func (p *producer) ReadFile(path string) (io.ReadCloser, error) {
+	return p.openFile(path, os.O_RDONLY, os.O_RDONLY)
+}
+
+// SaveFile writes the data by chunks, the interrupted upload is continued from the last written chunk
+// after reconnect, the reopened file is not truncated.
+func (p *producer) SaveFile(path string, reader io.ReadCloser) error {
+	file, err := p.openFile(path, os.O_RDWR|os.O_TRUNC|os.O_CREATE, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	if reader == nil {
+		return file.Close()
+	}
+
+	if _, err := io.CopyBuffer(file, reader, make([]byte, chunkSize)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (p *producer) ReadDir(path string) ([]fs.FileInfo, error) {
+	return p.client().ReadDir(path)
+}
+
+// Remove removes the file or the empty directory, the client removes the directory after the failed removal of the file.
+func (p *producer) Remove(path string) error {
+	return p.notEmpty(path, p.client().Remove(path))
+}
+
+// notEmpty replaces the failure of the removal of the directory with syscall.ENOTEMPTY
+// if the directory has the children, the servers report it by the generic failure.
+func (p *producer) notEmpty(path string, err error) error {
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if infos, readErr := p.client().ReadDir(path); readErr == nil && len(infos) != 0 {
+		return &fs.PathError{Op: "remove", Path: path, Err: syscall.ENOTEMPTY}
+	}
+	return err
+}
+
+// Rename uses the posix-rename@openssh.com extension to replace an existing file atomically,
+// if the server does not support it, the standard rename is used.
+func (p *producer) Rename(oldname, newname string) error {
+	if err := p.client().PosixRename(oldname, newname); err == nil {
+		return nil
+	}
+	err := p.client().Rename(oldname, newname)
+	if err != nil {
+		// the servers report the missing file by the generic failure
+		if _, statErr := p.client().Stat(oldname); errors.Is(statErr, fs.ErrNotExist) {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+		}
+	}
+	return err
+}
+
+func (p *producer) DeleteFile(path string) error {
+	return p.client().Remove(path)
+}
+
+// MakeDir does nothing if the directory exists, the servers fail to create it.
+func (p *producer) MakeDir(path string) error {
+	err := p.client().Mkdir(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		if info, statErr := p.client().Stat(path); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+func (p *producer) DeleteDir(path string) error {
+	return p.notEmpty(path, p.client().RemoveDirectory(path))
+}
+
+func (p *producer) RemoveAll(path string) error {
+	return storage.RemoveTree(p, path)
+}
+
+func (p *producer) Stat(path string) (fs.FileInfo, error) {
+	return p.client().Stat(path)
+}
@@ -0,0 +1,229 @@
+package sftp
+
+import (
+	"bytes"
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/local"
+	"captura-backup/internal/storage/remote/sftp/sftptest"
+	"captura-backup/internal/storage/storagetest"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serverConfig returns the config of the password authentication to the server
+func serverConfig(srv *sftptest.Server) *storage.RemoteConfig {
+	return &storage.RemoteConfig{
+		Host:               srv.Host,
+		Port:               srv.Port,
+		User:               sftptest.User,
+		Password:           sftptest.Password,
+		AuthMethod:         "password",
+		HostKeyFingerprint: srv.Fingerprint(),
+		Timeout:            5,
+	}
+}
+
+// roundTrip connects to the server and writes and reads back the file
+func roundTrip(t *testing.T, c *storage.RemoteConfig) error {
+	client, err := NewClient(c)
+	if err != nil {
+		return err
+	}
+	p := NewProducer(client, c)
+	defer p.Close()
+	assert.NoError(t, p.Ping())
+
+	path := filepath.Join(t.TempDir(), "file.txt")
+	assert.NoError(t, p.SaveFile(path, io.NopCloser(strings.NewReader("data"))))
+	file, err := p.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer file.Close()
+	data, _ := io.ReadAll(file)
+	assert.Equal(t, "data", string(data))
+	return nil
+}
+
+func TestHostKeyFingerprint(t *testing.T) {
+	srv := sftptest.NewServer(t, nil)
+
+	assert.NoError(t, roundTrip(t, serverConfig(srv)))
+
+	c := serverConfig(srv)
+	c.HostKeyFingerprint = "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	assert.Error(t, roundTrip(t, c))
+}
+
+func TestKnownHosts(t *testing.T) {
+	srv := sftptest.NewServer(t, nil)
+	knownHosts := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+
+	c := serverConfig(srv)
+	c.HostKeyFingerprint = ""
+	c.KnownHostsFile = knownHosts
+	assert.Error(t, roundTrip(t, c), "the known_hosts file does not exist")
+
+	c.TrustOnFirstUse = true
+	assert.NoError(t, roundTrip(t, c), "the key is trusted on the first use")
+	data, err := os.ReadFile(knownHosts)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "[127.0.0.1]:"+srv.Port)
+
+	c.TrustOnFirstUse = false
+	assert.NoError(t, roundTrip(t, c), "the host is known")
+
+	// the other server on the same address has the changed key
+	other := sftptest.NewServer(t, nil)
+	c.Port = other.Port
+	assert.NoError(t, os.WriteFile(knownHosts, []byte(strings.Replace(string(data), srv.Port, other.Port, 1)), 0600))
+	c.TrustOnFirstUse = true
+	assert.Error(t, roundTrip(t, c), "the changed key is rejected")
+}
+
+func TestPassphraseProtectedKey(t *testing.T) {
+	// the key is encrypted by ssh-keygen with the passphrase "passphrase"
+	const keyFile = "testdata/id_ecdsa"
+	authorized, err := os.ReadFile(keyFile + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _, _, _, err := ssh.ParseAuthorizedKey(authorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := sftptest.NewServer(t, public)
+
+	c := serverConfig(srv)
+	c.AuthMethod = "key"
+	c.PrivateKeyFile = keyFile
+	assert.Error(t, roundTrip(t, c), "the passphrase is not specified")
+
+	c.PrivateKeyPassphrase = "wrong"
+	assert.Error(t, roundTrip(t, c))
+
+	c.PrivateKeyPassphrase = "passphrase"
+	assert.NoError(t, roundTrip(t, c))
+}
+
+func TestAgentAuth(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: private}))
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := sftptest.NewServer(t, signer.PublicKey())
+
+	c := serverConfig(srv)
+	c.AuthMethod = "agent"
+	c.AgentSocket = socket
+	assert.NoError(t, roundTrip(t, c))
+
+	c.AgentSocket = filepath.Join(t.TempDir(), "missing.sock")
+	assert.Error(t, roundTrip(t, c))
+}
+
+func TestResume(t *testing.T) {
+	srv := sftptest.NewServer(t, nil)
+	data := bytes.Repeat([]byte("archive data "), 400000)
+	path := filepath.Join(t.TempDir(), "archive.gz")
+
+	c := serverConfig(srv)
+	c.ResumeRetries = 2
+	// connect drops the first connections of the producer after 2 MiB
+	connect := func(drops int) storage.Producer {
+		srv.DropConnections(drops, 2<<20)
+		client, err := NewClient(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewProducer(client, c)
+	}
+
+	p := connect(2)
+	assert.NoError(t, p.SaveFile(path, io.NopCloser(io.MultiReader(bytes.NewReader(data)))))
+	written, _ := os.ReadFile(path)
+	assert.Equal(t, data, written, "the upload is resumed")
+	p.Close()
+
+	p = connect(2)
+	file, err := p.ReadFile(path)
+	if assert.NoError(t, err) {
+		read, err := io.ReadAll(file)
+		assert.NoError(t, err)
+		assert.Equal(t, data, read, "the download is resumed")
+		file.Close()
+	}
+	p.Close()
+
+	p = connect(3)
+	assert.Error(t, p.SaveFile(path, io.NopCloser(bytes.NewReader(data))), "the retries are exhausted")
+	p.Close()
+}
+
+func TestFreeSpace(t *testing.T) {
+	srv := sftptest.NewServer(t, nil)
+	c := serverConfig(srv)
+	client, err := NewClient(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProducer(client, c)
+	defer p.Close()
+
+	dir := t.TempDir()
+	free, err := p.FreeSpace(dir)
+	assert.NoError(t, err)
+	assert.True(t, free > 0)
+	// the server is on the same file system
+	local, err := local.NewProducer().FreeSpace(dir)
+	assert.NoError(t, err)
+	assert.InDelta(t, local, free, float64(local)/10)
+
+	_, err = p.FreeSpace(filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, storage.ErrFreeSpaceUnknown)
+}
+
+func TestConformance(t *testing.T) {
+	srv := sftptest.NewServer(t, nil)
+	storagetest.TestProducer(t, func(t *testing.T) (storage.Producer, string) {
+		c := serverConfig(srv)
+		client, err := NewClient(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewProducer(client, c), t.TempDir()
+	})
+}
@@ -0,0 +1,162 @@
+// Package sftptest is the in-process SSH server with the sftp subsystem on the local file system for the tests
+// of the sftp storage.
+package sftptest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	gosftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// the credentials of the password authentication
+const (
+	User     = "backup"
+	Password = "secret"
+)
+
+// Server is the SSH server with the sftp subsystem, the client is authenticated by the password
+// or by the ClientKey if it is set.
+type Server struct {
+	Host, Port string
+	HostKey    ssh.Signer
+	ClientKey  ssh.PublicKey
+
+	mu sync.Mutex
+	// the number of the next connections dropped after dropAfter bytes
+	drops     int
+	dropAfter int64
+}
+
+// NewServer starts the server on the loopback interface, it is stopped by the cleanup of the test.
+func NewServer(t *testing.T, clientKey ssh.PublicKey) *Server {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{HostKey: hostKey, ClientKey: clientKey}
+
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == User && string(password) == Password {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if srv.ClientKey != nil && bytes.Equal(key.Marshal(), srv.ClientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	cfg.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	srv.Host, srv.Port, _ = net.SplitHostPort(listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(srv.wrap(conn), cfg)
+		}
+	}()
+	return srv
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the host key.
+func (srv *Server) Fingerprint() string {
+	return ssh.FingerprintSHA256(srv.HostKey.PublicKey())
+}
+
+// DropConnections closes each of the next n connections after the limit of the read and written bytes.
+func (srv *Server) DropConnections(n int, limit int64) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.drops, srv.dropAfter = n, limit
+}
+
+func (srv *Server) wrap(conn net.Conn) net.Conn {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.drops == 0 {
+		return conn
+	}
+	srv.drops--
+	return &droppedConn{Conn: conn, limit: srv.dropAfter}
+}
+
+// droppedConn closes the connection after the limit of the read and written bytes
+type droppedConn struct {
+	net.Conn
+	limit int64
+}
+
+func (c *droppedConn) count(n int) {
+	if atomic.AddInt64(&c.limit, -int64(n)) <= 0 {
+		c.Conn.Close()
+	}
+}
+
+func (c *droppedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(n)
+	return n, err
+}
+
+func (c *droppedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count(n)
+	return n, err
+}
+
+func serveConn(conn net.Conn, cfg *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}(requests)
+		server, err := gosftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
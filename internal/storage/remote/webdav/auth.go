@@ -0,0 +1,184 @@
+package webdav
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// authenticator sets the basic or the digest authorization of the requests. The digest challenge of the server
+// is kept and reused by the next requests with the increasing nonce count.
+type authenticator struct {
+	method         string
+	user, password string
+
+	mu        sync.Mutex
+	challenge map[string]string
+	nc        int
+}
+
+func newAuthenticator(method, user, password string) (*authenticator, error) {
+	switch method {
+	case "", "password":
+		method = "basic"
+	case "basic", "digest":
+	default:
+		return nil, errors.New("[" + method + "] unsupported authentication method")
+	}
+	return &authenticator{method: method, user: user, password: password}, nil
+}
+
+// ready reports whether the request can be authorized without the challenge of the server.
+func (a *authenticator) ready() bool {
+	if a.method != "digest" {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.challenge != nil
+}
+
+func (a *authenticator) authorize(req *http.Request) error {
+	if a.user == "" && a.password == "" {
+		return nil
+	}
+	if a.method == "basic" {
+		req.SetBasicAuth(a.user, a.password)
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.challenge == nil {
+		return nil
+	}
+	a.nc++
+	header, err := digestAuthorization(a.challenge, a.user, a.password, req.Method, req.URL.RequestURI(), a.nc)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", header)
+	return nil
+}
+
+// update keeps the digest challenge of the rejected request, it reports whether the request should be repeated.
+func (a *authenticator) update(resp *http.Response) bool {
+	if a.method != "digest" || resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	for _, value := range resp.Header.Values("WWW-Authenticate") {
+		if !strings.HasPrefix(strings.ToLower(value), "digest ") {
+			continue
+		}
+		challenge := parseParams(value[len("digest "):])
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		// the new nonce is repeated, the rejected credentials of the same nonce are not
+		repeat := a.challenge == nil || a.challenge["nonce"] != challenge["nonce"] || strings.EqualFold(challenge["stale"], "true")
+		a.challenge, a.nc = challenge, 0
+		return repeat
+	}
+	return false
+}
+
+// digestAuthorization returns the Authorization header of RFC 7616 for the qop "auth" or the legacy digest without qop.
+func digestAuthorization(challenge map[string]string, user, password, method, uri string, nc int) (string, error) {
+	var newHash func() hash.Hash
+	algorithm := challenge["algorithm"]
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5", "MD5-SESS":
+		newHash = md5.New
+	case "SHA-256", "SHA-256-SESS":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("[%s] unsupported digest algorithm", algorithm)
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(nonce)
+	ha1 := h(user + ":" + challenge["realm"] + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + challenge["nonce"] + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	params := []string{
+		fmt.Sprintf(`username="%s"`, user),
+		fmt.Sprintf(`realm="%s"`, challenge["realm"]),
+		fmt.Sprintf(`nonce="%s"`, challenge["nonce"]),
+		fmt.Sprintf(`uri="%s"`, uri),
+	}
+	if algorithm != "" {
+		params = append(params, "algorithm="+algorithm)
+	}
+	qop := ""
+	for _, q := range strings.Split(challenge["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	if qop == "" {
+		params = append(params, fmt.Sprintf(`response="%s"`, h(ha1+":"+challenge["nonce"]+":"+ha2)))
+	} else {
+		count := fmt.Sprintf("%08x", nc)
+		params = append(params,
+			fmt.Sprintf(`response="%s"`, h(ha1+":"+challenge["nonce"]+":"+count+":"+cnonce+":"+qop+":"+ha2)),
+			"qop="+qop, "nc="+count, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		params = append(params, fmt.Sprintf(`opaque="%s"`, opaque))
+	}
+	return "Digest " + strings.Join(params, ", "), nil
+}
+
+// parseParams parses the comma separated parameters key=value or key="quoted value" of the challenge.
+func parseParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, " ,") {
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var quoted strings.Builder
+			end := 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' && end+1 < len(s) {
+					end++
+				}
+				quoted.WriteByte(s[end])
+			}
+			value = quoted.String()
+			if end < len(s) {
+				end++
+			}
+			s = s[end:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
@@ -0,0 +1,446 @@
+// Package webdav is the storage on the WebDAV shares, e.g. Nextcloud. The folders are created by MKCOL,
+// listed by PROPFIND and renamed by MOVE, the files are streamed by PUT and GET.
+package webdav
+
+import (
+	"captura-backup/internal/storage"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type producer struct {
+	base      *url.URL
+	client    *http.Client
+	transport *http.Transport
+	auth      *authenticator
+}
+
+// NewProducer returns the producer of the share at the URL of the config, the Timeout limits the connection
+// and the wait for the response headers, not the transfer of the files.
+func NewProducer(c *storage.RemoteConfig) (storage.Producer, error) {
+	rawURL := c.URL
+	if rawURL == "" {
+		if c.Host == "" {
+			return nil, errors.New("the url of the webdav share is not specified")
+		}
+		rawURL = "https://" + c.Host
+		if c.Port != "" {
+			rawURL = "https://" + net.JoinHostPort(c.Host, c.Port)
+		}
+	}
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("webdav url: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.New("[" + base.Scheme + "] unsupported webdav url scheme")
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+
+	auth, err := newAuthenticator(c.AuthMethod, c.User, c.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(c.Timeout) * time.Second
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	if base.Scheme == "https" {
+		cfg := *c
+		cfg.Host = base.Hostname()
+		if transport.TLSClientConfig, err = storage.NewTLSConfig(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	return &producer{
+		base:      base,
+		client:    &http.Client{Transport: transport},
+		transport: transport,
+		auth:      auth,
+	}, nil
+}
+
+// statusError is the unexpected status of the response, the status of the missing path
+// (or its parent) is converted to fs.ErrNotExist.
+type statusError struct {
+	method string
+	path   string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("webdav %s %s: %d %s", e.method, e.path, e.code, http.StatusText(e.code))
+}
+
+func (e *statusError) Unwrap() error {
+	switch e.code {
+	case http.StatusNotFound, http.StatusGone, http.StatusConflict:
+		return fs.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fs.ErrPermission
+	}
+	return nil
+}
+
+// Temporary reports the errors of the overloaded or unavailable server.
+func (e *statusError) Temporary() bool {
+	switch e.code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (p *producer) url(name string) *url.URL {
+	u := *p.base
+	u.Path = path.Join("/", p.base.Path, name)
+	return &u
+}
+
+// do sends the request and returns the response with one of the expected statuses. The streamed body is read once,
+// so the digest challenge is requested before the first request with the body, the body io.Seeker is repeated
+// after the new challenge.
+func (p *producer) do(method, name string, header http.Header, body io.Reader, expected ...int) (*http.Response, error) {
+	if body != nil && !p.auth.ready() {
+		resp, err := p.do(http.MethodOptions, "/", nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+	}
+	for {
+		req, err := http.NewRequest(method, p.url(name).String(), body)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if err := p.auth.authorize(req); err != nil {
+			return nil, err
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if p.auth.update(resp) && rewind(body) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			continue
+		}
+		for _, code := range expected {
+			if resp.StatusCode == code {
+				return resp, nil
+			}
+		}
+		if len(expected) == 0 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, &statusError{method: method, path: name, code: resp.StatusCode}
+	}
+}
+
+func rewind(body io.Reader) bool {
+	if body == nil || body == http.NoBody {
+		return true
+	}
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return false
+	}
+	_, err := seeker.Seek(0, io.SeekStart)
+	return err == nil
+}
+
+// Ping checks that the server supports WebDAV by the DAV header of the OPTIONS response.
+func (p *producer) Ping() error {
+	resp, err := p.do(http.MethodOptions, "/", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.Header.Get("DAV") == "" {
+		return fmt.Errorf("no DAV header: %w", storage.ErrUnsupportedServer)
+	}
+	return nil
+}
+
+// FreeSpace uses the quota-available-bytes property of RFC 4331, the servers return the negative value
+// if the quota is unknown or not limited.
+func (p *producer) FreeSpace(name string) (int64, error) {
+	responses, err := p.propfind(name, "0", "<D:quota-available-bytes/>")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", err, storage.ErrFreeSpaceUnknown)
+	}
+	free, err := strconv.ParseInt(responses[0].prop().QuotaAvailable, 10, 64)
+	if err != nil || free < 0 {
+		return 0, storage.ErrFreeSpaceUnknown
+	}
+	return free, nil
+}
+
+func (p *producer) Close() error {
+	p.transport.CloseIdleConnections()
+	return nil
+}
+
+type multistatus struct {
+	Responses []response `xml:"DAV: response"`
+}
+
+type response struct {
+	Href      string `xml:"DAV: href"`
+	Propstats []struct {
+		Prop   prop   `xml:"DAV: prop"`
+		Status string `xml:"DAV: status"`
+	} `xml:"DAV: propstat"`
+}
+
+type prop struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength  string `xml:"DAV: getcontentlength"`
+	LastModified   string `xml:"DAV: getlastmodified"`
+	QuotaAvailable string `xml:"DAV: quota-available-bytes"`
+}
+
+// prop returns the found properties, the missing ones are in the propstat with the status 404.
+func (r *response) prop() prop {
+	for _, propstat := range r.Propstats {
+		if fields := strings.Fields(propstat.Status); len(fields) > 1 && fields[1] == "200" {
+			return propstat.Prop
+		}
+	}
+	return prop{}
+}
+
+// path returns the unescaped path of the href without the trailing slash.
+func (r *response) path() string {
+	href, err := url.Parse(r.Href)
+	if err != nil {
+		return r.Href
+	}
+	return strings.TrimSuffix(href.Path, "/")
+}
+
+func (r *response) fileInfo(name string) fs.FileInfo {
+	prop := r.prop()
+	info := fileInfo{name: name, dir: prop.ResourceType.Collection != nil}
+	info.size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+	info.modTime, _ = http.ParseTime(prop.LastModified)
+	return info
+}
+
+// propfind returns the properties of the path (depth 0) or of the path and its children (depth 1), the path is the first.
+func (p *producer) propfind(name, depth, props string) ([]response, error) {
+	body := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop>` + props + `</D:prop></D:propfind>`
+	header := http.Header{
+		"Depth":        {depth},
+		"Content-Type": {`application/xml; charset="utf-8"`},
+	}
+	resp, err := p.do("PROPFIND", name, header, strings.NewReader(body), http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav PROPFIND %s: %w", name, err)
+	}
+	self := strings.TrimSuffix(p.url(name).Path, "/")
+	for i, r := range ms.Responses {
+		if r.path() == self {
+			ms.Responses[0], ms.Responses[i] = ms.Responses[i], ms.Responses[0]
+			return ms.Responses, nil
+		}
+	}
+	return nil, fmt.Errorf("webdav PROPFIND %s: no response of the path", name)
+}
+
+const fileProps = "<D:resourcetype/><D:getcontentlength/><D:getlastmodified/>"
+
+func (p *producer) Stat(name string) (fs.FileInfo, error) {
+	responses, err := p.propfind(name, "0", fileProps)
+	if err != nil {
+		return nil, err
+	}
+	return responses[0].fileInfo(path.Base(name)), nil
+}
+
+func (p *producer) ReadFile(name string) (io.ReadCloser, error) {
+	resp, err := p.do(http.MethodGet, name, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// SaveFile streams the file by PUT with the chunked transfer encoding.
+func (p *producer) SaveFile(name string, reader io.ReadCloser) error {
+	var body io.Reader = http.NoBody
+	if reader != nil {
+		body = reader
+	}
+	resp, err := p.do(http.MethodPut, name, nil, body, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (p *producer) DeleteFile(name string) error {
+	return p.Remove(name)
+}
+
+// MakeDir creates the folder by MKCOL, the server rejects it with 405 if the path exists.
+func (p *producer) MakeDir(name string) error {
+	resp, err := p.do("MKCOL", name, nil, nil, http.StatusCreated)
+	if err == nil {
+		return resp.Body.Close()
+	}
+	var status *statusError
+	if errors.As(err, &status) && status.code == http.StatusMethodNotAllowed {
+		if info, statErr := p.Stat(name); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.EEXIST}
+	}
+	return err
+}
+
+func (p *producer) ReadDir(name string) ([]fs.FileInfo, error) {
+	responses, err := p.propfind(name, "1", fileProps)
+	if err != nil {
+		return nil, err
+	}
+	if responses[0].prop().ResourceType.Collection == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	infos := make([]fs.FileInfo, 0, len(responses)-1)
+	for _, r := range responses[1:] {
+		infos = append(infos, r.fileInfo(path.Base(r.path())))
+	}
+	return infos, nil
+}
+
+func (p *producer) DeleteDir(name string) error {
+	return p.Remove(name)
+}
+
+func (p *producer) MakedirAll(name string) error {
+	info, err := p.Stat(name)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if parent := path.Dir(path.Clean("/" + name)); parent != "/" {
+		if err := p.MakedirAll(parent); err != nil {
+			return err
+		}
+	}
+	return p.MakeDir(name)
+}
+
+// Rename moves the file or the folder by MOVE, the existing file is overwritten.
+func (p *producer) Rename(oldname, newname string) error {
+	header := http.Header{
+		"Destination": {p.url(newname).String()},
+		"Overwrite":   {"T"},
+	}
+	resp, err := p.do("MOVE", oldname, header, nil, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		// some servers reject the move of the missing path as forbidden
+		if _, statErr := p.Stat(oldname); errors.Is(statErr, fs.ErrNotExist) {
+			return statErr
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Remove checks that the folder is empty, DELETE of the collection removes it with all children.
+func (p *producer) Remove(name string) error {
+	responses, err := p.propfind(name, "1", "<D:resourcetype/>")
+	if err != nil {
+		return err
+	}
+	if len(responses) > 1 {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	resp, err := p.do(http.MethodDelete, name, nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (p *producer) RemoveAll(name string) error {
+	resp, err := p.do(http.MethodDelete, name, nil, nil, http.StatusOK, http.StatusNoContent)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i fileInfo) Name() string {
+	return i.name
+}
+
+func (i fileInfo) Size() int64 {
+	return i.size
+}
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0700
+	}
+	return 0600
+}
+
+func (i fileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i fileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i fileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,183 @@
+package webdav
+
+import (
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/storagetest"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	testUser     = "backup"
+	testPassword = "secret"
+	testPrefix   = "/remote.php/dav/files/backup"
+	testRealm    = "captura"
+	testNonce    = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+)
+
+// newHandler returns the in-memory webdav share under the testPrefix
+func newHandler() http.Handler {
+	return &webdav.Handler{
+		Prefix:     testPrefix,
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// basicAuth checks the basic authorization of the requests
+func basicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != testUser || password != testPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+testRealm+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// digestAuth checks the digest authorization with the qop "auth" of the requests
+func digestAuth(next http.Handler) http.Handler {
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if strings.HasPrefix(header, "Digest ") {
+			params := parseParams(header[len("Digest "):])
+			ha1 := md5hex(testUser + ":" + testRealm + ":" + testPassword)
+			ha2 := md5hex(r.Method + ":" + r.URL.RequestURI())
+			expected := md5hex(ha1 + ":" + testNonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+			if params["username"] == testUser && params["nonce"] == testNonce && params["uri"] == r.URL.RequestURI() &&
+				params["opaque"] == "opaque" && params["response"] == expected {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", opaque="opaque"`, testRealm, testNonce))
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+}
+
+func newProducer(t *testing.T, c *storage.RemoteConfig) storage.Producer {
+	p, err := NewProducer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func config(url, authMethod string) *storage.RemoteConfig {
+	return &storage.RemoteConfig{
+		URL:        url + testPrefix,
+		AuthMethod: authMethod,
+		User:       testUser,
+		Password:   testPassword,
+		Timeout:    5,
+	}
+}
+
+// roundTrip pings the server, creates the folder and writes and reads back the file
+func roundTrip(t *testing.T, c *storage.RemoteConfig) error {
+	p, err := NewProducer(c)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	if err := p.Ping(); err != nil {
+		return err
+	}
+	if err := p.MakeDir("/archive"); err != nil {
+		return err
+	}
+	if err := p.SaveFile("/archive/file.gz", io.NopCloser(strings.NewReader("archive data"))); err != nil {
+		return err
+	}
+	file, err := p.ReadFile("/archive/file.gz")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	assert.Equal(t, "archive data", string(data))
+	return err
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.TestProducer(t, func(t *testing.T) (storage.Producer, string) {
+		srv := httptest.NewServer(basicAuth(newHandler()))
+		t.Cleanup(srv.Close)
+		return newProducer(t, config(srv.URL, "basic")), "/"
+	})
+}
+
+func TestBasicAuth(t *testing.T) {
+	srv := httptest.NewServer(basicAuth(newHandler()))
+	defer srv.Close()
+
+	assert.NoError(t, roundTrip(t, config(srv.URL, "basic")))
+
+	c := config(srv.URL, "basic")
+	c.Password = "wrong"
+	assert.ErrorIs(t, roundTrip(t, c), fs.ErrPermission)
+}
+
+func TestDigestAuth(t *testing.T) {
+	srv := httptest.NewServer(digestAuth(newHandler()))
+	defer srv.Close()
+
+	assert.NoError(t, roundTrip(t, config(srv.URL, "digest")))
+
+	c := config(srv.URL, "digest")
+	c.Password = "wrong"
+	assert.ErrorIs(t, roundTrip(t, c), fs.ErrPermission)
+
+	c.AuthMethod = "unknown"
+	assert.Error(t, roundTrip(t, c))
+}
+
+func TestTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(basicAuth(newHandler()))
+	defer srv.Close()
+
+	c := config(srv.URL, "basic")
+	assert.Error(t, roundTrip(t, c), "the self-signed certificate is not trusted")
+
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	c.TLSFingerprint = hex.EncodeToString(sum[:])
+	assert.NoError(t, roundTrip(t, c))
+
+	c.TLSFingerprint = strings.Repeat("00", sha256.Size)
+	assert.Error(t, roundTrip(t, c))
+}
+
+func TestPing(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	p := newProducer(t, config(srv.URL, ""))
+	assert.Error(t, p.Ping(), "the server is not webdav")
+}
+
+func TestFreeSpace(t *testing.T) {
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	// the server does not report the quota
+	p := newProducer(t, config(srv.URL, ""))
+	_, err := p.FreeSpace("/")
+	assert.ErrorIs(t, err, storage.ErrFreeSpaceUnknown)
+}
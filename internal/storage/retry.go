@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// RetryMetrics counts the retries of the operations of the storages by the keys "<operation>.retries",
+// "<operation>.recovered" (succeeded after the retries) and "<operation>.failed" (the retries are exhausted).
+var RetryMetrics = expvar.NewMap("storage_retries")
+
+// RetryConfig is the retry policy of the idempotent operations. The delay before the n-th retry is
+// Delay*2^(n-1) limited by the MaxDelay, it is randomized by the jitter in the range [delay/2, delay].
+type RetryConfig struct {
+	// Attempts is the number of the attempts of the operation, 1 or less disables the retries
+	Attempts int
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// NoSaveRetry and NoReadRetry turn off the retries of SaveFile and ReadFile, e.g. if the producer resumes
+	// the interrupted transfers itself, so the retries are not multiplied by the resumes
+	NoSaveRetry bool
+	NoReadRetry bool
+	// OnRetry is called before the retry of the failed operation
+	OnRetry func(op, path string, attempt int, delay time.Duration, err error)
+}
+
+// Rewinder is the source of SaveFile which can be read again from the start, e.g. to retry the upload.
+type Rewinder interface {
+	Rewind() error
+}
+
+// WithRetry wraps the producer, so the idempotent operations Stat, ReadDir, MakeDir, ReadFile and SaveFile
+// are retried after the retryable errors. SaveFile is retried only if its source is a Rewinder or an io.Seeker.
+// The wait before the retry is stopped by the context, the last error is returned then.
+func WithRetry(ctx context.Context, p Producer, c RetryConfig) Producer {
+	if c.Attempts <= 1 {
+		return p
+	}
+	return &retrier{Producer: p, ctx: ctx, c: c}
+}
+
+type retrier struct {
+	Producer
+	ctx context.Context
+	c   RetryConfig
+}
+
+// Retryable reports whether the error is transient, e.g. the lost connection or the timeout.
+// The errors of the files and the unsupported server are permanent.
+func Retryable(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, fs.ErrNotExist),
+		errors.Is(err, fs.ErrExist),
+		errors.Is(err, fs.ErrPermission),
+		errors.Is(err, ErrUnsupportedServer),
+		errors.Is(err, ErrPoolClosed):
+		return false
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ETIMEDOUT),
+		errors.Is(err, sftp.ErrSSHFxConnectionLost):
+		return true
+	}
+	// the network errors and the ftp replies 4xx
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) {
+		return temporary.Temporary()
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) {
+		return timeout.Timeout()
+	}
+	return strings.Contains(err.Error(), "connection lost")
+}
+
+// delay returns the randomized delay before the retry.
+func (r *retrier) delay(attempt int) time.Duration {
+	delay := r.c.Delay << uint(attempt-1)
+	if delay > r.c.MaxDelay || delay <= 0 {
+		delay = r.c.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// do runs the operation up to Attempts times while its error is retryable, before each retry
+// the rewind is called if it is not nil.
+func (r *retrier) do(op, path string, rewind func() error, f func() error) error {
+	err := f()
+	for attempt := 1; err != nil && Retryable(err); attempt++ {
+		if attempt >= r.c.Attempts {
+			RetryMetrics.Add(op+".failed", 1)
+			return err
+		}
+		delay := r.delay(attempt)
+		RetryMetrics.Add(op+".retries", 1)
+		if r.c.OnRetry != nil {
+			r.c.OnRetry(op, path, attempt, delay, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			timer.Stop()
+			RetryMetrics.Add(op+".failed", 1)
+			return err
+		}
+
+		if rewind != nil {
+			if rewindErr := rewind(); rewindErr != nil {
+				return err
+			}
+		}
+		if err = f(); err == nil {
+			RetryMetrics.Add(op+".recovered", 1)
+		}
+	}
+	return err
+}
+
+func (r *retrier) Stat(path string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := r.do("Stat", path, nil, func() (err error) {
+		info, err = r.Producer.Stat(path)
+		return err
+	})
+	return info, err
+}
+
+func (r *retrier) ReadDir(path string) ([]fs.FileInfo, error) {
+	var infos []fs.FileInfo
+	err := r.do("ReadDir", path, nil, func() (err error) {
+		infos, err = r.Producer.ReadDir(path)
+		return err
+	})
+	return infos, err
+}
+
+func (r *retrier) MakeDir(path string) error {
+	return r.do("MakeDir", path, nil, func() error {
+		return r.Producer.MakeDir(path)
+	})
+}
+
+// ReadFile retries the opening of the file, the errors of the reading are returned by the reader.
+func (r *retrier) ReadFile(path string) (io.ReadCloser, error) {
+	if r.c.NoReadRetry {
+		return r.Producer.ReadFile(path)
+	}
+	var file io.ReadCloser
+	err := r.do("ReadFile", path, nil, func() (err error) {
+		file, err = r.Producer.ReadFile(path)
+		return err
+	})
+	return file, err
+}
+
+func (r *retrier) SaveFile(path string, reader io.ReadCloser) error {
+	if r.c.NoSaveRetry {
+		return r.Producer.SaveFile(path, reader)
+	}
+	var rewind func() error
+	switch source := reader.(type) {
+	case Rewinder:
+		rewind = source.Rewind
+	case io.Seeker:
+		start, err := source.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return r.Producer.SaveFile(path, reader)
+		}
+		rewind = func() error {
+			_, err := source.Seek(start, io.SeekStart)
+			return err
+		}
+	default:
+		return r.Producer.SaveFile(path, reader)
+	}
+	return r.do("SaveFile", path, rewind, func() error {
+		return r.Producer.SaveFile(path, reader)
+	})
+}
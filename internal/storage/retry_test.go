@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"bytes"
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/local"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyProducer fails the operations with the errors before the success
+type flakyProducer struct {
+	storage.Producer
+	errs  []error
+	calls int
+}
+
+func (p *flakyProducer) fail() error {
+	p.calls++
+	if len(p.errs) == 0 {
+		return nil
+	}
+	err := p.errs[0]
+	p.errs = p.errs[1:]
+	return err
+}
+
+func (p *flakyProducer) Stat(path string) (fs.FileInfo, error) {
+	if err := p.fail(); err != nil {
+		return nil, err
+	}
+	return p.Producer.Stat(path)
+}
+
+func (p *flakyProducer) SaveFile(path string, reader io.ReadCloser) error {
+	if err := p.fail(); err != nil {
+		// the part of the data is read before the failure
+		reader.Read(make([]byte, 2))
+		return err
+	}
+	return p.Producer.SaveFile(path, reader)
+}
+
+type seekCloser struct {
+	*bytes.Reader
+}
+
+func (seekCloser) Close() error {
+	return nil
+}
+
+func retryConfig(retries *int) storage.RetryConfig {
+	return storage.RetryConfig{
+		Attempts: 3,
+		Delay:    time.Millisecond,
+		MaxDelay: 5 * time.Millisecond,
+		OnRetry: func(op, path string, attempt int, delay time.Duration, err error) {
+			*retries++
+		},
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, storage.Retryable(&net.OpError{Op: "read", Err: syscall.ECONNRESET}))
+	assert.True(t, storage.Retryable(fmt.Errorf("save file: %w", io.ErrUnexpectedEOF)))
+	assert.False(t, storage.Retryable(fmt.Errorf("stat: %w", fs.ErrNotExist)))
+	assert.False(t, storage.Retryable(os.ErrPermission))
+	assert.False(t, storage.Retryable(storage.ErrUnsupportedServer))
+	assert.False(t, storage.Retryable(nil))
+}
+
+func TestRetry(t *testing.T) {
+	dir := t.TempDir()
+	var retries int
+	flaky := &flakyProducer{Producer: local.NewProducer()}
+	p := storage.WithRetry(context.Background(), flaky, retryConfig(&retries))
+	recovered := storage.RetryMetrics.Get("Stat.recovered")
+
+	flaky.errs = []error{syscall.ECONNRESET, io.ErrUnexpectedEOF}
+	_, err := p.Stat(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, flaky.calls)
+	assert.Equal(t, 2, retries)
+	assert.NotEqual(t, recovered, storage.RetryMetrics.Get("Stat.recovered"))
+
+	flaky.calls, retries = 0, 0
+	flaky.errs = []error{syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET}
+	_, err = p.Stat(dir)
+	assert.Error(t, err, "the attempts are exhausted")
+	assert.Equal(t, 3, flaky.calls)
+
+	flaky.calls, retries = 0, 0
+	flaky.errs = []error{fs.ErrPermission}
+	_, err = p.Stat(dir)
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.Equal(t, 1, flaky.calls, "the permanent error is not retried")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := retryConfig(&retries)
+	c.Delay, c.MaxDelay = time.Hour, time.Hour
+	flaky.calls = 0
+	flaky.errs = []error{syscall.ECONNRESET}
+	_, err = storage.WithRetry(ctx, flaky, c).Stat(dir)
+	assert.ErrorIs(t, err, syscall.ECONNRESET, "the wait for the retry is stopped by the context")
+	assert.Equal(t, 1, flaky.calls)
+}
+
+func TestRetrySaveFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.gz")
+	var retries int
+	flaky := &flakyProducer{Producer: local.NewProducer()}
+	p := storage.WithRetry(context.Background(), flaky, retryConfig(&retries))
+
+	flaky.errs = []error{syscall.EPIPE}
+	assert.NoError(t, p.SaveFile(path, seekCloser{bytes.NewReader([]byte("archive data"))}))
+	assert.Equal(t, 2, flaky.calls)
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, "archive data", string(data), "the source is read again from the start")
+
+	flaky.calls = 0
+	flaky.errs = []error{syscall.EPIPE}
+	assert.Error(t, p.SaveFile(path, io.NopCloser(strings.NewReader("archive data"))))
+	assert.Equal(t, 1, flaky.calls, "the source which can not be read again is not retried")
+
+	c := retryConfig(&retries)
+	c.NoSaveRetry = true
+	flaky.calls = 0
+	flaky.errs = []error{syscall.EPIPE}
+	assert.Error(t, storage.WithRetry(context.Background(), flaky, c).SaveFile(path, seekCloser{bytes.NewReader([]byte("archive data"))}))
+	assert.Equal(t, 1, flaky.calls, "the transfer resumed by the producer is not retried")
+}
@@ -0,0 +1,244 @@
+// Package storagetest is the conformance suite of the storage producers, every producer must behave as the local file system.
+package storagetest
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"captura-backup/internal/storage"
+)
+
+// NewProducer returns the producer under the test and the existing empty folder for the files of the test.
+type NewProducer func(t *testing.T) (p storage.Producer, root string)
+
+// TestProducer runs the conformance tests, each test gets the new producer and the new folder.
+func TestProducer(t *testing.T, newProducer NewProducer) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, p storage.Producer, root string)
+	}{
+		{"MissingPath", testMissingPath},
+		{"SaveFile", testSaveFile},
+		{"MakeDir", testMakeDir},
+		{"MakedirAll", testMakedirAll},
+		{"ReadDir", testReadDir},
+		{"Remove", testRemove},
+		{"Rename", testRename},
+		{"RemoveAll", testRemoveAll},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, root := newProducer(t)
+			defer p.Close()
+			tt.test(t, p, root)
+		})
+	}
+}
+
+func save(t *testing.T, p storage.Producer, name, data string) {
+	t.Helper()
+	if err := p.SaveFile(name, io.NopCloser(strings.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mkdir(t *testing.T, p storage.Producer, name string) {
+	t.Helper()
+	if err := p.MakedirAll(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(t *testing.T, p storage.Producer, name string) string {
+	t.Helper()
+	file, err := p.ReadFile(name)
+	if !assert.NoError(t, err, name) {
+		return ""
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	assert.NoError(t, err, name)
+	return string(data)
+}
+
+func exists(t *testing.T, p storage.Producer, name string) bool {
+	t.Helper()
+	_, err := p.Stat(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func names(infos []fs.FileInfo) []string {
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func testMissingPath(t *testing.T, p storage.Producer, root string) {
+	missing := path.Join(root, "missing")
+
+	_, err := p.Stat(missing)
+	assert.ErrorIs(t, err, fs.ErrNotExist, "Stat")
+	_, err = p.ReadFile(missing)
+	assert.ErrorIs(t, err, fs.ErrNotExist, "ReadFile")
+	_, err = p.ReadDir(missing)
+	assert.ErrorIs(t, err, fs.ErrNotExist, "ReadDir")
+	assert.ErrorIs(t, p.Remove(missing), fs.ErrNotExist, "Remove")
+	assert.ErrorIs(t, p.DeleteFile(missing), fs.ErrNotExist, "DeleteFile")
+	assert.ErrorIs(t, p.DeleteDir(missing), fs.ErrNotExist, "DeleteDir")
+	assert.ErrorIs(t, p.Rename(missing, path.Join(root, "renamed")), fs.ErrNotExist, "Rename")
+	assert.ErrorIs(t, p.MakeDir(path.Join(missing, "dir")), fs.ErrNotExist, "MakeDir without the parent")
+	assert.NoError(t, p.RemoveAll(missing), "RemoveAll")
+}
+
+func testSaveFile(t *testing.T, p storage.Producer, root string) {
+	name := path.Join(root, "file.gz")
+	save(t, p, name, "the first version of the file")
+	save(t, p, name, "overwritten")
+	assert.Equal(t, "overwritten", read(t, p, name), "the file is truncated")
+
+	info, err := p.Stat(name)
+	if assert.NoError(t, err) {
+		assert.False(t, info.IsDir())
+		assert.Equal(t, "file.gz", info.Name())
+		assert.EqualValues(t, len("overwritten"), info.Size())
+	}
+
+	empty := path.Join(root, "empty")
+	assert.NoError(t, p.SaveFile(empty, nil), "the nil reader creates the empty file")
+	assert.Equal(t, "", read(t, p, empty))
+}
+
+func testMakeDir(t *testing.T, p storage.Producer, root string) {
+	dir := path.Join(root, "dir")
+	assert.NoError(t, p.MakeDir(dir))
+	assert.NoError(t, p.MakeDir(dir), "the existing folder is not an error")
+
+	info, err := p.Stat(dir)
+	if assert.NoError(t, err) {
+		assert.True(t, info.IsDir())
+		// the servers not reporting the permissions have the zero mode
+		if perm := info.Mode().Perm(); perm != 0 {
+			assert.Equal(t, fs.FileMode(0700), perm&0700, "the owner has the full access")
+		}
+	}
+
+	file := path.Join(root, "file")
+	save(t, p, file, "data")
+	assert.Error(t, p.MakeDir(file), "the file is not a folder")
+}
+
+func testMakedirAll(t *testing.T, p storage.Producer, root string) {
+	dir := path.Join(root, "a", "b", "c")
+	assert.NoError(t, p.MakedirAll(dir))
+	assert.NoError(t, p.MakedirAll(dir), "the existing folder is not an error")
+
+	for _, name := range []string{path.Join(root, "a"), path.Join(root, "a", "b"), dir} {
+		info, err := p.Stat(name)
+		if assert.NoError(t, err, name) {
+			assert.True(t, info.IsDir(), name)
+			if perm := info.Mode().Perm(); perm != 0 {
+				assert.Equal(t, fs.FileMode(0700), perm&0700, "the owner has the full access to %s", name)
+			}
+		}
+	}
+	save(t, p, path.Join(dir, "file"), "data")
+
+	file := path.Join(root, "file")
+	save(t, p, file, "data")
+	assert.Error(t, p.MakedirAll(file), "the file is not a folder")
+	assert.Error(t, p.MakedirAll(path.Join(file, "dir")), "the path contains the file")
+}
+
+func testReadDir(t *testing.T, p storage.Producer, root string) {
+	mkdir(t, p, path.Join(root, "dir", "sub"))
+	save(t, p, path.Join(root, "dir", "file1"), "1")
+	save(t, p, path.Join(root, "dir", "file2"), "22")
+
+	infos, err := p.ReadDir(path.Join(root, "dir"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file1", "file2", "sub"}, names(infos))
+	for _, info := range infos {
+		assert.Equal(t, info.Name() == "sub", info.IsDir(), info.Name())
+		if info.Name() == "file2" {
+			assert.EqualValues(t, 2, info.Size())
+		}
+	}
+
+	infos, err = p.ReadDir(path.Join(root, "dir", "sub"))
+	assert.NoError(t, err)
+	assert.Empty(t, infos)
+}
+
+func testRemove(t *testing.T, p storage.Producer, root string) {
+	dir := path.Join(root, "dir")
+	file := path.Join(dir, "file")
+	mkdir(t, p, dir)
+	save(t, p, file, "data")
+
+	err := p.Remove(dir)
+	assert.ErrorIs(t, err, fs.ErrExist, "the folder is not empty")
+	assert.False(t, storage.Retryable(err), "the error is permanent")
+	assert.True(t, exists(t, p, file), "the files of the folder are kept")
+	assert.ErrorIs(t, p.DeleteDir(dir), fs.ErrExist, "the folder is not empty")
+
+	assert.NoError(t, p.Remove(file))
+	assert.False(t, exists(t, p, file))
+	assert.NoError(t, p.Remove(dir), "the empty folder is removed")
+	assert.False(t, exists(t, p, dir))
+
+	mkdir(t, p, dir)
+	save(t, p, file, "data")
+	assert.NoError(t, p.DeleteFile(file))
+	assert.NoError(t, p.DeleteDir(dir))
+	assert.False(t, exists(t, p, dir))
+}
+
+func testRename(t *testing.T, p storage.Producer, root string) {
+	oldname, newname := path.Join(root, "old"), path.Join(root, "new")
+	save(t, p, oldname, "new data")
+	save(t, p, newname, "old data")
+
+	assert.NoError(t, p.Rename(oldname, newname), "the existing file is replaced")
+	assert.False(t, exists(t, p, oldname))
+	assert.Equal(t, "new data", read(t, p, newname))
+
+	dir := path.Join(root, "dir")
+	mkdir(t, p, path.Join(dir, "sub"))
+	save(t, p, path.Join(dir, "sub", "file"), "data")
+	assert.NoError(t, p.Rename(dir, path.Join(root, "moved")), "the folder is moved with the files")
+	assert.False(t, exists(t, p, dir))
+	assert.Equal(t, "data", read(t, p, path.Join(root, "moved", "sub", "file")))
+}
+
+func testRemoveAll(t *testing.T, p storage.Producer, root string) {
+	tree := path.Join(root, "tree")
+	dir := tree
+	for i := 0; i < 5; i++ {
+		dir = path.Join(dir, "level")
+		mkdir(t, p, path.Join(dir, "empty"))
+		save(t, p, path.Join(dir, "file1"), "1")
+		save(t, p, path.Join(dir, "file2"), "2")
+	}
+	save(t, p, path.Join(root, "kept"), "data")
+
+	assert.NoError(t, p.RemoveAll(tree))
+	assert.False(t, exists(t, p, tree))
+	assert.True(t, exists(t, p, path.Join(root, "kept")), "the neighbours are kept")
+
+	file := path.Join(root, "kept")
+	assert.NoError(t, p.RemoveAll(file), "the file is removed")
+	assert.False(t, exists(t, p, file))
+}
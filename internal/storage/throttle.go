@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is the limit of the transfer in bytes per second by the time of day,
+// the Default limit applies out of the periods. The zero limit means no limit.
+type Rate struct {
+	Default int64
+	Periods []RatePeriod
+}
+
+// RatePeriod is the limit of the period of the day, the period can cross midnight.
+type RatePeriod struct {
+	From, To time.Duration // since midnight
+	Limit    int64
+}
+
+// ParseRate parses the rate "<limit>[, <HH:MM>-<HH:MM> <limit>]..." with the limits in KB/s,
+// e.g. "8192, 08:00-19:00 1024" limits the transfer to 1 MB/s during the business hours and to 8 MB/s out of them.
+func ParseRate(s string) (Rate, error) {
+	var rate Rate
+	for i, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if i == 0 {
+			if part == "" {
+				continue
+			}
+			limit, err := strconv.ParseInt(part, 10, 64)
+			if err != nil || limit < 0 {
+				return rate, fmt.Errorf("wrong limit %q", part)
+			}
+			rate.Default = limit << 10
+			continue
+		}
+		fields := strings.Fields(part)
+		if len(fields) != 2 {
+			return rate, fmt.Errorf("wrong period %q, expected <HH:MM>-<HH:MM> <limit>", part)
+		}
+		hours := strings.Split(fields[0], "-")
+		if len(hours) != 2 {
+			return rate, fmt.Errorf("wrong period %q, expected <HH:MM>-<HH:MM> <limit>", part)
+		}
+		var (
+			period RatePeriod
+			err    error
+		)
+		if period.From, err = parseClock(hours[0]); err != nil {
+			return rate, err
+		}
+		if period.To, err = parseClock(hours[1]); err != nil {
+			return rate, err
+		}
+		if period.Limit, err = strconv.ParseInt(fields[1], 10, 64); err != nil || period.Limit < 0 {
+			return rate, fmt.Errorf("wrong limit %q", fields[1])
+		}
+		period.Limit <<= 10
+		rate.Periods = append(rate.Periods, period)
+	}
+	return rate, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("wrong time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// At returns the limit at the time.
+func (r Rate) At(t time.Time) int64 {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, p := range r.Periods {
+		if p.From <= p.To && clock >= p.From && clock < p.To ||
+			p.From > p.To && (clock >= p.From || clock < p.To) {
+			return p.Limit
+		}
+	}
+	return r.Default
+}
+
+// Unlimited reports whether the rate does not limit the transfer at any time.
+func (r Rate) Unlimited() bool {
+	if r.Default != 0 {
+		return false
+	}
+	for _, p := range r.Periods {
+		if p.Limit != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Limiter is the token bucket of the transfer rate, it is shared by the transfers limited together.
+type Limiter struct {
+	rate Rate
+	now  func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate Rate) *Limiter {
+	return &Limiter{rate: rate, now: time.Now}
+}
+
+// Wait blocks until n bytes can be transferred. The burst is the limit of one second.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := l.now()
+	limit := float64(l.rate.At(now))
+	if limit == 0 {
+		l.tokens, l.last = 0, now
+		l.mu.Unlock()
+		return
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * limit
+	}
+	if l.tokens > limit {
+		l.tokens = limit
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / limit * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttleChunk is the maximum size of one read of the throttled reader, so the transfer is smooth
+const throttleChunk = 32 << 10
+
+type throttledReader struct {
+	io.ReadCloser
+	limiters []*Limiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	for _, l := range r.limiters {
+		l.Wait(n)
+	}
+	return n, err
+}
+
+// WithThrottle wraps the producer, so SaveFile and ReadFile transfer the data with the rate of all upload
+// and download limiters respectively. The nil limiters are skipped.
+func WithThrottle(p Producer, upload, download []*Limiter) Producer {
+	upload, download = activeLimiters(upload), activeLimiters(download)
+	if len(upload) == 0 && len(download) == 0 {
+		return p
+	}
+	return &throttled{Producer: p, upload: upload, download: download}
+}
+
+func activeLimiters(limiters []*Limiter) []*Limiter {
+	var active []*Limiter
+	for _, l := range limiters {
+		if l != nil && !l.rate.Unlimited() {
+			active = append(active, l)
+		}
+	}
+	return active
+}
+
+type throttled struct {
+	Producer
+	upload, download []*Limiter
+}
+
+func (t *throttled) SaveFile(path string, reader io.ReadCloser) error {
+	if reader == nil || len(t.upload) == 0 {
+		return t.Producer.SaveFile(path, reader)
+	}
+	return t.Producer.SaveFile(path, &throttledReader{reader, t.upload})
+}
+
+func (t *throttled) ReadFile(path string) (io.ReadCloser, error) {
+	file, err := t.Producer.ReadFile(path)
+	if err != nil || len(t.download) == 0 {
+		return file, err
+	}
+	return &throttledReader{file, t.download}, nil
+}
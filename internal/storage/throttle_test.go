@@ -0,0 +1,60 @@
+package storage_test
+
+import (
+	"bytes"
+	"captura-backup/internal/storage"
+	"captura-backup/internal/storage/local"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRate(t *testing.T) {
+	rate, err := storage.ParseRate("8192, 08:00-19:00 1024, 22:00-06:00 0")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8192<<10), rate.Default)
+
+	day := time.Date(2021, 3, 1, 0, 0, 0, 0, time.Local)
+	assert.Equal(t, int64(1024<<10), rate.At(day.Add(12*time.Hour)), "the business hours")
+	assert.Equal(t, int64(8192<<10), rate.At(day.Add(20*time.Hour)))
+	assert.Equal(t, int64(0), rate.At(day.Add(23*time.Hour)), "the period crosses midnight")
+	assert.Equal(t, int64(0), rate.At(day.Add(5*time.Hour)))
+	assert.False(t, rate.Unlimited())
+
+	rate, err = storage.ParseRate("")
+	assert.NoError(t, err)
+	assert.True(t, rate.Unlimited())
+
+	for _, wrong := range []string{"fast", "-1", "0, 08:00 1024", "0, 08:00-25:00 1024", "0, 08:00-19:00"} {
+		_, err := storage.ParseRate(wrong)
+		assert.Error(t, err, wrong)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 32<<10)
+	rate, _ := storage.ParseRate("1024")
+	global := storage.NewLimiter(rate)
+	p := storage.WithThrottle(local.NewProducer(), []*storage.Limiter{global, nil}, nil)
+
+	start := time.Now()
+	assert.NoError(t, p.SaveFile(filepath.Join(dir, "archive.gz"), io.NopCloser(bytes.NewReader(data))))
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "512 KB are written at 1 MB/s")
+
+	start = time.Now()
+	file, err := p.ReadFile(filepath.Join(dir, "archive.gz"))
+	if assert.NoError(t, err) {
+		read, _ := io.ReadAll(file)
+		file.Close()
+		assert.Equal(t, data, read)
+	}
+	assert.True(t, time.Since(start) < 400*time.Millisecond, "the download is not limited")
+
+	saved, _ := os.ReadFile(filepath.Join(dir, "archive.gz"))
+	assert.Equal(t, data, saved)
+}
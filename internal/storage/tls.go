@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// NewTLSConfig returns the TLS configuration of the connections to the ftps and webdav servers. The data connections
+// of ftps resume the TLS session of the control connection, as many servers require it.
+func NewTLSConfig(c *RemoteConfig) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         c.TLSServerName,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = c.Host
+	}
+
+	if c.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in the CA file")
+		}
+	}
+
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.TLSFingerprint != "" {
+		// the pinned certificate replaces the check of the chain and the host name
+		fingerprint := normalizeFingerprint(c.TLSFingerprint)
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("tls: the server did not present a certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if hex.EncodeToString(sum[:]) != fingerprint {
+				return fmt.Errorf("tls: the server certificate %X does not match the pinned fingerprint", sum)
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+// normalizeFingerprint accepts the fingerprint in hex with or without colons,
+// e.g. as printed by openssl x509 -noout -fingerprint -sha256
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimSpace(fingerprint)
+	if i := strings.LastIndex(fingerprint, "="); i != -1 {
+		fingerprint = fingerprint[i+1:]
+	}
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"captura-backup/internal/store"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The Store is also the archive database, the tests use the second Store as the archive database.
+var _ store.ArchiveDatabase = (*Store)(nil)
+
+// PrepareTable creates the table with the columns of the DDL written by TableDDL if it does not exist.
+func (s *Store) PrepareTable(ctx context.Context, name, ddl string) error {
+	columns, err := ddlColumns(ddl)
+	if err != nil {
+		return fmt.Errorf("create table: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tables[unquote(name)]; !ok {
+		s.tables[unquote(name)] = &Table{Columns: columns}
+	}
+	return nil
+}
+
+// WriteRows replaces the rows of the day by the rows of the CSV with the header.
+func (s *Store) WriteRows(ctx context.Context, name, dateColumn string, day time.Time, rows io.Reader) (int64, error) {
+	reader := csv.NewReader(rows)
+	reader.Comma = ';'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return 0, fmt.Errorf("copy from stdin to table:%s :%w", name, err)
+	}
+	if len(records) == 0 {
+		return 0, fmt.Errorf("copy from stdin to table:%s : no header", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(name)
+	if err != nil {
+		return 0, err
+	}
+	if strings.Join(records[0], ";") != strings.Join(table.Columns, ";") {
+		return 0, errors.New("the columns of the rows do not match the table")
+	}
+	if _, err := table.removeDay(dateColumn, day); err != nil {
+		return 0, err
+	}
+	table.Rows = append(table.Rows, records[1:]...)
+	return int64(len(records) - 1), nil
+}
+
+func (s *Store) ReadRows(ctx context.Context, name, dateColumn string, day time.Time, w io.Writer) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(name)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := table.copyDay(dateColumn, day, w)
+	if err != nil {
+		return 0, fmt.Errorf("copy data from table: %w", err)
+	}
+	return rows, nil
+}
+
+// DeleteRows deletes the rows of the day, the table left without rows is kept.
+func (s *Store) DeleteRows(ctx context.Context, name, dateColumn string, day time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, ok := s.tables[unquote(name)]
+	if !ok {
+		return 0, nil
+	}
+	return table.removeDay(dateColumn, day)
+}
+
+func (s *Store) Close() {}
+
+// ddlColumns returns the columns of the statement written by TableDDL.
+func ddlColumns(ddl string) ([]string, error) {
+	start, end := strings.Index(ddl, "("), strings.LastIndex(ddl, ")")
+	if start == -1 || end < start {
+		return nil, fmt.Errorf("wrong DDL %q", ddl)
+	}
+	var columns []string
+	for _, definition := range strings.Split(ddl[start+1:end], ", ") {
+		columns = append(columns, unquote(strings.Fields(definition)[0]))
+	}
+	return columns, nil
+}
+
+// removeDay removes the rows of the day by the date column and returns their number.
+func (t *Table) removeDay(dateColumn string, day time.Time) (int64, error) {
+	column, err := t.column(dateColumn)
+	if err != nil {
+		return 0, err
+	}
+	var kept [][]string
+	for _, row := range t.Rows {
+		if rowDay, ok := rowDate(row, column); !ok || !rowDay.Equal(dateOnly(day)) {
+			kept = append(kept, row)
+		}
+	}
+	removed := int64(len(t.Rows) - len(kept))
+	t.Rows = kept
+	return removed, nil
+}
@@ -0,0 +1,929 @@
+// Package memory is the Storer in memory for the tests of the service processes without the database.
+package memory
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/store"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nullValue is the value of NULL in the CSV of the archives as in the COPY of the postgres store
+const nullValue = "NULL"
+
+// defaultTablespace is the tablespace of the tables without the tablespace
+const defaultTablespace = "pg_default"
+
+// DataType is the row of config_table_list: the tables of the schema matching the pattern are archived
+// by the date column after RmInterval (e.g. "6 MONTH") and kept by the retention rules.
+type DataType struct {
+	ID              int
+	Schema          string
+	TablePattern    string
+	Entity          string // record, table or partition
+	DateColumn      string
+	RmInterval      string
+	DoBackup        bool
+	RestoreTemplate string
+	KeepRestoreDays int
+	KeepArchDays    int
+	KeepMonths      int
+	KeepLast        int
+	KeepYearly      bool
+	// Action "move" moves the tables into ArchiveSchema and ArchiveTablespace instead of the export
+	Action            string
+	ArchiveSchema     string
+	ArchiveTablespace string
+}
+
+// Table is the table of the database, the values of the rows are the CSV fields in the order of the columns.
+// The partition has the name of the partitioned table and the bound, e.g. "FOR VALUES FROM ('2020-01-01') TO ('2020-02-01')".
+// The empty tablespace is the default one.
+type Table struct {
+	Columns    []string
+	Rows       [][]string
+	Parent     string
+	Bound      string
+	Tablespace string
+}
+
+// Store keeps the configuration, the tables and the catalog of the archives in memory. The tables are named
+// "<schema>.<table>" without the quotes. Its methods behave as the methods of the postgres store.
+type Store struct {
+	mu           sync.Mutex
+	dataTypes    map[int]*DataType
+	tables       map[string]*Table
+	archives     []datastructs.ArchAvailableData
+	copies       []datastructs.ArchiveCopy
+	holds        []datastructs.LegalHold
+	destinations []datastructs.StorageDestination
+	schedule     []*datastructs.ScheduleConfig
+	control      datastructs.ControlPanel
+	reports      []datastructs.ReconcileIssue
+	state        string
+	message      string
+}
+
+func New() *Store {
+	return &Store{
+		dataTypes: make(map[int]*DataType),
+		tables:    make(map[string]*Table),
+	}
+}
+
+var _ store.Storer = (*Store)(nil)
+
+// AddDataType adds or replaces the data type.
+func (s *Store) AddDataType(dt DataType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataTypes[dt.ID] = &dt
+}
+
+// CreateTable creates the empty table, the existing table is replaced.
+func (s *Store) CreateTable(name string, columns ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tables[unquote(name)] = &Table{Columns: columns}
+}
+
+// CreatePartition creates the empty partition of the partitioned table with its columns.
+func (s *Store) CreatePartition(name, parent, bound string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(parent)
+	if err != nil {
+		return err
+	}
+	s.tables[unquote(name)] = &Table{Columns: table.Columns, Parent: unquote(parent), Bound: bound}
+	return nil
+}
+
+// Insert adds the rows to the table.
+func (s *Store) Insert(name string, rows ...[]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, ok := s.tables[unquote(name)]
+	if !ok {
+		return fmt.Errorf("relation %q does not exist", name)
+	}
+	for _, row := range rows {
+		if len(row) != len(table.Columns) {
+			return fmt.Errorf("table %s: %d values for %d columns", name, len(row), len(table.Columns))
+		}
+		table.Rows = append(table.Rows, append([]string(nil), row...))
+	}
+	return nil
+}
+
+// Table returns the copy of the table, false if the table does not exist.
+func (s *Store) Table(name string) (Table, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, ok := s.tables[unquote(name)]
+	if !ok {
+		return Table{}, false
+	}
+	rows := make([][]string, len(table.Rows))
+	copy(rows, table.Rows)
+	return Table{Columns: table.Columns, Rows: rows, Parent: table.Parent, Bound: table.Bound, Tablespace: table.Tablespace}, true
+}
+
+// AddLegalHold adds the active legal hold.
+func (s *Store) AddLegalHold(h datastructs.LegalHold) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holds = append(s.holds, h)
+}
+
+// AddStorageDestination adds the storage settings of the data type.
+func (s *Store) AddStorageDestination(d datastructs.StorageDestination) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.destinations = append(s.destinations, d)
+}
+
+// SetControl sets the state of the control panel of the user interface.
+func (s *Store) SetControl(cp datastructs.ControlPanel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.control = cp
+}
+
+// State returns the last state and message of the service.
+func (s *Store) State() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.message
+}
+
+// ReconcileReport returns the issues of all reconcile reports.
+func (s *Store) ReconcileReport() []datastructs.ReconcileIssue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]datastructs.ReconcileIssue(nil), s.reports...)
+}
+
+func unquote(name string) string {
+	return strings.ReplaceAll(name, `"`, "")
+}
+
+var plainIdent = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// upperBound is the upper date of the range partition
+var upperBound = regexp.MustCompile(`TO \('(\d{4}-\d{2}-\d{2})[^']*'\)`)
+
+// quoteIdent quotes the identifier as quote_ident of postgres
+func quoteIdent(name string) string {
+	if plainIdent.MatchString(name) {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func dateOnly(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// cutoff returns the first date which is not archived by the interval "<n> DAY|WEEK|MONTH|YEAR".
+func cutoff(interval string, now time.Time) (time.Time, error) {
+	fields := strings.Fields(strings.Trim(interval, "'"))
+	if len(fields) != 2 {
+		return time.Time{}, fmt.Errorf("wrong interval %q", interval)
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("wrong interval %q", interval)
+	}
+	today := dateOnly(now)
+	switch strings.TrimSuffix(strings.ToUpper(fields[1]), "S") {
+	case "DAY":
+		return today.AddDate(0, 0, -n), nil
+	case "WEEK":
+		return today.AddDate(0, 0, -7*n), nil
+	case "MONTH":
+		return today.AddDate(0, -n, 0), nil
+	case "YEAR":
+		return today.AddDate(-n, 0, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("wrong interval %q", interval)
+}
+
+// column returns the index of the column of the table.
+func (t *Table) column(name string) (int, error) {
+	name = unquote(name)
+	for i, column := range t.Columns {
+		if column == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("column %q does not exist", name)
+}
+
+// rowDate returns the date of the row by the date column, false for NULL.
+func rowDate(row []string, column int) (time.Time, bool) {
+	value := row[column]
+	if len(value) < len("2006-01-02") || value == nullValue {
+		return time.Time{}, false
+	}
+	day, err := time.Parse("2006-01-02", value[:len("2006-01-02")])
+	return day, err == nil
+}
+
+// table returns the table of the archived data, the caller holds the lock.
+func (s *Store) table(name string) (*Table, error) {
+	table, ok := s.tables[unquote(name)]
+	if !ok {
+		return nil, fmt.Errorf("relation %q does not exist", name)
+	}
+	return table, nil
+}
+
+func (s *Store) ScheduleSettings(ctx context.Context) ([]*datastructs.ScheduleConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.schedule, nil
+}
+
+func (s *Store) ResetStateControl(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.control = datastructs.ControlPanel{}
+	return nil
+}
+
+func (s *Store) StateAndMessageService(ctx context.Context, state, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state, s.message = state, message
+	return nil
+}
+
+func (s *Store) StateControl(ctx context.Context) (*datastructs.ControlPanel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := s.control
+	return &cp, nil
+}
+
+func (s *Store) StorageDestinations(ctx context.Context) ([]datastructs.StorageDestination, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]datastructs.StorageDestination(nil), s.destinations...), nil
+}
+
+// DatasToArchive returns the tables of the data type sorted by name.
+func (s *Store) DatasToArchive(ctx context.Context, id int) ([]*datastructs.ArchiveTable, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dt, ok := s.dataTypes[id]
+	if !ok {
+		return nil, nil
+	}
+	pattern, err := regexp.Compile(dt.TablePattern)
+	if err != nil {
+		return nil, err
+	}
+	match := func(name string) bool {
+		schemaTbl := strings.SplitN(name, ".", 2)
+		return schemaTbl[0] == dt.Schema && len(schemaTbl) == 2 && pattern.MatchString(schemaTbl[1])
+	}
+	var before time.Time
+	if dt.Entity == "partition" {
+		if before, err = cutoff(dt.RmInterval, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for name, table := range s.tables {
+		if dt.Entity != "partition" {
+			// the table moved to the archive tablespace of its schema is already archived
+			moved := dt.Action == "move" && (dt.ArchiveSchema == "" || dt.ArchiveSchema == dt.Schema) &&
+				table.Tablespace == dt.ArchiveTablespace
+			if match(name) && !moved {
+				names = append(names, name)
+			}
+			continue
+		}
+		// the partitions of the matching partitioned tables are expired by the upper date of the range
+		bound := upperBound.FindStringSubmatch(table.Bound)
+		if table.Parent == "" || !match(table.Parent) || bound == nil {
+			continue
+		}
+		if upper, err := time.Parse("2006-01-02", bound[1]); err == nil && !upper.After(before) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var ats []*datastructs.ArchiveTable
+	for _, name := range names {
+		schemaTbl := strings.SplitN(name, ".", 2)
+		var parent string
+		if table := s.tables[name]; table.Parent != "" {
+			parentTbl := strings.SplitN(table.Parent, ".", 2)
+			parent = parentTbl[0] + "." + quoteIdent(parentTbl[1])
+		}
+		ats = append(ats, &datastructs.ArchiveTable{
+			Parent:            parent,
+			PartitionBound:    s.tables[name].Bound,
+			ID:                dt.ID,
+			Name:              schemaTbl[0] + "." + quoteIdent(schemaTbl[1]),
+			Entity:            dt.Entity,
+			DateColumn:        dt.DateColumn,
+			RmInterval:        dt.RmInterval,
+			RestoreTemplate:   dt.RestoreTemplate,
+			DoBackup:          dt.DoBackup,
+			KeepRestore:       dt.KeepRestoreDays,
+			Action:            dt.Action,
+			ArchiveSchema:     dt.ArchiveSchema,
+			ArchiveTablespace: dt.ArchiveTablespace,
+		})
+	}
+	return ats, nil
+}
+
+// DatesToBackup returns the distinct dates of the table older than the interval of the data type.
+func (s *Store) DatesToBackup(ctx context.Context, data *datastructs.ArchiveTable) ([]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(data.Name)
+	if err != nil {
+		return nil, err
+	}
+	column, err := table.column(data.DateColumn)
+	if err != nil {
+		return nil, err
+	}
+	before, err := cutoff(data.RmInterval, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[time.Time]bool)
+	var dates []time.Time
+	for _, row := range table.Rows {
+		if day, ok := rowDate(row, column); ok && day.Before(before) && !seen[day] {
+			seen[day] = true
+			dates = append(dates, day)
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	return dates, nil
+}
+
+func (s *Store) WasRestoredAndExpired(ctx context.Context, data datastructs.ArchAvailableData) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.archives {
+		if a.SchemaName != data.SchemaName || a.TableName != data.TableName || !a.ContentDate.Equal(data.ContentDate) {
+			continue
+		}
+		keep := 0
+		if dt, ok := s.dataTypes[a.DataID]; ok {
+			keep = dt.KeepRestoreDays
+		}
+		return dateOnly(a.RestoredAt).AddDate(0, 0, keep).Before(dateOnly(time.Now())), nil
+	}
+	return true, nil
+}
+
+// SaveDataForDay writes the rows of the day to the file as the gzip CSV with the header.
+func (s *Store) SaveDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, tmpFile *os.File) (int64, error) {
+	gzWriter := gzip.NewWriter(tmpFile)
+	gzWriter.Extra = manifest.GzipExtra(data.TableDDL)
+	rows, err := s.CopyDataForDay(ctx, data, day, gzWriter)
+	if err != nil {
+		return 0, err
+	}
+	return rows, gzWriter.Close()
+}
+
+// CopyDataForDay writes the rows of the day as the CSV with the header.
+func (s *Store) CopyDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, w io.Writer) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(data.Name)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := table.copyDay(data.DateColumn, day, w)
+	if err != nil {
+		return 0, fmt.Errorf("copy data to file from table: %w", err)
+	}
+	return rows, nil
+}
+
+// copyDay writes the header and the rows of the day by the date column as the CSV.
+func (t *Table) copyDay(dateColumn string, day time.Time, w io.Writer) (int64, error) {
+	column, err := t.column(dateColumn)
+	if err != nil {
+		return 0, err
+	}
+	writer := csv.NewWriter(w)
+	writer.Comma = ';'
+	writer.Write(t.Columns)
+	var rows int64
+	for _, row := range t.Rows {
+		if rowDay, ok := rowDate(row, column); ok && rowDay.Equal(dateOnly(day)) {
+			writer.Write(row)
+			rows++
+		}
+	}
+	writer.Flush()
+	return rows, writer.Error()
+}
+
+func (s *Store) DeleteDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, rowsSave int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(data.Name)
+	if err != nil {
+		return err
+	}
+	column, err := table.column(data.DateColumn)
+	if err != nil {
+		return err
+	}
+	var kept [][]string
+	for _, row := range table.Rows {
+		if rowDay, ok := rowDate(row, column); !ok || !rowDay.Equal(dateOnly(day)) {
+			kept = append(kept, row)
+		}
+	}
+	if int64(len(table.Rows)-len(kept)) != rowsSave {
+		return errors.New("the number of saved and deleted records do not match")
+	}
+	table.Rows = kept
+	return nil
+}
+
+func (s *Store) AddArchAvailableData(ctx context.Context, data datastructs.ArchAvailableData) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data.ID = len(s.archives) + 1
+	s.archives = append(s.archives, data)
+	return data.ID, nil
+}
+
+func (s *Store) DeleteTable(ctx context.Context, table string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tables, unquote(table))
+	return nil
+}
+
+// DropPartition drops the partition, the partition with rows is kept.
+func (s *Store) DropPartition(ctx context.Context, parent, partition string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(partition)
+	if err != nil {
+		return err
+	}
+	if table.Parent != unquote(parent) {
+		return fmt.Errorf("detach partition: %q is not a partition of %q", partition, parent)
+	}
+	if len(table.Rows) != 0 {
+		return errors.New("the partition is not empty")
+	}
+	delete(s.tables, unquote(partition))
+	return nil
+}
+
+// MoveTable renames the table into the schema and sets its tablespace, the schema of the table is not set again.
+func (s *Store) MoveTable(ctx context.Context, name, schema, tablespace string) (string, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(name)
+	if err != nil {
+		return "", 0, err
+	}
+	source := table.Tablespace
+	if source == "" {
+		source = defaultTablespace
+	}
+	if moved := schema + "." + strings.SplitN(unquote(name), ".", 2)[1]; schema != "" && moved != unquote(name) {
+		if _, ok := s.tables[moved]; ok {
+			return "", 0, fmt.Errorf("set schema: relation %q already exists", moved)
+		}
+		delete(s.tables, unquote(name))
+		s.tables[moved] = table
+	}
+	if tablespace == defaultTablespace {
+		table.Tablespace = ""
+	} else if tablespace != "" {
+		table.Tablespace = tablespace
+	}
+	return source, int64(len(table.Rows)), nil
+}
+
+// TableTablespace returns the tablespace of the table or "" if the table does not exist.
+func (s *Store) TableTablespace(ctx context.Context, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, ok := s.tables[unquote(name)]
+	switch {
+	case !ok:
+		return "", nil
+	case table.Tablespace == "":
+		return defaultTablespace, nil
+	}
+	return table.Tablespace, nil
+}
+
+// TableDDL returns the statement creating the table, all columns have the type text,
+// the tables have no constraints and indexes.
+func (s *Store) TableDDL(ctx context.Context, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(name)
+	if err != nil {
+		return "", err
+	}
+	columns := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		columns[i] = quoteIdent(column) + " text"
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s);", name, strings.Join(columns, ", ")), nil
+}
+
+// EstimateDaySize estimates the size of one day by the size of the CSV of the table divided by the number of dates.
+func (s *Store) EstimateDaySize(ctx context.Context, data *datastructs.ArchiveTable) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table, err := s.table(data.Name)
+	if err != nil {
+		return 0, err
+	}
+	column, err := table.column(data.DateColumn)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	dates := make(map[time.Time]bool)
+	for _, row := range table.Rows {
+		for _, value := range row {
+			size += int64(len(value)) + 1
+		}
+		if day, ok := rowDate(row, column); ok {
+			dates[day] = true
+		}
+	}
+	if len(dates) == 0 {
+		return size, nil
+	}
+	return size / int64(len(dates)), nil
+}
+
+func (s *Store) StorageUsage(ctx context.Context) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := make(map[string]int64)
+	for _, a := range s.archives {
+		if a.DeletedAt.IsZero() {
+			usage[a.Storage] += a.FileSize
+		}
+	}
+	for _, c := range s.archiveCopies(func(c datastructs.ArchiveCopy, a datastructs.ArchAvailableData) bool {
+		return c.Status == "ok" && a.DeletedAt.IsZero()
+	}) {
+		for _, a := range s.archives {
+			if a.ID == c.AvailableDataID {
+				usage[c.Storage] += a.FileSize
+			}
+		}
+	}
+	return usage, nil
+}
+
+// StoragesForCleaner returns the retention rules of the data types with keep_arch_days > 0.
+func (s *Store) StoragesForCleaner(ctx context.Context) ([]datastructs.ArchiveStorage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ass []datastructs.ArchiveStorage
+	for _, dt := range s.dataTypes {
+		if dt.KeepArchDays > 0 {
+			ass = append(ass, datastructs.ArchiveStorage{
+				DataID:       dt.ID,
+				Schemaname:   dt.Schema,
+				DateColumn:   dt.DateColumn,
+				KeepArchDays: dt.KeepArchDays,
+				KeepMonths:   dt.KeepMonths,
+				KeepLast:     dt.KeepLast,
+				KeepYearly:   dt.KeepYearly,
+			})
+		}
+	}
+	sort.Slice(ass, func(i, j int) bool { return ass[i].DataID < ass[j].DataID })
+	return ass, nil
+}
+
+func (s *Store) UpdateAvailableDataAfterRemoveFile(ctx context.Context, data datastructs.ArchAvailableData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, a := range s.archives {
+		if a.SchemaName == data.SchemaName && a.TableName == data.TableName && a.ContentDate.Equal(data.ContentDate) {
+			s.archives[i].DeletedAt = data.DeletedAt
+		}
+	}
+	return nil
+}
+
+// FilesForRestore returns the not deleted archives with the content date up to the date, dataID = 0 means all data types
+// including the unknown ones.
+func (s *Store) FilesForRestore(ctx context.Context, dataID int, date time.Time) ([]*datastructs.RestoreData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var data []*datastructs.RestoreData
+	for _, a := range s.archives {
+		// the archives of the unknown data type are restored by the restore of all data types
+		dt, ok := s.dataTypes[a.DataID]
+		if !ok && dataID != 0 || !a.DeletedAt.IsZero() || a.ContentDate.After(date) || dataID != 0 && a.DataID != dataID {
+			continue
+		}
+		if !ok {
+			dt = &DataType{}
+		}
+		data = append(data, &datastructs.RestoreData{ArchAvailableData: a, CurrentTemplate: dt.RestoreTemplate, DateColumn: dt.DateColumn})
+	}
+	return data, nil
+}
+
+// RestoreData copies the CSV with the header into the table, the single table is created by its template
+// or, if the template differs from the one of the archive, by the definition of the table at the backup.
+func (s *Store) RestoreData(ctx context.Context, data *datastructs.RestoreData, tmpFile io.Reader) error {
+	reader := csv.NewReader(tmpFile)
+	reader.Comma = ';'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return fmt.Errorf("copy from file or stdin to table:%s :%w", data.TableName, err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("copy from file or stdin to table:%s : no header", data.TableName)
+	}
+	rows := records[1:]
+	if int64(len(rows)) != data.ContentRows {
+		return errors.New("the number of restored rows does not match the declared")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := unquote(data.SchemaName + "." + data.TableName)
+	if data.Parent != "" {
+		if _, ok := s.tables[name]; !ok {
+			parent, err := s.table(data.Parent)
+			if err != nil {
+				return fmt.Errorf("create partition: %w", err)
+			}
+			s.tables[name] = &Table{Columns: parent.Columns, Parent: unquote(data.Parent), Bound: data.PartitionBound}
+		}
+	} else if data.SingleTable {
+		var columns []string
+		switch {
+		case data.RestoreTemplate != "" && data.RestoreTemplate == data.CurrentTemplate:
+			template, err := s.table(data.RestoreTemplate)
+			if err != nil {
+				return fmt.Errorf("create table: %w", err)
+			}
+			columns = template.Columns
+		case data.TableDDL != "":
+			if columns, err = ddlColumns(data.TableDDL); err != nil {
+				return fmt.Errorf("create table by its definition: %w", err)
+			}
+		default:
+			return errors.New("no template or definition for creating a table")
+		}
+		if _, ok := s.tables[name]; ok {
+			return fmt.Errorf("create table: relation %q already exists", name)
+		}
+		s.tables[name] = &Table{Columns: columns}
+	}
+	table, err := s.table(name)
+	if err != nil {
+		return fmt.Errorf("copy from file or stdin to table:%s :%w", data.TableName, err)
+	}
+	for _, row := range rows {
+		if len(row) != len(table.Columns) {
+			return fmt.Errorf("copy from file or stdin to table:%s : %d values for %d columns", data.TableName, len(row), len(table.Columns))
+		}
+	}
+	table.Rows = append(table.Rows, rows...)
+	return nil
+}
+
+func (s *Store) UpdateAvailableDataAfterRestoreFile(ctx context.Context, id int) error {
+	return s.update(id, func(a *datastructs.ArchAvailableData) {
+		a.RestoredAt = time.Now()
+	})
+}
+
+// update changes the archive of the catalog by its ID, the missing archive is not an error as for UPDATE.
+func (s *Store) update(id int, f func(a *datastructs.ArchAvailableData)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.archives {
+		if s.archives[i].ID == id {
+			f(&s.archives[i])
+		}
+	}
+	return nil
+}
+
+// filter returns the archives of the catalog ordered by the content date and the ID.
+func (s *Store) filter(keep func(a datastructs.ArchAvailableData) bool) []datastructs.ArchAvailableData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var archives []datastructs.ArchAvailableData
+	for _, a := range s.archives {
+		if keep(a) {
+			archives = append(archives, a)
+		}
+	}
+	sort.SliceStable(archives, func(i, j int) bool { return archives[i].ContentDate.Before(archives[j].ContentDate) })
+	return archives
+}
+
+func inRange(a datastructs.ArchAvailableData, dataID int, from, to time.Time) bool {
+	return (dataID == 0 || a.DataID == dataID) && !a.ContentDate.Before(from) && !a.ContentDate.After(to)
+}
+
+func (s *Store) ArchivesForKeyRotation(ctx context.Context, keyID string) ([]datastructs.ArchAvailableData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var archives []datastructs.ArchAvailableData
+	for _, a := range s.archives {
+		if a.DeletedAt.IsZero() && a.KeyID != keyID {
+			archives = append(archives, a)
+		}
+	}
+	return archives, nil
+}
+
+func (s *Store) UpdateArchiveKey(ctx context.Context, id int, keyID string, fileSize int64) error {
+	return s.update(id, func(a *datastructs.ArchAvailableData) {
+		a.KeyID, a.FileSize = keyID, fileSize
+	})
+}
+
+func (s *Store) AvailableArchives(ctx context.Context, dataID int, from, to time.Time) ([]datastructs.ArchAvailableData, error) {
+	return s.filter(func(a datastructs.ArchAvailableData) bool {
+		return a.DeletedAt.IsZero() && inRange(a, dataID, from, to)
+	}), nil
+}
+
+func (s *Store) ArchiveDataType(ctx context.Context, schema, table string) (datastructs.ArchAvailableData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int, 0, len(s.dataTypes))
+	for id := range s.dataTypes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		dt := s.dataTypes[id]
+		if dt.Schema != schema {
+			continue
+		}
+		if ok, err := regexp.MatchString(dt.TablePattern, table); err != nil || !ok {
+			continue
+		}
+		return datastructs.ArchAvailableData{
+			DataID:          dt.ID,
+			SchemaName:      dt.Schema,
+			TableName:       quoteIdent(table),
+			SingleTable:     dt.Entity == "table",
+			RestoreTemplate: dt.RestoreTemplate,
+		}, nil
+	}
+	return datastructs.ArchAvailableData{}, fmt.Errorf("%w %s.%s", store.ErrNoDataType, schema, table)
+}
+
+func (s *Store) CatalogArchives(ctx context.Context) ([]datastructs.ArchAvailableData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]datastructs.ArchAvailableData(nil), s.archives...), nil
+}
+
+func (s *Store) MarkArchiveDeleted(ctx context.Context, id int, deletedAt time.Time) error {
+	return s.update(id, func(a *datastructs.ArchAvailableData) {
+		a.DeletedAt = deletedAt
+	})
+}
+
+func (s *Store) SaveArchiveCopy(ctx context.Context, c datastructs.ArchiveCopy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts := 0
+	if c.Status == "pending" {
+		attempts = 1
+	}
+	for i, existing := range s.copies {
+		if existing.AvailableDataID == c.AvailableDataID && existing.Storage == c.Storage {
+			if c.Status == "pending" {
+				attempts = existing.Attempts + 1
+			}
+			s.copies[i].FileName, s.copies[i].Status, s.copies[i].Error = c.FileName, c.Status, c.Error
+			s.copies[i].Attempts = attempts
+			return nil
+		}
+	}
+	s.copies = append(s.copies, datastructs.ArchiveCopy{
+		AvailableDataID: c.AvailableDataID,
+		Storage:         c.Storage,
+		FileName:        c.FileName,
+		Status:          c.Status,
+		Error:           c.Error,
+		Attempts:        attempts,
+	})
+	return nil
+}
+
+// archiveCopies returns the copies with the source archive, the caller holds the lock.
+func (s *Store) archiveCopies(keep func(c datastructs.ArchiveCopy, a datastructs.ArchAvailableData) bool) []datastructs.ArchiveCopy {
+	var copies []datastructs.ArchiveCopy
+	for _, c := range s.copies {
+		for _, a := range s.archives {
+			if a.ID == c.AvailableDataID && keep(c, a) {
+				c.SourceFileName, c.SourceStorage = a.FileName, a.Storage
+				copies = append(copies, c)
+			}
+		}
+	}
+	sort.SliceStable(copies, func(i, j int) bool {
+		if copies[i].AvailableDataID != copies[j].AvailableDataID {
+			return copies[i].AvailableDataID < copies[j].AvailableDataID
+		}
+		return copies[i].Storage < copies[j].Storage
+	})
+	return copies
+}
+
+func (s *Store) ArchiveCopies(ctx context.Context, id int) ([]datastructs.ArchiveCopy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.archiveCopies(func(c datastructs.ArchiveCopy, a datastructs.ArchAvailableData) bool {
+		return c.Status != "deleted" && (id == 0 || c.AvailableDataID == id)
+	}), nil
+}
+
+func (s *Store) PendingArchiveCopies(ctx context.Context) ([]datastructs.ArchiveCopy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.archiveCopies(func(c datastructs.ArchiveCopy, a datastructs.ArchAvailableData) bool {
+		return c.Status == "pending" && a.DeletedAt.IsZero()
+	}), nil
+}
+
+func (s *Store) SetArchiveCopiesStatus(ctx context.Context, id int, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.copies {
+		if s.copies[i].AvailableDataID == id {
+			s.copies[i].Status, s.copies[i].Attempts = status, 0
+		}
+	}
+	return nil
+}
+
+func (s *Store) MoveArchive(ctx context.Context, id int, storage, fileName string) error {
+	return s.update(id, func(a *datastructs.ArchAvailableData) {
+		a.Storage, a.FileName = storage, fileName
+	})
+}
+
+func (s *Store) DeletedArchives(ctx context.Context, dataID int, from, to time.Time) ([]datastructs.ArchAvailableData, error) {
+	return s.filter(func(a datastructs.ArchAvailableData) bool {
+		return !a.DeletedAt.IsZero() && inRange(a, dataID, from, to)
+	}), nil
+}
+
+func (s *Store) MarkArchiveRestoredFromTrash(ctx context.Context, id int) error {
+	return s.update(id, func(a *datastructs.ArchAvailableData) {
+		a.DeletedAt = time.Time{}
+	})
+}
+
+func (s *Store) SaveReconcileReport(ctx context.Context, checkedAt time.Time, issues []datastructs.ReconcileIssue) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports = append(s.reports, issues...)
+	return nil
+}
+
+func (s *Store) ActiveLegalHolds(ctx context.Context) ([]datastructs.LegalHold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]datastructs.LegalHold(nil), s.holds...), nil
+}
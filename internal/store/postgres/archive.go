@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"captura-backup/internal/store"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// sequenceDefault is the default of the serial column, the sequences of the production database
+// are not created in the archive database and the archived rows have the values of the column
+var sequenceDefault = regexp.MustCompile(` DEFAULT nextval\('(?:[^']|'')*'::regclass\)`)
+
+// ArchiveDatabase keeps the archived rows in the tables of the archive database
+type ArchiveDatabase struct {
+	*pgxpool.Pool
+}
+
+func NewArchiveDatabase(pool *pgxpool.Pool) store.ArchiveDatabase {
+	return &ArchiveDatabase{pool}
+}
+
+// PrepareTable creates the schema and the table, the unqualified name of the DDL is created in the schema of the table
+func (db *ArchiveDatabase) PrepareTable(ctx context.Context, table, ddl string) error {
+	schema := strings.SplitN(table, ".", 2)[0]
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction:%w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+schema); err != nil {
+		return fmt.Errorf("create schema: %w", err)
+	}
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+		return fmt.Errorf("check table: %w", err)
+	}
+	if !exists {
+		if _, err := tx.Exec(ctx, "SET LOCAL search_path TO "+schema); err != nil {
+			return fmt.Errorf("set search path: %w", err)
+		}
+		if _, err := tx.Exec(ctx, sequenceDefault.ReplaceAllString(ddl, "")); err != nil {
+			return fmt.Errorf("create table: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (db *ArchiveDatabase) WriteRows(ctx context.Context, table, dateColumn string, day time.Time, rows io.Reader) (int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction:%w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE %s = '%s'`, table, dateColumn, day.Format("2006-01-02"))
+	if _, err := tx.Exec(ctx, query); err != nil {
+		return 0, fmt.Errorf("delete rows of the day: %w", err)
+	}
+
+	ctxCopy, cancel := context.WithTimeout(ctx, time.Duration(5*time.Minute))
+	defer cancel()
+
+	query = fmt.Sprintf(`COPY %s FROM STDIN WITH CSV NULL 'NULL' DELIMITER ';' HEADER ;`, table)
+	tag, err := tx.Conn().PgConn().CopyFrom(ctxCopy, rows, query)
+	if err != nil {
+		return 0, fmt.Errorf("copy from stdin to table:%s :%w", table, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (db *ArchiveDatabase) ReadRows(ctx context.Context, table, dateColumn string, day time.Time, w io.Writer) (int64, error) {
+	con, err := db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection from pgpool: %w", err)
+	}
+	defer con.Release()
+
+	query := fmt.Sprintf(
+		`COPY (SELECT * FROM %s WHERE %s = '%s') TO STDOUT WITH CSV NULL 'NULL' DELIMITER ';' HEADER ;`,
+		table,
+		dateColumn,
+		day.Format("2006-01-02"))
+
+	ctxCopy, cancel := context.WithTimeout(ctx, time.Duration(5*time.Minute))
+	defer cancel()
+	tag, err := con.Conn().PgConn().CopyTo(ctxCopy, w, query)
+	if err != nil {
+		return 0, fmt.Errorf("copy data from table: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (db *ArchiveDatabase) DeleteRows(ctx context.Context, table, dateColumn string, day time.Time) (int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction:%w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("check table: %w", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE %s = '%s'`, table, dateColumn, day.Format("2006-01-02"))
+	tag, err := tx.Exec(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("execute transaction: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -1,416 +1,1096 @@
-package postgres
-
-import (
-	"captura-backup/internal/datastructs"
-	"captura-backup/internal/store"
-	"compress/gzip"
-	"context"
-	"fmt"
-	"io"
-	"os"
-	"time"
-
-	"github.com/pkg/errors"
-
-	"github.com/jackc/pgtype"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
-	"gopkg.in/ini.v1"
-)
-
-type Store struct {
-	*pgxpool.Pool
-	ini *ini.File
-}
-
-func New(pool *pgxpool.Pool, ini *ini.File) store.Storer {
-	return &Store{pool, ini}
-}
-
-func (db *Store) pgEntity(entity, key string) string {
-	return fmt.Sprintf(" %s.%s ",
-		db.ini.Section("database").Key("schema").String(),
-		db.ini.Section("database."+entity).Key(key).String(),
-	)
-}
-
-func (db *Store) StateAndMessageService(ctx context.Context, state, message string) error {
-	_, err := db.Exec(ctx,
-		"SELECT FROM"+db.pgEntity("function", "state_and_message")+"($1,$2)", state, message)
-	return err
-}
-
-func (db *Store) ResetStateControl(ctx context.Context) error {
-	_, err := db.Exec(ctx,
-		"SELECT FROM"+db.pgEntity("function", "reset_state_control")+"()")
-	return err
-}
-
-func (db *Store) StateControl(ctx context.Context) (*datastructs.ControlPanel, error) {
-	var (
-		cp       datastructs.ControlPanel
-		archive  pgtype.Int4
-		thisDate pgtype.Date
-	)
-	if err := db.QueryRow(ctx,
-		`SELECT stop_manager, reload_config, start_recovery, restore_to_this_date, start_manual_backup, type_archive
-		FROM`+db.pgEntity("table", "service_control")).
-		Scan(
-			&cp.StopService,
-			&cp.ReloadConfig,
-			&cp.StartRecovery,
-			&thisDate,
-			&cp.StartManualBackup,
-			&archive,
-		); err != nil {
-		return nil, err
-	}
-	if archive.Status != pgtype.Null {
-		cp.TypeArchive = int(archive.Int)
-	}
-	if thisDate.Status != pgtype.Null {
-		cp.RestoreToThisDate = thisDate.Time
-	}
-
-	return &cp, nil
-}
-
-func (db *Store) ScheduleSettings(ctx context.Context) ([]*datastructs.ScheduleConfig, error) {
-	var scheduler []*datastructs.ScheduleConfig
-	rows, err := db.Query(ctx,
-		`SELECT data_id, check_interval, check_interval_days, work_start 
-		FROM`+db.pgEntity("table", "schedule_settings")+"WHERE enabled = TRUE",
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var sch datastructs.ScheduleConfig
-		if err := rows.Scan(
-			&sch.DataID,
-			&sch.CheckInterval,
-			&sch.CheckIntervalDays,
-			&sch.WorkStart,
-		); err != nil {
-			return nil, err
-		}
-		scheduler = append(scheduler, &sch)
-	}
-	return scheduler, nil
-}
-
-func (db *Store) DatasToArchive(ctx context.Context, id int) ([]*datastructs.ArchiveTable, error) {
-	var ats []*datastructs.ArchiveTable
-	rows, err := db.Query(ctx,
-		"SELECT * FROM"+db.pgEntity("function", "datas_to_archive")+"($1);", id,
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var (
-			at                                                  datastructs.ArchiveTable
-			entity, dateclmn, condfmt, rminterval, restTemplate pgtype.Varchar
-			dobackup                                            pgtype.Bool
-			keepRestore                                         pgtype.Int4
-		)
-		if err := rows.Scan(
-			&at.Name,
-			&at.ID,
-			&entity,
-			&dateclmn,
-			&condfmt,
-			&rminterval,
-			&dobackup,
-			&restTemplate,
-			&keepRestore,
-		); err != nil {
-			return nil, err
-		}
-
-		if entity.Status != pgtype.Null {
-			at.Entity = entity.String
-		}
-		if dateclmn.Status != pgtype.Null {
-			at.DateColumn = dateclmn.String
-		}
-		if condfmt.Status != pgtype.Null {
-			at.DateColumn = dateclmn.String
-		}
-		if rminterval.Status != pgtype.Null {
-			at.RmInterval = rminterval.String
-		}
-		if dobackup.Status != pgtype.Null {
-			at.DoBackup = dobackup.Bool
-		}
-		if restTemplate.Status != pgtype.Null {
-			at.RestoreTemplate = restTemplate.String
-		}
-		if keepRestore.Status != pgtype.Null {
-			at.KeepRestore = int(keepRestore.Int)
-		}
-
-		ats = append(ats, &at)
-	}
-	return ats, nil
-}
-
-func (db *Store) DatesToBackup(ctx context.Context, data *datastructs.ArchiveTable) ([]time.Time, error) {
-	// SELECT DISTINCT "ST_Date" FROM billdb_rec.rec_6_40_cdr WHERE "ST_Date" < (current_date - '6 MONTH'::INTERVAL)::DATE
-	// SELECT DISTINCT DateColumn FROM Name WHERE DateColumn < (current_date - RmInterval::INTERVAL)::DATE
-	var dates []time.Time
-	sql := fmt.Sprintf(`SELECT DISTINCT %s FROM %s WHERE %s < (current_date - '%s'::INTERVAL)::DATE`, data.DateColumn, data.Name, data.DateColumn, data.RmInterval)
-	rows, err := db.Query(ctx, sql)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var date time.Time
-		if err := rows.Scan(&date); err != nil {
-			return nil, err
-		}
-		dates = append(dates, date)
-	}
-	return dates, nil
-}
-
-func (db *Store) SaveDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, tmpFile *os.File) (int64, error) {
-	gzWriter := gzip.NewWriter(tmpFile)
-	defer gzWriter.Close()
-
-	con, err := db.Acquire(ctx)
-	if err != nil {
-		return 0, fmt.Errorf("acquire connection from pgpool: %w", err)
-	}
-	defer con.Release()
-
-	query := fmt.Sprintf(
-		`COPY (SELECT * FROM %s WHERE %s = '%s') TO STDOUT WITH CSV NULL 'NULL' DELIMITER ';' HEADER ;`,
-		data.Name,
-		data.DateColumn,
-		day.Format("2006-01-02"))
-
-	ctxCopy, cancel := context.WithTimeout(ctx, time.Duration(5*time.Minute))
-	defer cancel()
-	tag, err := con.Conn().PgConn().CopyTo(ctxCopy, gzWriter, query)
-	if err != nil {
-		return 0, fmt.Errorf("copy data to file from table: %w", err)
-	}
-
-	return tag.RowsAffected(), nil
-}
-
-func (db *Store) DeleteDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, rowsSave int64) error {
-	tx, err := db.Begin(ctx)
-	if err != nil {
-		return fmt.Errorf("begin transaction:%w", err)
-	}
-	defer tx.Rollback(ctx)
-
-	query := fmt.Sprintf(`DELETE FROM %s WHERE %s = '%s'`,
-		data.Name,
-		data.DateColumn,
-		day.Format("2006-01-02"))
-	tag, err := tx.Exec(ctx, query)
-
-	if err != nil {
-		return fmt.Errorf("execute transaction: %w", err)
-	}
-	if tag.RowsAffected() != rowsSave {
-		return errors.New("the number of saved and deleted records do not match")
-	}
-
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("commit transaction: %w", err)
-	}
-	return nil
-}
-
-func (db *Store) DeleteTable(ctx context.Context, table string) (err error) {
-	tx, err := db.Begin(ctx)
-	if err != nil {
-		return fmt.Errorf("begin transaction:%w", err)
-	}
-	defer tx.Rollback(ctx)
-
-	if _, err := tx.Exec(ctx, "DROP TABLE IF EXISTS "+table); err != nil {
-		return fmt.Errorf("execute transaction: %w", err)
-	}
-
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("commit transaction: %w", err)
-	}
-	return nil
-}
-
-func (db *Store) AddArchAvailableData(ctx context.Context, d datastructs.ArchAvailableData) error {
-	var err error
-	if d.RestoreTemplate != "" {
-		_, err = db.Exec(ctx,
-			"SELECT FROM"+db.pgEntity("function", "add_available_data")+"($1,$2,$3,$4,$5,$6,$7,$8,$9);",
-			d.DataID,
-			d.SchemaName,
-			d.TableName,
-			d.SingleTable,
-			d.FileName,
-			d.ContentDate,
-			d.ContentRows,
-			d.ArchivedAt,
-			d.RestoreTemplate,
-		)
-	} else {
-		_, err = db.Exec(ctx,
-			"SELECT FROM"+db.pgEntity("function", "add_available_data")+"($1,$2,$3,$4,$5,$6,$7,$8,NULL);",
-			d.DataID,
-			d.SchemaName,
-			d.TableName,
-			d.SingleTable,
-			d.FileName,
-			d.ContentDate,
-			d.ContentRows,
-			d.ArchivedAt,
-		)
-	}
-
-	return err
-}
-
-func (db *Store) StoragesForCleaner(ctx context.Context) ([]datastructs.ArchiveStorage, error) {
-	rows, err := db.Query(ctx,
-		"SELECT id, schemaname, keep_arch_days FROM"+db.pgEntity("table", "config_table_list")+"WHERE keep_arch_days > 0")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var ass []datastructs.ArchiveStorage
-	for rows.Next() {
-		var as datastructs.ArchiveStorage
-		if err := rows.Scan(
-			&as.DataID,
-			&as.Schemaname,
-			&as.KeepArchDays,
-		); err != nil {
-			return nil, err
-		}
-		ass = append(ass, as)
-	}
-	return ass, nil
-}
-
-func (db *Store) UpdateAvailableDataAfterRemoveFile(ctx context.Context, data datastructs.ArchAvailableData) error {
-	_, err := db.Exec(ctx,
-		"UPDATE"+db.pgEntity("table", "available_data")+"SET deleted_at=$1 WHERE schemaname=$2 AND tblname=$3 AND content_date=$4",
-		data.DeletedAt,
-		data.SchemaName,
-		data.TableName,
-		data.ContentDate,
-	)
-	return err
-}
-
-func (db *Store) WasRestoredAndExpired(ctx context.Context, data datastructs.ArchAvailableData) (bool, error) {
-	var expired bool
-	err := db.QueryRow(ctx,
-		`SELECT (COALESCE(aad.restored_at, to_timestamp(0))::date + ctl.keep_restore_days) < now()::date
-		FROM`+db.pgEntity("table", "available_data")+`aad 
-		JOIN`+db.pgEntity("table", "config_table_list")+`ctl ON ctl.id = aad.data_id
-		WHERE aad.schemaname=$1 AND aad.tblname=$2 AND aad.content_date=$3`,
-		data.SchemaName,
-		data.TableName,
-		data.ContentDate,
-	).Scan(&expired)
-	if err != nil && err == pgx.ErrNoRows {
-		return true, nil
-	}
-	return expired, err
-}
-
-func (db *Store) FilesForRestore(ctx context.Context, dataID int, date time.Time) ([]*datastructs.RestoreData, error) {
-	var data []*datastructs.RestoreData
-	rows, err := db.Query(ctx,
-		"SELECT * FROM"+db.pgEntity("function", "files_for_restore")+"($1,$2);", dataID, date)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var (
-			d                          datastructs.RestoreData
-			restoreTempl, currentTempl pgtype.Varchar
-		)
-		if err := rows.Scan(
-			&d.ID,
-			&d.DataID,
-			&d.FileName,
-			&d.SchemaName,
-			&d.TableName,
-			&d.SingleTable,
-			&d.ContentDate,
-			&d.ContentRows,
-			&restoreTempl,
-			&currentTempl,
-		); err != nil {
-			return nil, err
-		}
-
-		if restoreTempl.Status != pgtype.Null {
-			d.RestoreTemplate = restoreTempl.String
-		}
-		if currentTempl.Status != pgtype.Null {
-			d.CurrentTemplate = currentTempl.String
-		}
-		data = append(data, &d)
-	}
-	return data, nil
-}
-
-func (db *Store) UpdateAvailableDataAfterRestoreFile(ctx context.Context, id int) error {
-	_, err := db.Exec(ctx,
-		"UPDATE"+db.pgEntity("table", "available_data")+"SET restored_at=now() WHERE id=$1", id)
-
-	return err
-}
-
-func (db *Store) RestoreData(ctx context.Context, data *datastructs.RestoreData, tmpFile io.Reader) error {
-	tx, err := db.Begin(ctx)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback(ctx)
-
-	if data.SingleTable {
-
-		if data.RestoreTemplate == "" || data.RestoreTemplate != data.CurrentTemplate {
-			return errors.New("no template for creating a table")
-		}
-
-		query := fmt.Sprintf(`SELECT public.f_clone_table_structure('%s.%s', '%s'::regclass);`, data.SchemaName, data.TableName, data.RestoreTemplate)
-		if _, err := tx.Exec(ctx, query); err != nil {
-			return fmt.Errorf("create table: %w", err)
-		}
-
-	}
-
-	ctxCopy, cancel := context.WithTimeout(ctx, time.Duration(5*time.Minute))
-	defer cancel()
-
-	query := fmt.Sprintf(`COPY %s.%s FROM STDIN WITH CSV NULL 'NULL' DELIMITER ';' HEADER ;`, data.SchemaName, data.TableName)
-	tag, err := tx.Conn().PgConn().CopyFrom(ctxCopy, tmpFile, query)
-	if err != nil {
-		return fmt.Errorf("copy from file or stdin to table:%s :%w", data.TableName, err)
-	}
-	if tag.RowsAffected() != data.ContentRows {
-		return errors.New("the number of restored rows does not match the declared")
-	}
-
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("commit transaction: %w", err)
-	}
-
-	return nil
-}
+package postgres
+
+import (
+	"captura-backup/internal/datastructs"
+	"captura-backup/internal/manifest"
+	"captura-backup/internal/store"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"gopkg.in/ini.v1"
+)
+
+type Store struct {
+	*pgxpool.Pool
+	ini *ini.File
+}
+
+func New(pool *pgxpool.Pool, ini *ini.File) store.Storer {
+	return &Store{pool, ini}
+}
+
+func (db *Store) pgEntity(entity, key string) string {
+	return fmt.Sprintf(" %s.%s ",
+		db.ini.Section("database").Key("schema").String(),
+		db.ini.Section("database."+entity).Key(key).String(),
+	)
+}
+
+func (db *Store) StateAndMessageService(ctx context.Context, state, message string) error {
+	_, err := db.Exec(ctx,
+		"SELECT FROM"+db.pgEntity("function", "state_and_message")+"($1,$2)", state, message)
+	return err
+}
+
+func (db *Store) ResetStateControl(ctx context.Context) error {
+	_, err := db.Exec(ctx,
+		"SELECT FROM"+db.pgEntity("function", "reset_state_control")+"()")
+	return err
+}
+
+func (db *Store) StateControl(ctx context.Context) (*datastructs.ControlPanel, error) {
+	var (
+		cp       datastructs.ControlPanel
+		archive  pgtype.Int4
+		thisDate pgtype.Date
+	)
+	if err := db.QueryRow(ctx,
+		`SELECT stop_manager, reload_config, start_recovery, restore_to_this_date, start_manual_backup, type_archive, start_key_rotation,
+		start_reconcile, reconcile_fix
+		FROM`+db.pgEntity("table", "service_control")).
+		Scan(
+			&cp.StopService,
+			&cp.ReloadConfig,
+			&cp.StartRecovery,
+			&thisDate,
+			&cp.StartManualBackup,
+			&archive,
+			&cp.StartKeyRotation,
+			&cp.StartReconcile,
+			&cp.ReconcileFix,
+		); err != nil {
+		return nil, err
+	}
+	if archive.Status != pgtype.Null {
+		cp.TypeArchive = int(archive.Int)
+	}
+	if thisDate.Status != pgtype.Null {
+		cp.RestoreToThisDate = thisDate.Time
+	}
+
+	return &cp, nil
+}
+
+// StorageDestinations returns the storage settings of the data types with the remote connection settings
+func (db *Store) StorageDestinations(ctx context.Context) ([]datastructs.StorageDestination, error) {
+	rows, err := db.Query(ctx,
+		`SELECT ss.data_id, ss.storage_name, ss.storage_path, ss.use_sftp, csf.host, csf.port, csf.username, csf.pass,
+		csf.auth_method, csf.time_out, csf.privat_key, COALESCE(ss.storage_period, 0), ss.auto_cleaning
+		FROM`+db.pgEntity("table", "storage_settings")+`ss
+		LEFT JOIN`+db.pgEntity("table", "config_sftp")+`csf ON ss.storage_name = csf.storage_name
+		ORDER BY ss.data_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var settings []datastructs.StorageDestination
+	for rows.Next() {
+		var (
+			d                                 datastructs.StorageDestination
+			useSFTP                           bool
+			host, port, user, pass, auth, key pgtype.Varchar
+			timeout                           pgtype.Int4
+		)
+		if err := rows.Scan(
+			&d.DataID,
+			&d.Name,
+			&d.Path,
+			&useSFTP,
+			&host,
+			&port,
+			&user,
+			&pass,
+			&auth,
+			&timeout,
+			&key,
+			&d.StoragePeriod,
+			&d.AutoCleaning,
+		); err != nil {
+			return nil, err
+		}
+		d.Protocol = "local"
+		if useSFTP {
+			d.Protocol = "sftp"
+		}
+		d.Host, d.Port, d.User = host.String, port.String, user.String
+		d.Password, d.AuthMethod, d.PrivateKey = pass.String, auth.String, key.String
+		d.Timeout = 10
+		if timeout.Status != pgtype.Null {
+			d.Timeout = int64(timeout.Int)
+		}
+		settings = append(settings, d)
+	}
+	return settings, rows.Err()
+}
+
+func (db *Store) ScheduleSettings(ctx context.Context) ([]*datastructs.ScheduleConfig, error) {
+	var scheduler []*datastructs.ScheduleConfig
+	rows, err := db.Query(ctx,
+		`SELECT data_id, check_interval, check_interval_days, work_start 
+		FROM`+db.pgEntity("table", "schedule_settings")+"WHERE enabled = TRUE",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sch datastructs.ScheduleConfig
+		if err := rows.Scan(
+			&sch.DataID,
+			&sch.CheckInterval,
+			&sch.CheckIntervalDays,
+			&sch.WorkStart,
+		); err != nil {
+			return nil, err
+		}
+		scheduler = append(scheduler, &sch)
+	}
+	return scheduler, nil
+}
+
+func (db *Store) DatasToArchive(ctx context.Context, id int) ([]*datastructs.ArchiveTable, error) {
+	var ats []*datastructs.ArchiveTable
+	rows, err := db.Query(ctx,
+		"SELECT * FROM"+db.pgEntity("function", "datas_to_archive")+"($1);", id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			at                                                  datastructs.ArchiveTable
+			entity, dateclmn, condfmt, rminterval, restTemplate pgtype.Varchar
+			parent, partitionBound                              pgtype.Varchar
+			action, archiveSchema, archiveTablespace            pgtype.Varchar
+			dobackup                                            pgtype.Bool
+			keepRestore                                         pgtype.Int4
+		)
+		if err := rows.Scan(
+			&at.Name,
+			&at.ID,
+			&entity,
+			&dateclmn,
+			&condfmt,
+			&rminterval,
+			&dobackup,
+			&parent,
+			&partitionBound,
+			&restTemplate,
+			&keepRestore,
+			&action,
+			&archiveSchema,
+			&archiveTablespace,
+		); err != nil {
+			return nil, err
+		}
+
+		if entity.Status != pgtype.Null {
+			at.Entity = entity.String
+		}
+		if dateclmn.Status != pgtype.Null {
+			at.DateColumn = dateclmn.String
+		}
+		if condfmt.Status != pgtype.Null {
+			at.DateColumn = dateclmn.String
+		}
+		if rminterval.Status != pgtype.Null {
+			at.RmInterval = rminterval.String
+		}
+		if dobackup.Status != pgtype.Null {
+			at.DoBackup = dobackup.Bool
+		}
+		if restTemplate.Status != pgtype.Null {
+			at.RestoreTemplate = restTemplate.String
+		}
+		if keepRestore.Status != pgtype.Null {
+			at.KeepRestore = int(keepRestore.Int)
+		}
+		if parent.Status != pgtype.Null {
+			at.Parent = parent.String
+		}
+		if partitionBound.Status != pgtype.Null {
+			at.PartitionBound = partitionBound.String
+		}
+		if action.Status != pgtype.Null {
+			at.Action = action.String
+		}
+		if archiveSchema.Status != pgtype.Null {
+			at.ArchiveSchema = archiveSchema.String
+		}
+		if archiveTablespace.Status != pgtype.Null {
+			at.ArchiveTablespace = archiveTablespace.String
+		}
+
+		ats = append(ats, &at)
+	}
+	return ats, nil
+}
+
+func (db *Store) DatesToBackup(ctx context.Context, data *datastructs.ArchiveTable) ([]time.Time, error) {
+	// SELECT DISTINCT "ST_Date" FROM billdb_rec.rec_6_40_cdr WHERE "ST_Date" < (current_date - '6 MONTH'::INTERVAL)::DATE
+	// SELECT DISTINCT DateColumn FROM Name WHERE DateColumn < (current_date - RmInterval::INTERVAL)::DATE
+	var dates []time.Time
+	sql := fmt.Sprintf(`SELECT DISTINCT %s FROM %s WHERE %s < (current_date - '%s'::INTERVAL)::DATE`, data.DateColumn, data.Name, data.DateColumn, data.RmInterval)
+	rows, err := db.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var date time.Time
+		if err := rows.Scan(&date); err != nil {
+			return nil, err
+		}
+		dates = append(dates, date)
+	}
+	return dates, nil
+}
+
+func (db *Store) SaveDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, tmpFile *os.File) (int64, error) {
+	gzWriter := gzip.NewWriter(tmpFile)
+	gzWriter.Extra = manifest.GzipExtra(data.TableDDL)
+	defer gzWriter.Close()
+
+	return db.CopyDataForDay(ctx, data, day, gzWriter)
+}
+
+// CopyDataForDay writes the rows of the day as the CSV with the header
+func (db *Store) CopyDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, w io.Writer) (int64, error) {
+	con, err := db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection from pgpool: %w", err)
+	}
+	defer con.Release()
+
+	query := fmt.Sprintf(
+		`COPY (SELECT * FROM %s WHERE %s = '%s') TO STDOUT WITH CSV NULL 'NULL' DELIMITER ';' HEADER ;`,
+		data.Name,
+		data.DateColumn,
+		day.Format("2006-01-02"))
+
+	ctxCopy, cancel := context.WithTimeout(ctx, time.Duration(5*time.Minute))
+	defer cancel()
+	tag, err := con.Conn().PgConn().CopyTo(ctxCopy, w, query)
+	if err != nil {
+		return 0, fmt.Errorf("copy data to file from table: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+func (db *Store) DeleteDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, rowsSave int64) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction:%w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE %s = '%s'`,
+		data.Name,
+		data.DateColumn,
+		day.Format("2006-01-02"))
+	tag, err := tx.Exec(ctx, query)
+
+	if err != nil {
+		return fmt.Errorf("execute transaction: %w", err)
+	}
+	if tag.RowsAffected() != rowsSave {
+		return errors.New("the number of saved and deleted records do not match")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (db *Store) DeleteTable(ctx context.Context, table string) (err error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction:%w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DROP TABLE IF EXISTS "+table); err != nil {
+		return fmt.Errorf("execute transaction: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// DropPartition detaches the partition from the partitioned table and drops it, the partition with rows is kept
+func (db *Store) DropPartition(ctx context.Context, parent, partition string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction:%w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var empty bool
+	if err := tx.QueryRow(ctx, "SELECT NOT EXISTS (SELECT FROM "+partition+")").Scan(&empty); err != nil {
+		return fmt.Errorf("check rows: %w", err)
+	}
+	if !empty {
+		return errors.New("the partition is not empty")
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", parent, partition)); err != nil {
+		return fmt.Errorf("detach partition: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DROP TABLE "+partition); err != nil {
+		return fmt.Errorf("drop partition: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// TableTablespace returns the tablespace of the table, the tablespace of the database if it is not set,
+// or "" if the table does not exist
+func (db *Store) TableTablespace(ctx context.Context, table string) (string, error) {
+	var tablespace string
+	err := db.QueryRow(ctx,
+		`SELECT COALESCE(ts.spcname, dts.spcname)
+		FROM pg_class c
+		LEFT JOIN pg_tablespace ts ON ts.oid = c.reltablespace
+		JOIN pg_database d ON d.datname = current_database()
+		JOIN pg_tablespace dts ON dts.oid = d.dattablespace
+		WHERE c.oid = to_regclass($1)`,
+		table,
+	).Scan(&tablespace)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return tablespace, err
+}
+
+// MoveTable moves the table with its indexes into the tablespace and then into the schema, the schema of the table
+// is not set again. The tablespace of the table before the move is the default tablespace of the database if it was not set.
+func (db *Store) MoveTable(ctx context.Context, table, schema, tablespace string) (string, int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", 0, fmt.Errorf("begin transaction:%w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		source, current string
+		rows            int64
+	)
+	if err := tx.QueryRow(ctx,
+		`SELECT COALESCE(ts.spcname, dts.spcname), c.relnamespace::regnamespace::text
+		FROM pg_class c
+		LEFT JOIN pg_tablespace ts ON ts.oid = c.reltablespace
+		JOIN pg_database d ON d.datname = current_database()
+		JOIN pg_tablespace dts ON dts.oid = d.dattablespace
+		WHERE c.oid = $1::regclass`,
+		table,
+	).Scan(&source, &current); err != nil {
+		return "", 0, fmt.Errorf("get tablespace: %w", err)
+	}
+	if err := tx.QueryRow(ctx, "SELECT count(*) FROM "+table).Scan(&rows); err != nil {
+		return "", 0, fmt.Errorf("count rows: %w", err)
+	}
+
+	if tablespace != "" {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s SET TABLESPACE %s", table, tablespace)); err != nil {
+			return "", 0, fmt.Errorf("set tablespace: %w", err)
+		}
+		var indexes []string
+		rs, err := tx.Query(ctx, "SELECT indexrelid::regclass::text FROM pg_index WHERE indrelid = $1::regclass", table)
+		if err != nil {
+			return "", 0, fmt.Errorf("get indexes: %w", err)
+		}
+		for rs.Next() {
+			var index string
+			if err := rs.Scan(&index); err != nil {
+				rs.Close()
+				return "", 0, fmt.Errorf("get indexes: %w", err)
+			}
+			indexes = append(indexes, index)
+		}
+		rs.Close()
+		for _, index := range indexes {
+			if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER INDEX %s SET TABLESPACE %s", index, tablespace)); err != nil {
+				return "", 0, fmt.Errorf("set tablespace of index: %w", err)
+			}
+		}
+	}
+	if schema != "" && schema != current {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s SET SCHEMA %s", table, schema)); err != nil {
+			return "", 0, fmt.Errorf("set schema: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	return source, rows, nil
+}
+
+// restorePartition creates the partition by the columns of the partitioned table and attaches it with the bound
+// of the archive. The archives of the partition restored at the same time wait for the one creating it.
+func restorePartition(ctx context.Context, tx pgx.Tx, data *datastructs.RestoreData) error {
+	name := data.SchemaName + "." + data.TableName
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", name); err != nil {
+		return fmt.Errorf("lock partition: %w", err)
+	}
+
+	var exists, attached bool
+	if err := tx.QueryRow(ctx,
+		"SELECT to_regclass($1) IS NOT NULL, COALESCE((SELECT relispartition FROM pg_class WHERE oid = to_regclass($1)), false)",
+		name,
+	).Scan(&exists, &attached); err != nil {
+		return fmt.Errorf("check partition: %w", err)
+	}
+	if !exists {
+		query := fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING CONSTRAINTS INCLUDING STORAGE)", name, data.Parent)
+		if _, err := tx.Exec(ctx, query); err != nil {
+			return fmt.Errorf("create partition: %w", err)
+		}
+	}
+	if !attached {
+		query := fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s %s", data.Parent, name, data.PartitionBound)
+		if _, err := tx.Exec(ctx, query); err != nil {
+			return fmt.Errorf("attach partition: %w", err)
+		}
+	}
+	return nil
+}
+
+// AddArchAvailableData adds the archive to the catalog and returns its ID
+func (db *Store) AddArchAvailableData(ctx context.Context, d datastructs.ArchAvailableData) (int, error) {
+	var id int
+	err := db.QueryRow(ctx,
+		"SELECT * FROM"+db.pgEntity("function", "add_available_data")+"($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18);",
+		d.DataID,
+		d.SchemaName,
+		d.TableName,
+		d.SingleTable,
+		d.FileName,
+		d.ContentDate,
+		d.ContentRows,
+		d.ArchivedAt,
+		nullVarchar(d.RestoreTemplate),
+		nullVarchar(d.KeyID),
+		d.FileSize,
+		nullVarchar(d.Checksum),
+		nullVarchar(d.Storage),
+		nullVarchar(d.Parent),
+		nullVarchar(d.PartitionBound),
+		nullVarchar(d.Action),
+		nullVarchar(d.SourceTablespace),
+		nullVarchar(d.TableDDL),
+	).Scan(&id)
+	return id, err
+}
+
+func nullVarchar(s string) pgtype.Varchar {
+	if s == "" {
+		return pgtype.Varchar{Status: pgtype.Null}
+	}
+	return pgtype.Varchar{String: s, Status: pgtype.Present}
+}
+
+func (db *Store) StoragesForCleaner(ctx context.Context) ([]datastructs.ArchiveStorage, error) {
+	rows, err := db.Query(ctx,
+		"SELECT id, schemaname, COALESCE(date_clmn, ''), keep_arch_days, keep_months, keep_last, keep_yearly FROM"+db.pgEntity("table", "config_table_list")+"WHERE keep_arch_days > 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ass []datastructs.ArchiveStorage
+	for rows.Next() {
+		var as datastructs.ArchiveStorage
+		if err := rows.Scan(
+			&as.DataID,
+			&as.Schemaname,
+			&as.DateColumn,
+			&as.KeepArchDays,
+			&as.KeepMonths,
+			&as.KeepLast,
+			&as.KeepYearly,
+		); err != nil {
+			return nil, err
+		}
+		ass = append(ass, as)
+	}
+	return ass, nil
+}
+
+func (db *Store) UpdateAvailableDataAfterRemoveFile(ctx context.Context, data datastructs.ArchAvailableData) error {
+	_, err := db.Exec(ctx,
+		"UPDATE"+db.pgEntity("table", "available_data")+"SET deleted_at=$1 WHERE schemaname=$2 AND tblname=$3 AND content_date=$4",
+		data.DeletedAt,
+		data.SchemaName,
+		data.TableName,
+		data.ContentDate,
+	)
+	return err
+}
+
+func (db *Store) WasRestoredAndExpired(ctx context.Context, data datastructs.ArchAvailableData) (bool, error) {
+	var expired bool
+	err := db.QueryRow(ctx,
+		`SELECT (COALESCE(aad.restored_at, to_timestamp(0))::date + ctl.keep_restore_days) < now()::date
+		FROM`+db.pgEntity("table", "available_data")+`aad 
+		JOIN`+db.pgEntity("table", "config_table_list")+`ctl ON ctl.id = aad.data_id
+		WHERE aad.schemaname=$1 AND aad.tblname=$2 AND aad.content_date=$3`,
+		data.SchemaName,
+		data.TableName,
+		data.ContentDate,
+	).Scan(&expired)
+	if err != nil && err == pgx.ErrNoRows {
+		return true, nil
+	}
+	return expired, err
+}
+
+func (db *Store) FilesForRestore(ctx context.Context, dataID int, date time.Time) ([]*datastructs.RestoreData, error) {
+	var data []*datastructs.RestoreData
+	rows, err := db.Query(ctx,
+		"SELECT * FROM"+db.pgEntity("function", "files_for_restore")+"($1,$2);", dataID, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			d                          datastructs.RestoreData
+			restoreTempl, currentTempl pgtype.Varchar
+			storageName, checksum      pgtype.Varchar
+			dateColumn                 pgtype.Varchar
+			parent, partitionBound     pgtype.Varchar
+			action, sourceTablespace   pgtype.Varchar
+			tableDDL                   pgtype.Text
+		)
+		if err := rows.Scan(
+			&d.ID,
+			&d.DataID,
+			&d.FileName,
+			&d.SchemaName,
+			&d.TableName,
+			&d.SingleTable,
+			&d.ContentDate,
+			&d.ContentRows,
+			&restoreTempl,
+			&currentTempl,
+			&storageName,
+			&checksum,
+			&dateColumn,
+			&parent,
+			&partitionBound,
+			&action,
+			&sourceTablespace,
+			&tableDDL,
+		); err != nil {
+			return nil, err
+		}
+
+		if restoreTempl.Status != pgtype.Null {
+			d.RestoreTemplate = restoreTempl.String
+		}
+		if currentTempl.Status != pgtype.Null {
+			d.CurrentTemplate = currentTempl.String
+		}
+		if storageName.Status != pgtype.Null {
+			d.Storage = storageName.String
+		}
+		if checksum.Status != pgtype.Null {
+			d.Checksum = checksum.String
+		}
+		if dateColumn.Status != pgtype.Null {
+			d.DateColumn = dateColumn.String
+		}
+		if parent.Status != pgtype.Null {
+			d.Parent = parent.String
+		}
+		if partitionBound.Status != pgtype.Null {
+			d.PartitionBound = partitionBound.String
+		}
+		if action.Status != pgtype.Null {
+			d.Action = action.String
+		}
+		if sourceTablespace.Status != pgtype.Null {
+			d.SourceTablespace = sourceTablespace.String
+		}
+		if tableDDL.Status != pgtype.Null {
+			d.TableDDL = tableDDL.String
+		}
+		data = append(data, &d)
+	}
+	return data, nil
+}
+
+func (db *Store) UpdateAvailableDataAfterRestoreFile(ctx context.Context, id int) error {
+	_, err := db.Exec(ctx,
+		"UPDATE"+db.pgEntity("table", "available_data")+"SET restored_at=now() WHERE id=$1", id)
+
+	return err
+}
+
+func (db *Store) RestoreData(ctx context.Context, data *datastructs.RestoreData, tmpFile io.Reader) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if data.Parent != "" {
+		if err := restorePartition(ctx, tx, data); err != nil {
+			return err
+		}
+	} else if data.SingleTable {
+		switch {
+		case data.RestoreTemplate != "" && data.RestoreTemplate == data.CurrentTemplate:
+			query := fmt.Sprintf(`SELECT public.f_clone_table_structure('%s.%s', '%s'::regclass);`, data.SchemaName, data.TableName, data.RestoreTemplate)
+			if _, err := tx.Exec(ctx, query); err != nil {
+				return fmt.Errorf("create table: %w", err)
+			}
+		case data.TableDDL != "":
+			// the table is created by its definition at the backup, the sequences of the dropped table do not exist anymore
+			if _, err := tx.Exec(ctx, sequenceDefault.ReplaceAllString(data.TableDDL, "")); err != nil {
+				return fmt.Errorf("create table by its definition: %w", err)
+			}
+		default:
+			return errors.New("no template or definition for creating a table")
+		}
+	}
+
+	ctxCopy, cancel := context.WithTimeout(ctx, time.Duration(5*time.Minute))
+	defer cancel()
+
+	query := fmt.Sprintf(`COPY %s.%s FROM STDIN WITH CSV NULL 'NULL' DELIMITER ';' HEADER ;`, data.SchemaName, data.TableName)
+	tag, err := tx.Conn().PgConn().CopyFrom(ctxCopy, tmpFile, query)
+	if err != nil {
+		return fmt.Errorf("copy from file or stdin to table:%s :%w", data.TableName, err)
+	}
+	if tag.RowsAffected() != data.ContentRows {
+		return errors.New("the number of restored rows does not match the declared")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// availableDataColumns is the list of arch_available_data columns read by scanAvailableData
+const availableDataColumns = ` id, data_id, schemaname, tblname, blsingle_tbl_arch, file_name, content_date, content_rows,
+	archived_at, restore_template, key_id, file_size, checksum, deleted_at, storage_name, archive_action, source_tablespace `
+
+func scanAvailableData(rows pgx.Rows) ([]datastructs.ArchAvailableData, error) {
+	var data []datastructs.ArchAvailableData
+	for rows.Next() {
+		var (
+			d                       datastructs.ArchAvailableData
+			restTemplate, key, hash pgtype.Varchar
+			storageName, action     pgtype.Varchar
+			sourceTablespace        pgtype.Varchar
+			size                    pgtype.Int8
+			deleted                 pgtype.Timestamptz
+		)
+		if err := rows.Scan(
+			&d.ID,
+			&d.DataID,
+			&d.SchemaName,
+			&d.TableName,
+			&d.SingleTable,
+			&d.FileName,
+			&d.ContentDate,
+			&d.ContentRows,
+			&d.ArchivedAt,
+			&restTemplate,
+			&key,
+			&size,
+			&hash,
+			&deleted,
+			&storageName,
+			&action,
+			&sourceTablespace,
+		); err != nil {
+			return nil, err
+		}
+		d.SourceTablespace = sourceTablespace.String
+		if restTemplate.Status != pgtype.Null {
+			d.RestoreTemplate = restTemplate.String
+		}
+		if key.Status != pgtype.Null {
+			d.KeyID = key.String
+		}
+		if size.Status != pgtype.Null {
+			d.FileSize = size.Int
+		}
+		if hash.Status != pgtype.Null {
+			d.Checksum = hash.String
+		}
+		if deleted.Status != pgtype.Null {
+			d.DeletedAt = deleted.Time
+		}
+		if storageName.Status != pgtype.Null {
+			d.Storage = storageName.String
+		}
+		if action.Status != pgtype.Null {
+			d.Action = action.String
+		}
+		data = append(data, d)
+	}
+	return data, rows.Err()
+}
+
+func (db *Store) ArchivesForKeyRotation(ctx context.Context, keyID string) ([]datastructs.ArchAvailableData, error) {
+	rows, err := db.Query(ctx,
+		"SELECT"+availableDataColumns+"FROM"+db.pgEntity("table", "available_data")+
+			"WHERE deleted_at IS NULL AND key_id IS DISTINCT FROM $1 ORDER BY id", keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanAvailableData(rows)
+}
+
+func (db *Store) UpdateArchiveKey(ctx context.Context, id int, keyID string, fileSize int64) error {
+	_, err := db.Exec(ctx,
+		"UPDATE"+db.pgEntity("table", "available_data")+"SET key_id=$1, file_size=$2 WHERE id=$3", nullVarchar(keyID), fileSize, id)
+	return err
+}
+
+// AvailableArchives returns not deleted archives with the content date in the range, dataID = 0 means all data types
+func (db *Store) AvailableArchives(ctx context.Context, dataID int, from, to time.Time) ([]datastructs.ArchAvailableData, error) {
+	rows, err := db.Query(ctx,
+		"SELECT"+availableDataColumns+"FROM"+db.pgEntity("table", "available_data")+
+			"WHERE deleted_at IS NULL AND content_date BETWEEN $1 AND $2 AND ($3 = 0 OR data_id = $3) ORDER BY content_date, id",
+		from, to, dataID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanAvailableData(rows)
+}
+
+// TableDDL returns the statement creating the table with the same columns, types, defaults, identities
+// and constraints, followed by the statements creating the indexes not made by the constraints.
+// The foreign keys are skipped, the referenced rows may be archived.
+func (db *Store) TableDDL(ctx context.Context, table string) (string, error) {
+	var ddl string
+	err := db.QueryRow(ctx,
+		`SELECT format('CREATE TABLE %s (%s);', c.oid::regclass, concat_ws(', ', cols.list, cons.list)) || COALESCE(' ' || idx.list, '')
+		FROM pg_class c,
+		LATERAL (SELECT string_agg(format('%I %s%s%s%s', a.attname, format_type(a.atttypid, a.atttypmod),
+				CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END,
+				COALESCE(' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid), ''),
+				CASE a.attidentity
+					WHEN 'a' THEN ' GENERATED ALWAYS AS IDENTITY'
+					WHEN 'd' THEN ' GENERATED BY DEFAULT AS IDENTITY'
+					ELSE '' END), ', ' ORDER BY a.attnum) list
+			FROM pg_attribute a
+			LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+			WHERE a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped) cols,
+		LATERAL (SELECT string_agg(format('CONSTRAINT %I %s', con.conname, pg_get_constraintdef(con.oid)), ', ' ORDER BY con.conname) list
+			FROM pg_constraint con
+			WHERE con.conrelid = c.oid AND con.contype IN ('p', 'u', 'c', 'x')) cons,
+		LATERAL (SELECT string_agg(pg_get_indexdef(i.indexrelid) || ';', ' ' ORDER BY i.indexrelid) list
+			FROM pg_index i
+			WHERE i.indrelid = c.oid AND NOT EXISTS (SELECT FROM pg_constraint con WHERE con.conrelid = c.oid AND con.conindid = i.indexrelid)) idx
+		WHERE c.oid = $1::text::regclass`,
+		table,
+	).Scan(&ddl)
+	return ddl, err
+}
+
+// EstimateDaySize estimates the size of the data of one day in the table by the statistics of the table:
+// the size of the table divided by the number of the distinct dates of the date column.
+func (db *Store) EstimateDaySize(ctx context.Context, data *datastructs.ArchiveTable) (int64, error) {
+	var size int64
+	err := db.QueryRow(ctx,
+		`SELECT (pg_table_size(c.oid) / GREATEST(CASE
+				WHEN s.n_distinct > 0 THEN s.n_distinct
+				WHEN s.n_distinct < 0 THEN -s.n_distinct * c.reltuples
+				ELSE 1 END, 1))::int8
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_stats s ON s.schemaname = n.nspname AND s.tablename = c.relname AND s.attname = $2
+		WHERE c.oid = $1::text::regclass`,
+		data.Name, strings.Trim(data.DateColumn, `"`),
+	).Scan(&size)
+	return size, err
+}
+
+// StorageUsage returns the size of the archive files and their written copies by the storage, the archives
+// of the default storage written before the named storages have the empty name
+func (db *Store) StorageUsage(ctx context.Context) (map[string]int64, error) {
+	rows, err := db.Query(ctx,
+		`SELECT name, SUM(size)::int8 FROM (
+			SELECT COALESCE(storage_name, '') AS name, COALESCE(file_size, 0) AS size
+			FROM`+db.pgEntity("table", "available_data")+`WHERE deleted_at IS NULL
+			UNION ALL
+			SELECT ac.storage_name, COALESCE(aad.file_size, 0)
+			FROM`+db.pgEntity("table", "archive_copies")+`ac
+			JOIN`+db.pgEntity("table", "available_data")+`aad ON aad.id = ac.available_data_id
+			WHERE ac.status = 'ok' AND aad.deleted_at IS NULL
+		) u GROUP BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usage := make(map[string]int64)
+	for rows.Next() {
+		var (
+			name string
+			size int64
+		)
+		if err := rows.Scan(&name, &size); err != nil {
+			return nil, err
+		}
+		usage[name] = size
+	}
+	return usage, rows.Err()
+}
+
+// ArchiveDataType returns the catalog fields of the data type that the table belongs to
+func (db *Store) ArchiveDataType(ctx context.Context, schema, table string) (datastructs.ArchAvailableData, error) {
+	var (
+		d            datastructs.ArchAvailableData
+		restTemplate pgtype.Varchar
+	)
+	err := db.QueryRow(ctx,
+		`SELECT id, schemaname, quote_ident($2), entity = 'table', restore_template
+		FROM`+db.pgEntity("table", "config_table_list")+`
+		WHERE schemaname = $1 AND $2 ~ tblname_pattern ORDER BY id LIMIT 1`,
+		schema, table,
+	).Scan(
+		&d.DataID,
+		&d.SchemaName,
+		&d.TableName,
+		&d.SingleTable,
+		&restTemplate,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return d, store.ErrNoDataType
+	}
+	if err != nil {
+		return d, err
+	}
+	if restTemplate.Status != pgtype.Null {
+		d.RestoreTemplate = restTemplate.String
+	}
+	return d, nil
+}
+
+// CatalogArchives returns all archives of the catalog including deleted ones
+func (db *Store) CatalogArchives(ctx context.Context) ([]datastructs.ArchAvailableData, error) {
+	rows, err := db.Query(ctx,
+		"SELECT"+availableDataColumns+"FROM"+db.pgEntity("table", "available_data")+"ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanAvailableData(rows)
+}
+
+func (db *Store) MarkArchiveDeleted(ctx context.Context, id int, deletedAt time.Time) error {
+	_, err := db.Exec(ctx,
+		"UPDATE"+db.pgEntity("table", "available_data")+"SET deleted_at=$1 WHERE id=$2", deletedAt, id)
+	return err
+}
+
+// MoveArchive sets the storage and the file name of the archive moved to another storage
+func (db *Store) MoveArchive(ctx context.Context, id int, storage, fileName string) error {
+	_, err := db.Exec(ctx,
+		"UPDATE"+db.pgEntity("table", "available_data")+"SET storage_name=$1, file_name=$2 WHERE id=$3", storage, fileName, id)
+	return err
+}
+
+// DeletedArchives returns deleted archives with the content date in the range, dataID = 0 means all data types
+func (db *Store) DeletedArchives(ctx context.Context, dataID int, from, to time.Time) ([]datastructs.ArchAvailableData, error) {
+	rows, err := db.Query(ctx,
+		"SELECT"+availableDataColumns+"FROM"+db.pgEntity("table", "available_data")+
+			"WHERE deleted_at IS NOT NULL AND content_date BETWEEN $1 AND $2 AND ($3 = 0 OR data_id = $3) ORDER BY content_date, id",
+		from, to, dataID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanAvailableData(rows)
+}
+
+func (db *Store) MarkArchiveRestoredFromTrash(ctx context.Context, id int) error {
+	_, err := db.Exec(ctx,
+		"UPDATE"+db.pgEntity("table", "available_data")+"SET deleted_at=NULL WHERE id=$1", id)
+	return err
+}
+
+func (db *Store) SaveReconcileReport(ctx context.Context, checkedAt time.Time, issues []datastructs.ReconcileIssue) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, issue := range issues {
+		id := pgtype.Int4{Status: pgtype.Null}
+		if issue.AvailableDataID != 0 {
+			id = pgtype.Int4{Int: int32(issue.AvailableDataID), Status: pgtype.Present}
+		}
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO"+db.pgEntity("table", "reconcile_report")+
+				"(checked_at, available_data_id, issue, file_name, details, fixed) VALUES ($1, $2, $3, $4, $5, $6)",
+			checkedAt,
+			id,
+			issue.Issue,
+			issue.FileName,
+			nullVarchar(issue.Details),
+			issue.Fixed,
+		); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (db *Store) ActiveLegalHolds(ctx context.Context) ([]datastructs.LegalHold, error) {
+	rows, err := db.Query(ctx,
+		`SELECT id, data_id, available_data_id, schemaname, date_from, date_to, reason
+		FROM`+db.pgEntity("table", "legal_hold")+"WHERE released_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var holds []datastructs.LegalHold
+	for rows.Next() {
+		var (
+			h                 datastructs.LegalHold
+			dataID, archiveID pgtype.Int4
+			schema            pgtype.Varchar
+			from, to          pgtype.Date
+		)
+		if err := rows.Scan(
+			&h.ID,
+			&dataID,
+			&archiveID,
+			&schema,
+			&from,
+			&to,
+			&h.Reason,
+		); err != nil {
+			return nil, err
+		}
+		if dataID.Status != pgtype.Null {
+			h.DataID = int(dataID.Int)
+		}
+		if archiveID.Status != pgtype.Null {
+			h.AvailableDataID = int(archiveID.Int)
+		}
+		if schema.Status != pgtype.Null {
+			h.SchemaName = schema.String
+		}
+		if from.Status != pgtype.Null {
+			h.DateFrom = from.Time
+		}
+		if to.Status != pgtype.Null {
+			h.DateTo = to.Time
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+// SaveArchiveCopy adds or updates the copy of the archive, the attempts of the pending copy are counted
+func (db *Store) SaveArchiveCopy(ctx context.Context, c datastructs.ArchiveCopy) error {
+	_, err := db.Exec(ctx,
+		"INSERT INTO"+db.pgEntity("table", "archive_copies")+`AS ac (available_data_id, storage_name, file_name, status, attempts, last_error)
+		VALUES ($1, $2, $3, $4, CASE WHEN $4 = 'pending' THEN 1 ELSE 0 END, $5)
+		ON CONFLICT (available_data_id, storage_name) DO UPDATE SET file_name = $3, status = $4,
+		attempts = CASE WHEN $4 = 'pending' THEN ac.attempts + 1 ELSE 0 END, last_error = $5, updated_at = now()`,
+		c.AvailableDataID,
+		c.Storage,
+		c.FileName,
+		c.Status,
+		nullVarchar(c.Error),
+	)
+	return err
+}
+
+// ArchiveCopies returns the not deleted copies of the archive, id = 0 means the copies of all archives
+func (db *Store) ArchiveCopies(ctx context.Context, id int) ([]datastructs.ArchiveCopy, error) {
+	rows, err := db.Query(ctx,
+		`SELECT ac.available_data_id, ac.storage_name, ac.file_name, ac.status, ac.attempts, aad.file_name, aad.storage_name
+		FROM`+db.pgEntity("table", "archive_copies")+`ac
+		JOIN`+db.pgEntity("table", "available_data")+`aad ON aad.id = ac.available_data_id
+		WHERE ac.status <> 'deleted' AND ($1 = 0 OR ac.available_data_id = $1) ORDER BY ac.available_data_id, ac.storage_name`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanArchiveCopies(rows)
+}
+
+// PendingArchiveCopies returns the copies that are not written yet of the not deleted archives
+func (db *Store) PendingArchiveCopies(ctx context.Context) ([]datastructs.ArchiveCopy, error) {
+	rows, err := db.Query(ctx,
+		`SELECT ac.available_data_id, ac.storage_name, ac.file_name, ac.status, ac.attempts, aad.file_name, aad.storage_name
+		FROM`+db.pgEntity("table", "archive_copies")+`ac
+		JOIN`+db.pgEntity("table", "available_data")+`aad ON aad.id = ac.available_data_id
+		WHERE ac.status = 'pending' AND aad.deleted_at IS NULL ORDER BY ac.available_data_id, ac.storage_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanArchiveCopies(rows)
+}
+
+func scanArchiveCopies(rows pgx.Rows) ([]datastructs.ArchiveCopy, error) {
+	var copies []datastructs.ArchiveCopy
+	for rows.Next() {
+		var (
+			c             datastructs.ArchiveCopy
+			sourceStorage pgtype.Varchar
+		)
+		if err := rows.Scan(
+			&c.AvailableDataID,
+			&c.Storage,
+			&c.FileName,
+			&c.Status,
+			&c.Attempts,
+			&c.SourceFileName,
+			&sourceStorage,
+		); err != nil {
+			return nil, err
+		}
+		if sourceStorage.Status != pgtype.Null {
+			c.SourceStorage = sourceStorage.String
+		}
+		copies = append(copies, c)
+	}
+	return copies, rows.Err()
+}
+
+// SetArchiveCopiesStatus sets the status of all copies of the archive
+func (db *Store) SetArchiveCopiesStatus(ctx context.Context, id int, status string) error {
+	_, err := db.Exec(ctx,
+		"UPDATE"+db.pgEntity("table", "archive_copies")+"SET status = $1, attempts = 0, updated_at = now() WHERE available_data_id = $2",
+		status, id)
+	return err
+}
@@ -1,38 +1,102 @@
-package store
-
-import (
-	"captura-backup/internal/datastructs"
-	"context"
-	"io"
-	"os"
-	"time"
-)
-
-// Storer ...
-type Storer interface {
-
-	//service and control
-	ScheduleSettings(ctx context.Context) ([]*datastructs.ScheduleConfig, error)
-	ResetStateControl(ctx context.Context) error
-	StateAndMessageService(ctx context.Context, state, message string) error
-	StateControl(ctx context.Context) (*datastructs.ControlPanel, error)
-
-	//backup process
-	DatasToArchive(ctx context.Context, id int) ([]*datastructs.ArchiveTable, error)
-	DatesToBackup(ctx context.Context, data *datastructs.ArchiveTable) ([]time.Time, error)
-	WasRestoredAndExpired(ctx context.Context, data datastructs.ArchAvailableData) (bool, error)
-	SaveDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, tmpFile *os.File) (int64, error)
-	DeleteDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, rowsSave int64) error
-	AddArchAvailableData(ctx context.Context, data datastructs.ArchAvailableData) error
-	DeleteTable(ctx context.Context, table string) error
-
-	//storage clean process
-	StoragesForCleaner(ctx context.Context) ([]datastructs.ArchiveStorage, error)
-	UpdateAvailableDataAfterRemoveFile(ctx context.Context, data datastructs.ArchAvailableData) error
-	
-	//restore process
-	FilesForRestore(ctx context.Context, archive int, date time.Time) ([]*datastructs.RestoreData, error)
-	RestoreData(ctx context.Context, data *datastructs.RestoreData, tmpFile io.Reader) error
-	UpdateAvailableDataAfterRestoreFile(ctx context.Context, id int) error
-
-}
+package store
+
+import (
+	"captura-backup/internal/datastructs"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrNoDataType is returned by ArchiveDataType if no data type matches the table
+var ErrNoDataType = errors.New("no data type of the table")
+
+// Storer ...
+type Storer interface {
+
+	//service and control
+	ScheduleSettings(ctx context.Context) ([]*datastructs.ScheduleConfig, error)
+	ResetStateControl(ctx context.Context) error
+	StateAndMessageService(ctx context.Context, state, message string) error
+	StateControl(ctx context.Context) (*datastructs.ControlPanel, error)
+	StorageDestinations(ctx context.Context) ([]datastructs.StorageDestination, error)
+
+	//backup process
+	DatasToArchive(ctx context.Context, id int) ([]*datastructs.ArchiveTable, error)
+	DatesToBackup(ctx context.Context, data *datastructs.ArchiveTable) ([]time.Time, error)
+	WasRestoredAndExpired(ctx context.Context, data datastructs.ArchAvailableData) (bool, error)
+	SaveDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, tmpFile *os.File) (int64, error)
+	CopyDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, w io.Writer) (int64, error)
+	DeleteDataForDay(ctx context.Context, data *datastructs.ArchiveTable, day time.Time, rowsSave int64) error
+	AddArchAvailableData(ctx context.Context, data datastructs.ArchAvailableData) (int, error)
+	DeleteTable(ctx context.Context, table string) error
+	DropPartition(ctx context.Context, parent, partition string) error
+	// MoveTable moves the table into the schema and the tablespace, the empty schema or tablespace is not changed.
+	// It returns the tablespace of the table before the move and the number of its rows.
+	MoveTable(ctx context.Context, table, schema, tablespace string) (string, int64, error)
+	// TableTablespace returns the tablespace of the table or "" if the table does not exist
+	TableTablespace(ctx context.Context, table string) (string, error)
+	// TableDDL returns the statements creating the table with its columns, defaults, identities and constraints
+	// except the foreign keys, followed by the indexes not made by the constraints. The archived table is created
+	// by them without the template
+	TableDDL(ctx context.Context, table string) (string, error)
+	EstimateDaySize(ctx context.Context, data *datastructs.ArchiveTable) (int64, error)
+	StorageUsage(ctx context.Context) (map[string]int64, error)
+
+	//storage clean process
+	StoragesForCleaner(ctx context.Context) ([]datastructs.ArchiveStorage, error)
+	UpdateAvailableDataAfterRemoveFile(ctx context.Context, data datastructs.ArchAvailableData) error
+	
+	//restore process
+	FilesForRestore(ctx context.Context, archive int, date time.Time) ([]*datastructs.RestoreData, error)
+	RestoreData(ctx context.Context, data *datastructs.RestoreData, tmpFile io.Reader) error
+	UpdateAvailableDataAfterRestoreFile(ctx context.Context, id int) error
+
+	//key rotation process
+	ArchivesForKeyRotation(ctx context.Context, keyID string) ([]datastructs.ArchAvailableData, error)
+	UpdateArchiveKey(ctx context.Context, id int, keyID string, fileSize int64) error
+
+	//archives verification
+	AvailableArchives(ctx context.Context, dataID int, from, to time.Time) ([]datastructs.ArchAvailableData, error)
+
+	//catalog rebuild
+	ArchiveDataType(ctx context.Context, schema, table string) (datastructs.ArchAvailableData, error)
+
+	//storage and catalog reconciliation
+	CatalogArchives(ctx context.Context) ([]datastructs.ArchAvailableData, error)
+	MarkArchiveDeleted(ctx context.Context, id int, deletedAt time.Time) error
+	SaveReconcileReport(ctx context.Context, checkedAt time.Time, issues []datastructs.ReconcileIssue) error
+
+	//replication
+	SaveArchiveCopy(ctx context.Context, c datastructs.ArchiveCopy) error
+	ArchiveCopies(ctx context.Context, id int) ([]datastructs.ArchiveCopy, error)
+	PendingArchiveCopies(ctx context.Context) ([]datastructs.ArchiveCopy, error)
+	SetArchiveCopiesStatus(ctx context.Context, id int, status string) error
+
+	//storage tiering
+	MoveArchive(ctx context.Context, id int, storage, fileName string) error
+
+	//storage trash
+	DeletedArchives(ctx context.Context, dataID int, from, to time.Time) ([]datastructs.ArchAvailableData, error)
+	MarkArchiveRestoredFromTrash(ctx context.Context, id int) error
+
+	//legal holds
+	ActiveLegalHolds(ctx context.Context) ([]datastructs.LegalHold, error)
+
+}
+
+// ArchiveDatabase keeps the archived rows in the tables of the separate archive database instead of the files.
+// The tables have the names of the archived tables, the rows are copied as the CSV with the header
+// written by CopyDataForDay and read by RestoreData of the Storer.
+type ArchiveDatabase interface {
+	// PrepareTable creates the schema and the table by the DDL of the archived table if they do not exist
+	PrepareTable(ctx context.Context, table, ddl string) error
+	// WriteRows replaces the rows of the day in the table, so the repeated backup of the day does not duplicate them
+	WriteRows(ctx context.Context, table, dateColumn string, day time.Time, rows io.Reader) (int64, error)
+	ReadRows(ctx context.Context, table, dateColumn string, day time.Time, w io.Writer) (int64, error)
+	// DeleteRows deletes the rows of the day, the table left without rows is kept, so the concurrent
+	// backup between PrepareTable and WriteRows does not lose its table
+	DeleteRows(ctx context.Context, table, dateColumn string, day time.Time) (int64, error)
+	Close()
+}
@@ -1,23 +1,75 @@
-package main
-
-import (
-	"flag"
-	"log"
-
-	"captura-backup/internal/service"
-)
-
-func main() {
-	info := flag.Bool("v", false, "will display the version of the program")
-	flag.Parse()
-	if *info {
-		service.Version()
-		return
-	}
-	srv, err := service.New()
-	if err != nil {
-		log.Fatalln("new service:", err)
-	}
-
-	srv.Start()
-}
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"captura-backup/internal/service"
+)
+
+func main() {
+	info := flag.Bool("v", false, "will display the version of the program")
+	verify := flag.Bool("verify", false, "will verify signatures and checksums of archives and exit")
+	from := flag.String("from", "0001-01-01", "the first content date of archives for verification or restore from trash, format 2006-01-02")
+	to := flag.String("to", time.Now().Format("2006-01-02"), "the last content date of archives for verification or restore from trash, format 2006-01-02")
+	dataID := flag.Int("data", 0, "data type ID of archives for verification or restore from trash, 0 means all")
+	rebuild := flag.Bool("rebuild-catalog", false, "will fill the catalog of available archives from the storage and exit, the database schema must be created before")
+	cleanup := flag.Bool("cleanup", false, "will remove archives by the retention rules and exit")
+	dryRun := flag.Bool("dry-run", false, "with -cleanup only reports archives that would be removed")
+	untrash := flag.Bool("restore-trash", false, "will move removed archives from the trash back into place and exit")
+	tiering := flag.Bool("tiering", false, "will move aged archives to the cold storages and exit")
+	flag.Parse()
+	if *info {
+		service.Version()
+		return
+	}
+	srv, err := service.New()
+	if err != nil {
+		log.Fatalln("new service:", err)
+	}
+
+	if *verify || *untrash {
+		fromDate, err := time.Parse("2006-01-02", *from)
+		if err != nil {
+			log.Fatalln("parse from date:", err)
+		}
+		toDate, err := time.Parse("2006-01-02", *to)
+		if err != nil {
+			log.Fatalln("parse to date:", err)
+		}
+		if *untrash {
+			if err := srv.RestoreFromTrash(*dataID, fromDate, toDate); err != nil {
+				log.Fatalln("restore from trash:", err)
+			}
+			return
+		}
+		if err := srv.Verify(*dataID, fromDate, toDate); err != nil {
+			log.Fatalln("verify archives:", err)
+		}
+		return
+	}
+
+	if *rebuild {
+		if err := srv.RebuildCatalog(); err != nil {
+			log.Fatalln("rebuild catalog:", err)
+		}
+		return
+	}
+
+	if *cleanup {
+		if err := srv.Cleanup(*dryRun); err != nil {
+			log.Fatalln("cleanup:", err)
+		}
+		return
+	}
+
+	if *tiering {
+		if err := srv.Tiering(); err != nil {
+			log.Fatalln("tiering:", err)
+		}
+		return
+	}
+
+	srv.Start()
+}
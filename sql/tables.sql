@@ -1,119 +1,234 @@
-DROP SCHEMA IF EXISTS archive_manager CASCADE;
-
-CREATE SCHEMA archive_manager;
-
-CREATE TABLE archive_manager.config_table_list (
-	id serial NOT NULL,
-	schemaname varchar(64) NOT NULL,
-	tblname_pattern varchar(64) NOT NULL,
-	arch_data_after int4 NULL,
-	arch_interval_name varchar(50) NOT NULL DEFAULT 'DAY'::character varying,
-	keep_arch_days int4 NOT NULL DEFAULT 0,
-	entity varchar NOT NULL DEFAULT 'table'::character varying,
-	condition_fmt text NULL,
-	date_clmn varchar(64) NULL,
-	tblname_date_fmt_sbstr varchar(25) NULL,
-	tblname_date_fmt_todate varchar(25) NULL,
-	restore_template varchar(64) NULL,
-	keep_restore_days int4 NULL,
-	CONSTRAINT config_table_list_id_key UNIQUE (id),
-	CONSTRAINT config_table_list_pkey PRIMARY KEY (tblname_pattern, schemaname)
-);
-
-COMMENT ON COLUMN archive_manager.config_table_list.keep_arch_days IS 'Setting responsible for two parameters. If the value is <0, then the data is simply deleted from the database without being saved. If the value is >= 0, then before deleting the data from the database, they are saved. At the same time, this value serves as an indication of how many days to store the saved data. If 0, then store forever.';
-COMMENT ON COLUMN archive_manager.config_table_list.arch_interval_name IS 'Available values: "DAY", "MONTH", "YEAR"';
-COMMENT ON COLUMN archive_manager.config_table_list.entity IS 'Available values: "record", "table"';
-
-INSERT INTO archive_manager.config_table_list (
-	schemaname,
-	tblname_pattern,
-	arch_data_after,
-	arch_interval_name,
-	keep_arch_days,
-	entity,
-	condition_fmt,
-	date_clmn,
-	tblname_date_fmt_sbstr,
-	tblname_date_fmt_todate,
-	restore_template,
-	keep_restore_days
-	)
-	VALUES
-	 ('sales','^RouteVKN\d*$',6,'MONTH',366,'record','"Gueltig_bis" < $1','"Gueltig_bis"',NULL,NULL,NULL,14),
-	 ('billdb_inv','^inv_\d*_\d*_cdr$',6,'MONTH',0,'table','SELECT format(''inv_%s_%s_cdr'', "CarrierID", "CarrierInvoiceID") tblname
-	FROM billdb."Bill_Invoice" WHERE "InvoiceDate" < $1','"ST_Date"',NULL,NULL,'billdb_inv._template_inv_cdr',14),
-	 ('logdb','^Log_(RT|SP)?\d{6}$',2,'YEAR',-1,'table',NULL,'"Date"','\d{6}','YYYYMM',NULL,NULL),
-	 ('lcr_db','^RB_P_\d*_\d*$',6,'MONTH',-1,'record','"Gueltigbis" < $1','"Gueltigbis"',NULL,NULL,NULL,NULL),
-	 ('billdb_rec','^rec_\d*_\d*_cdr$',6,'MONTH',0,'table','SELECT format(''rec_%s_%s_cdr'', "CarrierID", "InvoiceID") tblname
-	FROM billdb."BSup_Invoice" WHERE "InvoiceDate" < $1','"ST_Date"',NULL,NULL,'billdb_rec._template_rec_cdr',14),
-	 ('raterresult','^RT\d{8}$',6,'MONTH',0,'table',NULL,'"St_Date"','\d{8}','YYYYMMDD','raterresult._template_rt',14);
-
-CREATE TABLE archive_manager.schedule_settings (
-	data_id integer NOT NULL,
-	enabled bool NOT NULL DEFAULT true,
-	check_interval varchar(10) NOT NULL DEFAULT 'WEEK'::character varying,
-	check_interval_days _int4 NOT NULL DEFAULT ARRAY[6, 7],
-	work_start time NOT NULL DEFAULT '01:01:00'::time without time zone,
-	CONSTRAINT pk_schedule_settings PRIMARY KEY (data_id),
-	CONSTRAINT fk_schedule_settings FOREIGN KEY (data_id) REFERENCES archive_manager.config_table_list (id)
-	ON DELETE CASCADE ON UPDATE CASCADE	
-);
-
-COMMENT ON COLUMN archive_manager.schedule_settings.check_interval IS 'Determines when the service should back up - on certain days of the week or days of the month';
-COMMENT ON COLUMN archive_manager.schedule_settings.check_interval_days IS 'Specifies the days of the week or days of the month on which to run the backup';
-COMMENT ON COLUMN archive_manager.schedule_settings.work_start IS 'Backup start time';
-
-INSERT INTO archive_manager.schedule_settings (
-	data_id,
-	check_interval,
-	check_interval_days,
-	work_start
-)
-VALUES 
-	(1,'WEEK','{7}','00:00:00'),
-	(2,'WEEK','{7}','00:00:00'),
-	(3,'MONTH','{1}','00:00:00'),
-	(4,'MONTH','{1,15}','00:00:00'),
-	(5,'WEEK','{7}','00:00:00'),
-	(6,'WEEK','{7}','00:00:00');
-
-CREATE TABLE archive_manager.arch_available_data (
-	id serial NOT NULL,
-	data_id int4 NOT NULL,
-	schemaname varchar(64) NOT NULL,
-	tblname varchar(64) NOT NULL,
-	blsingle_tbl_arch bool NOT NULL,
-	file_name varchar NOT NULL,
-	content_date date NOT NULL,
-	content_rows int4 NOT NULL,
-	archived_at timestamptz NOT NULL DEFAULT now(),
-	restored_at timestamptz NULL,
-	deleted_at timestamptz NULL,
-	restore_template varchar NULL,
-	CONSTRAINT uniq_arch_available_data UNIQUE (schemaname, tblname, content_date),
-	CONSTRAINT pk_arch_available_data PRIMARY KEY (id)
-);
-
-CREATE TABLE archive_manager.pr_arch_tbls (
-	tblname varchar(130) NOT NULL,
-	tid int4 NOT NULL,
-	entity varchar(25) NULL,
-	date_clmn varchar(64) NULL,
-	condtion_fmt varchar(100) NULL,
-	rm_interval varchar(25) NULL,
-	do_backup bool NULL,
-	CONSTRAINT pr_arch_tbls_pkey PRIMARY KEY (tblname)
-);
-
-CREATE TABLE archive_manager.control (
-	stop_manager bool NOT NULL DEFAULT false,
-	reload_config bool NOT NULL DEFAULT false,
-	start_recovery bool NOT NULL DEFAULT false,
-	restore_to_this_date date NULL,
-	start_manual_backup bool NOT NULL DEFAULT false,
-	type_archive integer NULL, --all = 0 id from config_table_list
-	message text NULL,
-	current_state text NOT NULL
-);
-
-INSERT INTO archive_manager.control (stop_manager,current_state) VALUES (true,'Service stopped...');
+DROP SCHEMA IF EXISTS archive_manager CASCADE;
+
+CREATE SCHEMA archive_manager;
+
+CREATE TABLE archive_manager.config_table_list (
+	id serial NOT NULL,
+	schemaname varchar(64) NOT NULL,
+	tblname_pattern varchar(64) NOT NULL,
+	arch_data_after int4 NULL,
+	arch_interval_name varchar(50) NOT NULL DEFAULT 'DAY'::character varying,
+	keep_arch_days int4 NOT NULL DEFAULT 0,
+	entity varchar NOT NULL DEFAULT 'table'::character varying,
+	condition_fmt text NULL,
+	date_clmn varchar(64) NULL,
+	tblname_date_fmt_sbstr varchar(25) NULL,
+	tblname_date_fmt_todate varchar(25) NULL,
+	restore_template varchar(64) NULL,
+	keep_restore_days int4 NULL,
+	keep_months int4 NOT NULL DEFAULT 0,
+	keep_last int4 NOT NULL DEFAULT 0,
+	keep_yearly bool NOT NULL DEFAULT false,
+	archive_action varchar(25) NOT NULL DEFAULT 'export'::character varying,
+	archive_schema varchar(64) NULL,
+	archive_tablespace varchar(64) NULL,
+	CONSTRAINT config_table_list_archive_action_check CHECK (archive_action = 'export' OR archive_action = 'move' AND entity = 'table' AND (archive_schema IS NOT NULL OR archive_tablespace IS NOT NULL)),
+	CONSTRAINT config_table_list_id_key UNIQUE (id),
+	CONSTRAINT config_table_list_pkey PRIMARY KEY (tblname_pattern, schemaname)
+);
+
+COMMENT ON COLUMN archive_manager.config_table_list.keep_arch_days IS 'Setting responsible for two parameters. If the value is <0, then the data is simply deleted from the database without being saved. If the value is >= 0, then before deleting the data from the database, they are saved. At the same time, this value serves as an indication of how many days to store the saved data. If 0, then store forever.';
+COMMENT ON COLUMN archive_manager.config_table_list.keep_months IS 'Retention of archives with keep_arch_days > 0: the last archive of each month is kept for this number of months, 0 - not kept longer than daily archives';
+COMMENT ON COLUMN archive_manager.config_table_list.keep_last IS 'Retention of archives with keep_arch_days > 0: the archives of the last N content dates are kept regardless of their age';
+COMMENT ON COLUMN archive_manager.config_table_list.keep_yearly IS 'Retention of archives with keep_arch_days > 0: the last archive of each year is kept forever';
+COMMENT ON COLUMN archive_manager.config_table_list.archive_action IS 'Available values: "export" - the data is copied to the storage and deleted, "move" - the expired table of the "table" entity is moved to archive_schema and/or archive_tablespace with ALTER TABLE and stays queryable there, the restore moves it back';
+COMMENT ON COLUMN archive_manager.config_table_list.arch_interval_name IS 'Available values: "DAY", "MONTH", "YEAR"';
+COMMENT ON COLUMN archive_manager.config_table_list.entity IS 'Available values: "record", "table", "partition" - tblname_pattern matches the partitioned tables, their partitions with the upper bound of the range older than arch_data_after are archived, detached and dropped';
+
+INSERT INTO archive_manager.config_table_list (
+	schemaname,
+	tblname_pattern,
+	arch_data_after,
+	arch_interval_name,
+	keep_arch_days,
+	entity,
+	condition_fmt,
+	date_clmn,
+	tblname_date_fmt_sbstr,
+	tblname_date_fmt_todate,
+	restore_template,
+	keep_restore_days
+	)
+	VALUES
+	 ('sales','^RouteVKN\d*$',6,'MONTH',366,'record','"Gueltig_bis" < $1','"Gueltig_bis"',NULL,NULL,NULL,14),
+	 ('billdb_inv','^inv_\d*_\d*_cdr$',6,'MONTH',0,'table','SELECT format(''inv_%s_%s_cdr'', "CarrierID", "CarrierInvoiceID") tblname
+	FROM billdb."Bill_Invoice" WHERE "InvoiceDate" < $1','"ST_Date"',NULL,NULL,'billdb_inv._template_inv_cdr',14),
+	 ('logdb','^Log_(RT|SP)?\d{6}$',2,'YEAR',-1,'table',NULL,'"Date"','\d{6}','YYYYMM',NULL,NULL),
+	 ('lcr_db','^RB_P_\d*_\d*$',6,'MONTH',-1,'record','"Gueltigbis" < $1','"Gueltigbis"',NULL,NULL,NULL,NULL),
+	 ('billdb_rec','^rec_\d*_\d*_cdr$',6,'MONTH',0,'table','SELECT format(''rec_%s_%s_cdr'', "CarrierID", "InvoiceID") tblname
+	FROM billdb."BSup_Invoice" WHERE "InvoiceDate" < $1','"ST_Date"',NULL,NULL,'billdb_rec._template_rec_cdr',14),
+	 ('raterresult','^RT\d{8}$',6,'MONTH',0,'table',NULL,'"St_Date"','\d{8}','YYYYMMDD','raterresult._template_rt',14);
+
+CREATE TABLE archive_manager.schedule_settings (
+	data_id integer NOT NULL,
+	enabled bool NOT NULL DEFAULT true,
+	check_interval varchar(10) NOT NULL DEFAULT 'WEEK'::character varying,
+	check_interval_days _int4 NOT NULL DEFAULT ARRAY[6, 7],
+	work_start time NOT NULL DEFAULT '01:01:00'::time without time zone,
+	CONSTRAINT pk_schedule_settings PRIMARY KEY (data_id),
+	CONSTRAINT fk_schedule_settings FOREIGN KEY (data_id) REFERENCES archive_manager.config_table_list (id)
+	ON DELETE CASCADE ON UPDATE CASCADE	
+);
+
+COMMENT ON COLUMN archive_manager.schedule_settings.check_interval IS 'Determines when the service should back up - on certain days of the week or days of the month';
+COMMENT ON COLUMN archive_manager.schedule_settings.check_interval_days IS 'Specifies the days of the week or days of the month on which to run the backup';
+COMMENT ON COLUMN archive_manager.schedule_settings.work_start IS 'Backup start time';
+
+INSERT INTO archive_manager.schedule_settings (
+	data_id,
+	check_interval,
+	check_interval_days,
+	work_start
+)
+VALUES 
+	(1,'WEEK','{7}','00:00:00'),
+	(2,'WEEK','{7}','00:00:00'),
+	(3,'MONTH','{1}','00:00:00'),
+	(4,'MONTH','{1,15}','00:00:00'),
+	(5,'WEEK','{7}','00:00:00'),
+	(6,'WEEK','{7}','00:00:00');
+
+CREATE TABLE archive_manager.arch_available_data (
+	id serial NOT NULL,
+	data_id int4 NOT NULL,
+	schemaname varchar(64) NOT NULL,
+	tblname varchar(64) NOT NULL,
+	blsingle_tbl_arch bool NOT NULL,
+	file_name varchar NOT NULL,
+	content_date date NOT NULL,
+	content_rows int4 NOT NULL,
+	archived_at timestamptz NOT NULL DEFAULT now(),
+	restored_at timestamptz NULL,
+	deleted_at timestamptz NULL,
+	restore_template varchar NULL,
+	key_id varchar NULL,
+	file_size int8 NULL,
+	checksum varchar(64) NULL,
+	storage_name varchar NULL,
+	partition_parent varchar NULL,
+	partition_bound text NULL,
+	archive_action varchar(25) NULL,
+	source_tablespace varchar(64) NULL,
+	table_ddl text NULL,
+	CONSTRAINT uniq_arch_available_data UNIQUE (schemaname, tblname, content_date),
+	CONSTRAINT pk_arch_available_data PRIMARY KEY (id)
+);
+
+COMMENT ON COLUMN archive_manager.arch_available_data.key_id IS 'Identifier of the key the archive file is encrypted with, NULL if the file is not encrypted';
+COMMENT ON COLUMN archive_manager.arch_available_data.storage_name IS 'Name of the storage the archive file is written to, NULL - the default storage from the [storage] section of the config';
+COMMENT ON COLUMN archive_manager.arch_available_data.partition_parent IS 'Partitioned table of the archived partition, the restore recreates the partition and attaches it with the partition_bound (FOR VALUES ...)';
+COMMENT ON COLUMN archive_manager.arch_available_data.archive_action IS '"move" - the table is moved in the database, file_name is the moved table and source_tablespace is the tablespace the restore moves it back to, NULL - the archive is exported to the storage';
+COMMENT ON COLUMN archive_manager.arch_available_data.table_ddl IS 'Definition of the archived single table at the backup (columns, defaults, constraints without foreign keys, indexes), the restore creates the table by it if restore_template is not set or differs from the current template. It is also kept in the gzip header of the archive file';
+COMMENT ON COLUMN archive_manager.arch_available_data.checksum IS 'SHA-256 checksum of the archive data before encryption, file_size is the size of the stored file';
+
+CREATE TABLE archive_manager.arch_copies (
+	available_data_id int4 NOT NULL,
+	storage_name varchar(64) NOT NULL,
+	file_name varchar NOT NULL,
+	status varchar(16) NOT NULL,
+	attempts int4 NOT NULL DEFAULT 0,
+	last_error text NULL,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT pk_arch_copies PRIMARY KEY (available_data_id, storage_name),
+	CONSTRAINT fk_arch_copies_available_data FOREIGN KEY (available_data_id) REFERENCES archive_manager.arch_available_data(id) ON DELETE CASCADE
+);
+
+COMMENT ON TABLE archive_manager.arch_copies IS 'Copies of the archives in the replica storages, the primary copy is described in arch_available_data';
+COMMENT ON COLUMN archive_manager.arch_copies.status IS 'Available values: "ok", "pending" - the copy is not written yet and will be retried, "deleted"';
+
+CREATE TABLE archive_manager.storage_settings (
+	data_id int4 NOT NULL,
+	storage_name varchar(64) NOT NULL,
+	storage_path varchar NOT NULL,
+	use_sftp bool NOT NULL DEFAULT false,
+	storage_period int4 NULL,
+	auto_cleaning bool NOT NULL DEFAULT false,
+	CONSTRAINT pk_storage_settings PRIMARY KEY (data_id)
+);
+
+COMMENT ON TABLE archive_manager.storage_settings IS 'The archives of the data type are written to the named storage instead of the default one from the config';
+
+CREATE TABLE archive_manager.config_sftp (
+	storage_name varchar(64) NOT NULL,
+	host varchar NULL,
+	port varchar NULL,
+	username varchar NULL,
+	pass varchar NULL,
+	auth_method varchar NULL,
+	time_out int4 NULL,
+	privat_key varchar NULL,
+	CONSTRAINT pk_config_sftp PRIMARY KEY (storage_name)
+);
+
+CREATE TABLE archive_manager.reconcile_report (
+	id serial NOT NULL,
+	checked_at timestamptz NOT NULL,
+	available_data_id int4 NULL,
+	issue varchar(32) NOT NULL,
+	file_name varchar NOT NULL,
+	details text NULL,
+	fixed bool NOT NULL DEFAULT false,
+	CONSTRAINT pk_reconcile_report PRIMARY KEY (id)
+);
+
+COMMENT ON COLUMN archive_manager.reconcile_report.issue IS 'orphaned_file, missing_file, size_mismatch or deleted_file_exists';
+COMMENT ON COLUMN archive_manager.reconcile_report.fixed IS 'The issue was fixed by the reconciliation in the fix mode';
+
+CREATE TABLE archive_manager.legal_hold (
+	id serial NOT NULL,
+	data_id int4 NULL,
+	schemaname varchar(64) NULL,
+	date_from date NULL,
+	date_to date NULL,
+	available_data_id int4 NULL,
+	reason text NOT NULL,
+	placed_by varchar NOT NULL,
+	placed_at timestamptz NOT NULL DEFAULT now(),
+	released_by varchar NULL,
+	released_at timestamptz NULL,
+	CONSTRAINT pk_legal_hold PRIMARY KEY (id),
+	CONSTRAINT chk_legal_hold_scope CHECK (COALESCE(data_id::text, schemaname, date_from::text, date_to::text, available_data_id::text) IS NOT NULL)
+);
+
+COMMENT ON TABLE archive_manager.legal_hold IS 'The archives and the source data covered by an active hold (released_at IS NULL) are not deleted by the cleaner and the backup. All the set conditions must match, the empty ones match any value';
+
+CREATE TABLE archive_manager.legal_hold_audit (
+	id serial NOT NULL,
+	hold_id int4 NOT NULL,
+	action varchar(16) NOT NULL,
+	done_by varchar NOT NULL,
+	done_at timestamptz NOT NULL DEFAULT now(),
+	comment text NULL,
+	CONSTRAINT pk_legal_hold_audit PRIMARY KEY (id)
+);
+
+COMMENT ON COLUMN archive_manager.legal_hold_audit.action IS 'Available values: "placed", "released"';
+
+CREATE TABLE archive_manager.pr_arch_tbls (
+	tblname varchar(130) NOT NULL,
+	tid int4 NOT NULL,
+	entity varchar(25) NULL,
+	date_clmn varchar(64) NULL,
+	condtion_fmt varchar(100) NULL,
+	rm_interval varchar(25) NULL,
+	do_backup bool NULL,
+	parent_tbl varchar(130) NULL,
+	partition_bound text NULL,
+	CONSTRAINT pr_arch_tbls_pkey PRIMARY KEY (tblname)
+);
+
+CREATE TABLE archive_manager.control (
+	stop_manager bool NOT NULL DEFAULT false,
+	reload_config bool NOT NULL DEFAULT false,
+	start_recovery bool NOT NULL DEFAULT false,
+	restore_to_this_date date NULL,
+	start_manual_backup bool NOT NULL DEFAULT false,
+	type_archive integer NULL, --all = 0 id from config_table_list
+	start_key_rotation bool NOT NULL DEFAULT false,
+	start_reconcile bool NOT NULL DEFAULT false,
+	reconcile_fix bool NOT NULL DEFAULT false,
+	message text NULL,
+	current_state text NOT NULL
+);
+
+INSERT INTO archive_manager.control (stop_manager,current_state) VALUES (true,'Service stopped...');